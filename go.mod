@@ -1,49 +1,68 @@
 module github.com/jursonmo/practise
 
-go 1.15
+go 1.18
 
 require (
 	github.com/EDDYCJY/go-grpc-example v0.0.0-20181014074047-0f68708edbcb
 	github.com/afex/hystrix-go v0.0.0-20180502004556-fa1af6a1f4f5
 	github.com/apache/rocketmq-client-go/v2 v2.1.0
-	github.com/arl/statsviz v0.5.1 // indirect
-	github.com/bluele/gcache v0.0.2 // indirect
 	github.com/containernetworking/cni v1.0.1
 	github.com/containernetworking/plugins v1.0.2-0.20211006153910-f1f128e3c922
-	github.com/go-mods/zerolog-rotate v1.0.2 // indirect
+	github.com/golang-jwt/jwt/v4 v4.5.2
+	github.com/golang/snappy v0.0.4
 	github.com/google/gops v0.3.22
 	github.com/grpc-ecosystem/go-grpc-middleware v1.3.0
 	github.com/hashicorp/memberlist v0.2.0
-	github.com/iancoleman/strcase v0.2.0 // indirect
-	github.com/influxdata/influxdb v1.9.5 // indirect
 	github.com/influxdata/influxdb-client-go/v2 v2.5.1
 	github.com/influxdata/influxdb1-client v0.0.0-20191209144304-8bf82d3c094d
 	github.com/iovisor/gobpf v0.2.0
 	github.com/j-keck/arping v1.0.2
 	github.com/jursonmo/go-tcpinfo v0.2.1
-	github.com/lucas-clemente/quic-go v0.30.0 // indirect
+	github.com/klauspost/compress v1.15.9
 	github.com/networkop/xdp-xconnect v0.0.0-20210308194118-1e1a8482c3bc
 	github.com/pborman/uuid v1.2.0
+	github.com/pierrec/lz4/v4 v4.1.15
+	github.com/prometheus/client_golang v1.11.0
 	github.com/rcrowley/go-metrics v0.0.0-20201227073835-cf1acfcdf475
-	github.com/rfyiamcool/backoff v1.1.0 // indirect
-	github.com/rogpeppe/go-internal v1.8.1 // indirect
-	github.com/rs/zerolog v1.26.1 // indirect
-	github.com/songgao/packets v0.0.0-20160404182456-549a10cd4091 // indirect
-	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8 // indirect
+	github.com/rfyiamcool/backoff v1.1.0
 	github.com/tal-tech/go-queue v1.0.7
 	github.com/tevjef/go-runtime-metrics v0.0.0-20170326170900-527a54029307
 	github.com/vishvananda/netlink v1.1.1-0.20210330154013-f5de75959ad5
+	github.com/vmihailenco/msgpack/v5 v5.4.1
 	github.com/vrischmann/go-metrics-influxdb v0.1.1
 	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.27.0
 	go.opentelemetry.io/otel v1.2.0
 	go.opentelemetry.io/otel/exporters/jaeger v1.2.0
-	go.opentelemetry.io/otel/exporters/trace/jaeger v0.20.0 // indirect
 	go.opentelemetry.io/otel/sdk v1.2.0
 	go.opentelemetry.io/otel/trace v1.2.0
-	golang.org/x/net v0.0.0-20220722155237-a158d28d115b // indirect
-	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f
+	golang.org/x/net v0.7.0
+	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4
+	golang.org/x/sys v0.5.0
 	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
 	google.golang.org/grpc v1.40.0
 	google.golang.org/grpc/examples v0.0.0-20210924222925-11437f66f20f
+	google.golang.org/protobuf v1.28.0
+)
+
+require (
+	github.com/arl/statsviz v0.5.1 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/bluele/gcache v0.0.2 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/go-mods/zerolog-rotate v1.0.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/iancoleman/strcase v0.2.0 // indirect
+	github.com/influxdata/influxdb v1.9.5 // indirect
+	github.com/lucas-clemente/quic-go v0.30.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.2-0.20181231171920-c182affec369 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.26.0 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
+	github.com/rogpeppe/go-internal v1.8.1 // indirect
+	github.com/rs/zerolog v1.26.1 // indirect
+	github.com/songgao/packets v0.0.0-20160404182456-549a10cd4091 // indirect
+	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	go.opentelemetry.io/otel/exporters/trace/jaeger v0.20.0 // indirect
 	gopkg.in/DataDog/dd-trace-go.v1 v1.34.0 // indirect
 )
@@ -3,6 +3,7 @@ package dial
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"math"
 	"net"
 	"net/url"
@@ -72,8 +73,18 @@ type DialConfig struct {
 	TcpUserTimeout time.Duration //for linux: use socket option: tcp_user_timeout
 	BackOff        backoffx.Backoffer
 	MaxDial        int64 //max dial times, default MaxInt64, but use ctx to control dial is better way
-	DialFailFunc   func(error)
+	DialFailFunc   func(error)   //每个地址连接失败时调用, err 是*DialError
+	AttemptDelay   time.Duration //Happy Eyeballs 开始连接下一个地址之前等待的时间, 见happyeyeballs.go
 	//Dial(network, address string) (net.Conn, error)
+
+	//for tls://, see tls.go
+	TLSConfig          *tls.Config //base config, 下面的选项会覆盖它的对应字段
+	CAFile             string      //PEM, 用来验证server 的证书, 默认用系统的CA
+	CertFile           string      //client 证书, 用于mTLS
+	KeyFile            string
+	ServerName         string   //SNI 和验证证书用的名字, 默认是地址里的host
+	PinnedSPKI         [][]byte //server 证书链里必须有一个证书的SPKI sha256 跟其中一个相同
+	InsecureSkipVerify bool     //不验证server 的证书, 只用于测试; 设置了PinnedSPKI 仍然会检查
 }
 
 func NewDefDialConfig() *DialConfig {
@@ -81,6 +92,8 @@ func NewDefDialConfig() *DialConfig {
 		Timeout: 3 * time.Second,
 		BackOff: backoff.NewBackOff(backoff.WithMinDelay(2*time.Second), backoff.WithMaxDelay(10*time.Second)),
 		MaxDial: math.MaxInt64, //default dial forever until ctx cancel or timeout
+
+		AttemptDelay: DefaultAttemptDelay,
 	}
 }
 
@@ -144,50 +157,45 @@ func WithDialFailFunc(f func(error)) DialOption {
 }
 
 // dial until success or ctx error
+// addr 的host 是域名时解析出所有的A/AAAA 记录, 用Happy Eyeballs 的方式同时连接, 见DialAny
 func Dial(ctx context.Context, addr string, options ...DialOption) (conn net.Conn, err error) {
+	return DialAny(ctx, []string{addr}, options...)
+}
+
+// DialAny 同时连接addrs 里的所有地址(域名解析出的所有地址), 每隔AttemptDelay 开始连接下一个地址, 第一个连上的胜出, 其他的关闭;
+// 每个地址连接失败都会调用DialFailFunc, 参数是*DialError; 所有地址都失败了就backoff 后重试, 直到成功或者ctx 结束
+func DialAny(ctx context.Context, addrs []string, options ...DialOption) (conn net.Conn, err error) {
 	c := NewDefDialConfig()
 	for _, opt := range options {
 		opt(c)
 	}
-	network, err := url.Parse(addr)
-	if err != nil {
-		return nil, err
-	}
-
-	type dialContexter interface {
-		DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	if len(addrs) == 0 {
+		return nil, ErrNoAddress
 	}
-	var dialer dialContexter
-
-	control := TcpUserTimeoutControl(c.TcpUserTimeout)
-	switch network.Scheme {
-	case "tls":
-		tlsconf := &tls.Config{
-			InsecureSkipVerify: true,
-			MinVersion:         tls.VersionTLS11,
-			//CipherSuites:       NO_DES,
-			CipherSuites: SecureCipherSuites(), //tls.InsecureCipherSuites() 包含不安全的加密套件, 可以查看这些不安全的套件是哪些
+	endpoints := make([]*url.URL, 0, len(addrs))
+	var tlsconf *tls.Config
+	for _, addr := range addrs {
+		endpoint, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := dialNetworks[endpoint.Scheme]; !ok {
+			return nil, fmt.Errorf("unsupported scheme:%s in %s", endpoint.Scheme, addr)
 		}
-		//conn, err = tls.Dial("tcp", network.Host, tlsconf)
-		//conn, err = tls.DialWithDialer(&net.Dialer{Timeout: c.Timeout}, "tcp", network.Host, tlsconf)
-		td := &tls.Dialer{NetDialer: &net.Dialer{Timeout: c.Timeout, Control: control, KeepAlive: c.KeepAlive}, Config: tlsconf}
-		//conn, err = td.DialContext(ctx, "tcp", network.Host)
-		dialer = td
-	case "tcp":
-		d := &net.Dialer{Timeout: c.Timeout, Control: control, KeepAlive: c.KeepAlive}
-		//conn, err = d.DialContext(ctx, "tcp", network.Host)
-		dialer = d
+		if endpoint.Scheme == "tls" && tlsconf == nil {
+			if tlsconf, err = c.tlsConfig(); err != nil {
+				return nil, err
+			}
+		}
+		endpoints = append(endpoints, endpoint)
 	}
 
 	for i := 0; i < int(c.MaxDial); i++ {
-		conn, err = dialer.DialContext(ctx, "tcp", network.Host)
+		conn, err = c.dialOnce(ctx, endpoints, tlsconf)
 		if err == nil {
 			c.BackOff.Reset()
 			break
 		}
-		if c.DialFailFunc != nil {
-			c.DialFailFunc(err)
-		}
 		// if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded){
 		// 	return nil, err
 		// }
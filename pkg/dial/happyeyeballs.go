@@ -0,0 +1,225 @@
+package dial
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+//Happy Eyeballs(RFC 8305): 域名解析出所有地址后ipv6 和ipv4 交替排列, 先连第一个地址, 每隔AttemptDelay
+//或者前一个失败时再开始连下一个, 第一个连上的胜出, 其他的取消或者关闭; tls 要握手成功才算连上, 握手失败就接着连下一个
+
+//DefaultAttemptDelay RFC 8305 推荐的Connection Attempt Delay
+var DefaultAttemptDelay = 250 * time.Millisecond
+
+var ErrNoAddress = errors.New("no address to dial")
+
+//scheme -> network
+var dialNetworks = map[string]string{
+	"tcp":        "tcp",
+	"tcp4":       "tcp4",
+	"tcp6":       "tcp6",
+	"tls":        "tcp",
+	"unix":       "unix",
+	"unixpacket": "unixpacket",
+}
+
+//DialError DialFailFunc 收到的错误, Addr 是具体连接的地址, 比如tls://[2001:db8::1]:443
+type DialError struct {
+	Addr string
+	Err  error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("dial %s err:%v", e.Addr, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+//WithAttemptDelay Happy Eyeballs 开始连接下一个地址之前等待的时间, 默认DefaultAttemptDelay
+func WithAttemptDelay(d time.Duration) DialOption {
+	return func(c *DialConfig) {
+		c.AttemptDelay = d
+	}
+}
+
+//dialTarget 一个具体的地址
+type dialTarget struct {
+	endpoint *url.URL
+	network  string //tcp4, tcp6, unix, unixpacket
+	addr     string //ip:port 或者socket 文件路径
+}
+
+func (t dialTarget) String() string {
+	return t.endpoint.Scheme + "://" + t.addr
+}
+
+//resolve 解析所有endpoint, ipv6 和ipv4 交替排列
+func (c *DialConfig) resolve(ctx context.Context, endpoints []*url.URL) ([]dialTarget, error) {
+	var v6, v4 []dialTarget
+	var firstErr error
+	for _, endpoint := range endpoints {
+		network := dialNetworks[endpoint.Scheme]
+		if network == "unix" || network == "unixpacket" {
+			v4 = append(v4, dialTarget{endpoint: endpoint, network: network, addr: unixAddr(endpoint)})
+			continue
+		}
+		host, port, err := net.SplitHostPort(endpoint.Host)
+		if err != nil {
+			return nil, err
+		}
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				err = &DialError{Addr: endpoint.String(), Err: err}
+				if c.DialFailFunc != nil {
+					c.DialFailFunc(err)
+				}
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			for _, addr := range addrs {
+				ips = append(ips, addr.IP)
+			}
+		}
+		for _, ip := range ips {
+			t := dialTarget{endpoint: endpoint, addr: net.JoinHostPort(ip.String(), port)}
+			if ip.To4() != nil {
+				if network == "tcp6" {
+					continue
+				}
+				t.network = "tcp4"
+				v4 = append(v4, t)
+			} else {
+				if network == "tcp4" {
+					continue
+				}
+				t.network = "tcp6"
+				v6 = append(v6, t)
+			}
+		}
+	}
+	targets := make([]dialTarget, 0, len(v6)+len(v4))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			targets = append(targets, v6[i])
+		}
+		if i < len(v4) {
+			targets = append(targets, v4[i])
+		}
+	}
+	if len(targets) == 0 {
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		return nil, ErrNoAddress
+	}
+	return targets, nil
+}
+
+//dialOnce 所有地址都连一次, 返回第一个连上的, 都失败时返回第一个错误
+func (c *DialConfig) dialOnce(ctx context.Context, endpoints []*url.URL, tlsconf *tls.Config) (net.Conn, error) {
+	targets, err := c.resolve(ctx, endpoints)
+	if err != nil {
+		return nil, err
+	}
+	return c.race(ctx, targets, tlsconf)
+}
+
+func (c *DialConfig) race(ctx context.Context, targets []dialTarget, tlsconf *tls.Config) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		t    dialTarget
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(targets))
+	d := &net.Dialer{Timeout: c.Timeout, KeepAlive: c.KeepAlive}
+	next, pending := 0, 0
+	var delay <-chan time.Time
+	start := func() {
+		t := targets[next]
+		next++
+		pending++
+		go func() {
+			dialer := *d
+			if t.network == "tcp4" || t.network == "tcp6" {
+				dialer.Control = TcpUserTimeoutControl(c.TcpUserTimeout)
+			}
+			conn, err := dialer.DialContext(ctx, t.network, t.addr)
+			if err == nil && t.endpoint.Scheme == "tls" {
+				conn, err = c.handshake(ctx, t, conn, tlsconf)
+			}
+			results <- result{t: t, conn: conn, err: err}
+		}()
+		delay = nil
+		if next < len(targets) {
+			delay = time.After(c.AttemptDelay)
+		}
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		select {
+		case <-delay:
+			start()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				//其他还在连接的都取消, 已经连上的关闭
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			err := &DialError{Addr: r.t.String(), Err: r.err}
+			if c.DialFailFunc != nil && ctx.Err() == nil {
+				c.DialFailFunc(err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if next < len(targets) {
+				start()
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+//handshake ServerName 默认是地址里的host, 不是解析出来的ip
+func (c *DialConfig) handshake(ctx context.Context, t dialTarget, conn net.Conn, tlsconf *tls.Config) (net.Conn, error) {
+	if tlsconf.ServerName == "" {
+		tlsconf = tlsconf.Clone()
+		tlsconf.ServerName = t.endpoint.Hostname()
+	}
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	tconn := tls.Client(conn, tlsconf)
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
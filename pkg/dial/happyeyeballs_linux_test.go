@@ -0,0 +1,63 @@
+package dial
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jursonmo/practise/pkg/backoffx"
+)
+
+//blackhole backlog 为0 的listener, 不accept, accept 队列满了之后内核丢掉SYN, connect 一直没有回应
+func blackhole(t *testing.T) string {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err = syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+	//填满accept 队列
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Millisecond*100)
+		if err != nil {
+			break
+		}
+		t.Cleanup(func() { conn.Close() })
+	}
+	return "tcp://" + addr
+}
+
+func TestDialRaceBlackhole(t *testing.T) {
+	hole := blackhole(t)
+	good := startTestServer(t, []string{"tcp://127.0.0.1:0"}).testAddr(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	start := time.Now()
+	conn, err := DialAny(ctx, []string{hole, good}, WithMaxDial(1), WithBackOffer(backoffx.NewLinearBackoff(0)),
+		WithTimeout(time.Second*3), WithAttemptDelay(time.Millisecond*50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//黑洞的地址先连, AttemptDelay 之后开始连第二个, 不用等黑洞超时
+	if cost := time.Since(start); cost < time.Millisecond*50 || cost > time.Second {
+		t.Fatalf("unexpect cost:%v", cost)
+	}
+	if "tcp://"+conn.RemoteAddr().String() != good {
+		t.Fatalf("connect to %v, expect:%s", conn.RemoteAddr(), good)
+	}
+}
@@ -0,0 +1,93 @@
+package dial
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jursonmo/practise/pkg/backoffx"
+)
+
+func TestResolveInterleave(t *testing.T) {
+	var endpoints []*url.URL
+	for _, addr := range []string{"tcp://127.0.0.1:1", "tcp://127.0.0.2:1", "tcp://[::1]:1", "tcp6://127.0.0.3:1"} {
+		u, _ := url.Parse(addr)
+		endpoints = append(endpoints, u)
+	}
+	targets, err := NewDefDialConfig().resolve(context.Background(), endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//ipv6 先, 然后交替; tcp6:// 跳过ipv4 地址
+	expect := []string{"tcp://[::1]:1", "tcp://127.0.0.1:1", "tcp://127.0.0.2:1"}
+	if len(targets) != len(expect) {
+		t.Fatalf("targets:%v", targets)
+	}
+	for i, target := range targets {
+		if target.String() != expect[i] {
+			t.Fatalf("targets:%v, expect:%v", targets, expect)
+		}
+	}
+}
+
+//race 的胜出者tls 握手失败时, 接着连下一个地址
+func TestDialTLSFallback(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	goodCert, goodKey := filepath.Join(dir, "good.pem"), filepath.Join(dir, "good.key")
+	ca.issue(t, goodCert, goodKey)
+	other := newTestCA(t, t.TempDir())
+	badCert, badKey := filepath.Join(dir, "bad.pem"), filepath.Join(dir, "bad.key")
+	other.issue(t, badCert, badKey)
+
+	bad := startTestServer(t, []string{"tls://127.0.0.1:0"}, WithServerCert(badCert, badKey)).testAddr(0)
+	good := startTestServer(t, []string{"tls://127.0.0.1:0"}, WithServerCert(goodCert, goodKey)).testAddr(0)
+
+	var mu sync.Mutex
+	var fails []error
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	start := time.Now()
+	//AttemptDelay 很大, 只有前一个失败才会马上连下一个
+	conn, err := DialAny(ctx, []string{bad, good}, WithMaxDial(1), WithBackOffer(backoffx.NewLinearBackoff(0)),
+		WithAttemptDelay(time.Second*2), WithCAFile(ca.file), WithDialFailFunc(func(err error) {
+			mu.Lock()
+			fails = append(fails, err)
+			mu.Unlock()
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if cost := time.Since(start); cost > time.Second {
+		t.Fatalf("fallback too slow:%v", cost)
+	}
+	if "tls://"+conn.RemoteAddr().String() != good {
+		t.Fatalf("connect to %v, expect:%s", conn.RemoteAddr(), good)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var de *DialError
+	if len(fails) != 1 || !errors.As(fails[0], &de) || de.Addr != bad {
+		t.Fatalf("fails:%v", fails)
+	}
+}
+
+func TestDialAllFail(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "tcp://" + l.Addr().String()
+	l.Close()
+	_, err = testDial(addr)
+	var de *DialError
+	if !errors.As(err, &de) || de.Addr != addr {
+		t.Fatalf("expect DialError of %s, err:%v", addr, err)
+	}
+}
@@ -0,0 +1,296 @@
+package dial
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jursonmo/practise/pkg/tokenbucket"
+)
+
+//连接数限制和accept 限速, 超过限制的连接默认accept 后马上关闭, WithQueueOverLimit 时先不accept, 让连接在内核的backlog 里排队;
+//每个IP 的连接数要accept 后才知道对端地址, 所以总是直接关闭
+
+//WithMaxConns 所有listener 总的最大连接数, <=0 表示不限制
+func WithMaxConns(n int) ServerOption {
+	return func(s *Server) {
+		s.limit.maxConns = n
+	}
+}
+
+//WithMaxConnsPerListener 每个listener 的最大连接数, <=0 表示不限制
+func WithMaxConnsPerListener(n int) ServerOption {
+	return func(s *Server) {
+		s.limit.maxLnConns = n
+	}
+}
+
+//WithMaxConnsPerIP 同一个源IP 的最大连接数, 对unix socket 不起作用
+func WithMaxConnsPerIP(n int) ServerOption {
+	return func(s *Server) {
+		s.limit.maxIPConns = n
+	}
+}
+
+//WithAcceptRate 所有listener 每秒最多accept rate 个连接, 最多burst 个突发
+func WithAcceptRate(rate float64, burst int) ServerOption {
+	return func(s *Server) {
+		s.limit.bucket = tokenbucket.New(rate, burst)
+		s.limit.rate = rate
+	}
+}
+
+//WithQueueOverLimit 超过总连接数, listener 连接数和accept 速率时不关闭连接, 等有空位时再accept
+func WithQueueOverLimit() ServerOption {
+	return func(s *Server) {
+		s.limit.queue = true
+	}
+}
+
+//LimitStats 连接限制的计数, 见Server.LimitStats
+type LimitStats struct {
+	Conns           int64  //当前的连接数
+	Accepted        uint64 //通过限制的连接
+	RejectedConns   uint64 //超过WithMaxConns 被关闭的连接
+	RejectedLnConns uint64 //超过WithMaxConnsPerListener 被关闭的连接
+	RejectedIPConns uint64 //超过WithMaxConnsPerIP 被关闭的连接
+	RejectedRate    uint64 //超过WithAcceptRate 被关闭的连接
+}
+
+//LimitStats 没有设置任何限制时返回零值
+func (s *Server) LimitStats() LimitStats {
+	l := &s.limit
+	if !l.enabled() {
+		return LimitStats{}
+	}
+	return LimitStats{
+		Conns:           atomic.LoadInt64(&l.conns),
+		Accepted:        atomic.LoadUint64(&l.accepted),
+		RejectedConns:   atomic.LoadUint64(&l.rejectedConns),
+		RejectedLnConns: atomic.LoadUint64(&l.rejectedLnConns),
+		RejectedIPConns: atomic.LoadUint64(&l.rejectedIPConns),
+		RejectedRate:    atomic.LoadUint64(&l.rejectedRate),
+	}
+}
+
+//connLimiter 所有listener 共用
+type connLimiter struct {
+	maxConns   int
+	maxLnConns int
+	maxIPConns int
+	bucket     *tokenbucket.Bucket
+	rate       float64
+	queue      bool
+
+	sem     chan struct{} //总连接数
+	ipMu    sync.Mutex
+	ipConns map[string]int
+
+	conns           int64
+	accepted        uint64
+	rejectedConns   uint64
+	rejectedLnConns uint64
+	rejectedIPConns uint64
+	rejectedRate    uint64
+}
+
+func (l *connLimiter) enabled() bool {
+	return l.maxConns > 0 || l.maxLnConns > 0 || l.maxIPConns > 0 || l.bucket != nil
+}
+
+func (l *connLimiter) init() {
+	if l.maxConns > 0 {
+		l.sem = make(chan struct{}, l.maxConns)
+	}
+	if l.maxIPConns > 0 {
+		l.ipConns = make(map[string]int)
+	}
+}
+
+//wrap 在tls 之前包装原始的listener, 这样被拒绝的连接不用tls 握手
+func (l *connLimiter) wrap(ln net.Listener) net.Listener {
+	ll := &limitListener{Listener: ln, limit: l, done: make(chan struct{})}
+	if l.maxLnConns > 0 {
+		ll.sem = make(chan struct{}, l.maxLnConns)
+	}
+	return ll
+}
+
+//acquire queue 时一直等到有空位, 否则没有空位马上返回false
+func acquire(sem chan struct{}, queue bool, done <-chan struct{}) bool {
+	if sem == nil {
+		return true
+	}
+	if queue {
+		select {
+		case sem <- struct{}{}:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func release(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
+
+//waitToken 等到有token, listener 关闭时返回false
+func (l *connLimiter) waitToken(done <-chan struct{}) bool {
+	wait := time.Duration(float64(time.Second) / l.rate)
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	for !l.bucket.Allow() {
+		select {
+		case <-time.After(wait):
+		case <-done:
+			return false
+		}
+	}
+	return true
+}
+
+//ipKey 不是ip 地址(比如unix socket) 返回空
+func ipKey(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+func (l *connLimiter) acquireIP(ip string) bool {
+	if l.ipConns == nil || ip == "" {
+		return true
+	}
+	l.ipMu.Lock()
+	defer l.ipMu.Unlock()
+	if l.ipConns[ip] >= l.maxIPConns {
+		return false
+	}
+	l.ipConns[ip]++
+	return true
+}
+
+func (l *connLimiter) releaseIP(ip string) {
+	if l.ipConns == nil || ip == "" {
+		return
+	}
+	l.ipMu.Lock()
+	defer l.ipMu.Unlock()
+	if l.ipConns[ip]--; l.ipConns[ip] <= 0 {
+		delete(l.ipConns, ip)
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	limit     *connLimiter
+	sem       chan struct{} //这个listener 的连接数
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (ll *limitListener) Close() error {
+	ll.closeOnce.Do(func() { close(ll.done) })
+	return ll.Listener.Close()
+}
+
+//Accept 被拒绝的连接直接关闭, 继续accept 下一个
+func (ll *limitListener) Accept() (net.Conn, error) {
+	l := ll.limit
+	for {
+		if l.queue {
+			if l.bucket != nil && !l.waitToken(ll.done) {
+				return nil, net.ErrClosed
+			}
+			if !acquire(l.sem, true, ll.done) {
+				return nil, net.ErrClosed
+			}
+			if !acquire(ll.sem, true, ll.done) {
+				release(l.sem)
+				return nil, net.ErrClosed
+			}
+		}
+		conn, err := ll.Listener.Accept()
+		if err != nil {
+			if l.queue {
+				release(ll.sem)
+				release(l.sem)
+			}
+			return nil, err
+		}
+		if !l.queue {
+			if l.bucket != nil && !l.bucket.Allow() {
+				atomic.AddUint64(&l.rejectedRate, 1)
+				conn.Close()
+				continue
+			}
+			if !acquire(l.sem, false, nil) {
+				atomic.AddUint64(&l.rejectedConns, 1)
+				conn.Close()
+				continue
+			}
+			if !acquire(ll.sem, false, nil) {
+				release(l.sem)
+				atomic.AddUint64(&l.rejectedLnConns, 1)
+				conn.Close()
+				continue
+			}
+		}
+		ip := ipKey(conn.RemoteAddr())
+		if !l.acquireIP(ip) {
+			release(ll.sem)
+			release(l.sem)
+			atomic.AddUint64(&l.rejectedIPConns, 1)
+			conn.Close()
+			continue
+		}
+		atomic.AddUint64(&l.accepted, 1)
+		atomic.AddInt64(&l.conns, 1)
+		return &limitConn{Conn: conn, ln: ll, ip: ip}, nil
+	}
+}
+
+//limitConn Close 时释放占用的连接数, 用UnwrapConn 得到原始的连接
+type limitConn struct {
+	net.Conn
+	ln   *limitListener
+	ip   string
+	once sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		l := c.ln.limit
+		l.releaseIP(c.ip)
+		release(c.ln.sem)
+		release(l.sem)
+		atomic.AddInt64(&l.conns, -1)
+	})
+	return err
+}
+
+//NetConn 跟tls.Conn 一样返回底层的连接
+func (c *limitConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+//UnwrapConn 设置了连接限制时, Server 交给ConnHandler 的连接是包装过的, 用这个得到原始的连接, 比如*net.TCPConn, *udp.UDPConn
+func UnwrapConn(conn net.Conn) net.Conn {
+	if c, ok := conn.(*limitConn); ok {
+		return c.Conn
+	}
+	return conn
+}
@@ -0,0 +1,87 @@
+package dial
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+//rejected server 直接关闭被拒绝的连接, client 读到EOF
+func rejected(t *testing.T, conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	_, err := conn.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+func TestLimitStats(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		opt    ServerOption
+		expect func(LimitStats) uint64
+	}{
+		{"max conns", WithMaxConns(1), func(ls LimitStats) uint64 { return ls.RejectedConns }},
+		{"max listener conns", WithMaxConnsPerListener(1), func(ls LimitStats) uint64 { return ls.RejectedLnConns }},
+		{"max ip conns", WithMaxConnsPerIP(1), func(ls LimitStats) uint64 { return ls.RejectedIPConns }},
+		{"accept rate", WithAcceptRate(0.001, 1), func(ls LimitStats) uint64 { return ls.RejectedRate }},
+	} {
+		s := startTestServer(t, []string{"tcp://127.0.0.1:0"}, c.opt)
+		addr := s.lns[0].Addr().String()
+		first, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rejected(t, first) {
+			t.Fatalf("%s: first conn is rejected", c.name)
+		}
+		second, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rejected(t, second) {
+			t.Fatalf("%s: second conn should be rejected", c.name)
+		}
+		second.Close()
+		ls := s.LimitStats()
+		if ls.Accepted != 1 || ls.Conns != 1 || c.expect(ls) != 1 {
+			t.Fatalf("%s: stats:%+v", c.name, ls)
+		}
+
+		//连接关闭后释放
+		first.Close()
+		for i := 0; s.LimitStats().Conns != 0; i++ {
+			if i > 100 {
+				t.Fatalf("%s: conns is not released, stats:%+v", c.name, s.LimitStats())
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		s.Stop()
+	}
+}
+
+func TestLimitQueue(t *testing.T) {
+	s := startTestServer(t, []string{"tcp://127.0.0.1:0"}, WithMaxConns(1), WithQueueOverLimit())
+	addr := s.lns[0].Addr().String()
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//queue 时不关闭, 等第一个连接关闭后才accept
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if rejected(t, second) {
+		t.Fatal("queued conn is closed")
+	}
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second * 2))
+	second.Write([]byte("ping"))
+	if _, err = io.ReadFull(second, make([]byte, 4)); err != nil {
+		t.Fatalf("queued conn is not accepted, err:%v", err)
+	}
+	if ls := s.LimitStats(); ls.Accepted != 2 || ls.RejectedConns != 0 {
+		t.Fatalf("stats:%+v", ls)
+	}
+}
@@ -10,7 +10,10 @@ import (
 	"log"
 	"net"
 	"net/url"
+	"os"
 	"time"
+
+	"github.com/jursonmo/practise/pkg/udp"
 )
 
 type ServerConfig struct {
@@ -21,17 +24,34 @@ type ServerConfig struct {
 
 type ConnHandler func(conn net.Conn, fromLnID int) error
 type Server struct {
-	ctx         context.Context
-	cancel      context.CancelFunc
-	handler     ConnHandler
-	keepalive   time.Duration
-	userTimeout time.Duration
-	lns         []net.Listener
-	tlsConf     *tls.Config
-	certFile    string
-	keyFile     string
-	clientCert  string
-	endpoints   []*url.URL
+	ctx            context.Context
+	cancel         context.CancelFunc
+	handler        ConnHandler
+	keepalive      time.Duration
+	userTimeout    time.Duration
+	lns            []net.Listener
+	tlsConf        *tls.Config
+	certFile       string
+	keyFile        string
+	clientCert     string //client 的CA, 见WithClientCA
+	certs          *certReloader
+	reloadInterval time.Duration
+	unixMode       os.FileMode
+	limit          connLimiter //see limit.go
+	endpoints      []*url.URL
+}
+
+//scheme -> network, tls 跟tcp 一样, 地址是通配地址时tcp 同时监听ipv4 和ipv6
+var listenNetworks = map[string]string{
+	"tcp":        "tcp",
+	"tcp4":       "tcp4",
+	"tcp6":       "tcp6",
+	"tls":        "tcp",
+	"unix":       "unix",
+	"unixpacket": "unixpacket",
+	"udp":        "udp",
+	"udp4":       "udp4",
+	"udp6":       "udp6",
 }
 
 type ServerOption func(s *Server)
@@ -55,8 +75,9 @@ func WithHandler(handler ConnHandler) ServerOption {
 }
 
 // 底层都是tcp listener, 如果是tls, 用原始tcp listener 和tlsConfig 生成新的tls listener: tls.NewListener(l, tlsConfig), 同样是net.Listener
+// unix://, unixpacket:// 的地址是socket 文件路径, 比如unix:///var/run/x.sock; udp:// 由pkg/udp 监听, 每个对端地址是一个net.Conn
 func NewServer(addrs []string, options ...ServerOption) (*Server, error) {
-	s := &Server{}
+	s := &Server{reloadInterval: DefaultCertReloadInterval}
 	for _, opt := range options {
 		opt(s)
 	}
@@ -65,35 +86,47 @@ func NewServer(addrs []string, options ...ServerOption) (*Server, error) {
 		if err != nil {
 			return nil, err
 		}
+		if _, ok := listenNetworks[endpoint.Scheme]; !ok {
+			return nil, fmt.Errorf("unsupported scheme:%s in %s", endpoint.Scheme, addr)
+		}
 		s.endpoints = append(s.endpoints, endpoint)
 	}
 
-	if s.tlsConf == nil {
-		if s.certFile != "" && s.keyFile != "" {
-			cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
-			if err != nil {
-				return nil, err
-			}
+	s.limit.init()
+
+	//用户的tlsConf 可能被多个server 共用, 所以clone 后再修改
+	if s.tlsConf != nil {
+		s.tlsConf = s.tlsConf.Clone()
+	}
+	if s.certFile != "" && s.keyFile != "" {
+		certs, err := newCertReloader(s.certFile, s.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if s.tlsConf == nil {
 			s.tlsConf = new(tls.Config)
-			s.tlsConf.Certificates = []tls.Certificate{cert}
 		}
+		s.certs = certs
+		//Certificates 不为空时, client 没有带SNI 就不会调用GetCertificate
+		s.tlsConf.Certificates = nil
+		s.tlsConf.GetCertificate = certs.GetCertificate
+	}
 
-		if s.clientCert != "" {
-			certBytes, err := ioutil.ReadFile(s.clientCert)
-			if err != nil {
-				return nil, err
-			}
-			clientCertPool := x509.NewCertPool()
-			ok := clientCertPool.AppendCertsFromPEM(certBytes)
-			if !ok {
-				return nil, fmt.Errorf("AppendCertsFromPEM err")
-			}
-			if s.tlsConf == nil {
-				s.tlsConf = new(tls.Config)
-			}
-			s.tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
-			s.tlsConf.ClientCAs = clientCertPool
+	if s.clientCert != "" {
+		certBytes, err := ioutil.ReadFile(s.clientCert)
+		if err != nil {
+			return nil, err
+		}
+		clientCertPool := x509.NewCertPool()
+		ok := clientCertPool.AppendCertsFromPEM(certBytes)
+		if !ok {
+			return nil, fmt.Errorf("AppendCertsFromPEM err")
 		}
+		if s.tlsConf == nil {
+			s.tlsConf = new(tls.Config)
+		}
+		s.tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+		s.tlsConf.ClientCAs = clientCertPool
 	}
 
 	if s.tlsConf != nil && s.tlsConf.CipherSuites == nil {
@@ -122,25 +155,17 @@ func (s *Server) Start(ctx context.Context) error {
 
 	s.lns = make([]net.Listener, len(s.endpoints))
 	for i, endpoint := range s.endpoints {
-		l, err := NewListener(s.ctx, "tcp4", endpoint.Host, s.keepalive, s.userTimeout)
+		l, err := s.listen(endpoint)
 		if err != nil {
+			//关掉已经打开的listener, 不然端口和socket 文件会一直占着
+			s.Stop()
 			return err
 		}
-		switch endpoint.Scheme {
-		case "tls":
-			//s.lis, err = tls.Listen("tcp4", endpoint.Host, s.tlsConf)
-			s.lns[i], err = tlsListen(l, s.tlsConf)
-			if err != nil {
-				return err
-			}
-		case "tcp":
-			//s.lis, err = net.Listen("tcp4", endpoint.Host)
-			s.lns[i] = l
-		}
+		s.lns[i] = l
 	}
 
 	accpet := func(lnID int, ln net.Listener, endpoint *url.URL) error {
-		log.Printf("server(%d) start and listen at %s://%s\n", lnID, endpoint.Scheme, endpoint.Host)
+		log.Printf("server(%d) start and listen at %s\n", lnID, endpoint)
 		log.Printf("lnID:%d, ln.Addr():%s://%s\n", lnID, ln.Addr().Network(), ln.Addr().String())
 		defer log.Printf("lnID:%d, ln.Addr():%s://%s out service\n", lnID, ln.Addr().Network(), ln.Addr().String())
 		for {
@@ -163,9 +188,42 @@ func (s *Server) Start(ctx context.Context) error {
 	for i, ln := range s.lns {
 		go accpet(i, ln, s.endpoints[i])
 	}
+	if s.certs != nil && s.reloadInterval > 0 {
+		go s.certs.watch(s.ctx, s.reloadInterval)
+	}
 	return nil
 }
 
+func (s *Server) listen(endpoint *url.URL) (net.Listener, error) {
+	network := listenNetworks[endpoint.Scheme]
+	var l net.Listener
+	var err error
+	switch endpoint.Scheme {
+	case "unix", "unixpacket":
+		l, err = unixListen(s.ctx, network, unixAddr(endpoint), s.unixMode)
+	case "udp", "udp4", "udp6":
+		l, err = udp.NewUdpListen(s.ctx, network, endpoint.Host)
+	default:
+		l, err = NewListener(s.ctx, network, endpoint.Host, s.keepalive, s.userTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.limit.enabled() {
+		l = s.limit.wrap(l)
+	}
+	if endpoint.Scheme == "tls" {
+		//s.lis, err = tls.Listen("tcp4", endpoint.Host, s.tlsConf)
+		ln, err := tlsListen(l, s.tlsConf)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		return ln, nil
+	}
+	return l, nil
+}
+
 func NewListener(ctx context.Context, network, laddr string, keepalive, userTimeout time.Duration) (net.Listener, error) {
 	var lc net.ListenConfig
 	lc.KeepAlive = keepalive
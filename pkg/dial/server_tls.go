@@ -0,0 +1,139 @@
+package dial
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//DefaultCertReloadInterval 检查证书文件是否变化的间隔, 见WithCertReloadInterval
+var DefaultCertReloadInterval = time.Second * 10
+
+//WithServerTLSConfig tls:// 的基础配置, 设置了WithServerCert 时证书由文件提供, 会覆盖conf 的Certificates
+func WithServerTLSConfig(conf *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.tlsConf = conf
+	}
+}
+
+//WithServerCert server 的证书和私钥, 文件变化后自动重新加载, 不影响已经建立的连接
+func WithServerCert(certFile, keyFile string) ServerOption {
+	return func(s *Server) {
+		s.certFile = certFile
+		s.keyFile = keyFile
+	}
+}
+
+//WithClientCA mTLS, 用caFile 里的CA(PEM) 验证client 的证书, client 必须提供证书
+func WithClientCA(caFile string) ServerOption {
+	return func(s *Server) {
+		s.clientCert = caFile
+	}
+}
+
+//WithCertReloadInterval 检查证书文件的间隔, 默认DefaultCertReloadInterval, <=0 表示不检查, 只能调用ReloadCert 重新加载
+func WithCertReloadInterval(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.reloadInterval = d
+	}
+}
+
+//ReloadCert 重新加载证书文件, 比如收到SIGHUP 时调用; 失败时继续用原来的证书
+func (s *Server) ReloadCert() error {
+	if s.certs == nil {
+		return nil
+	}
+	return s.certs.reload()
+}
+
+//certReloader 通过tls.Config.GetCertificate 提供证书, 新的握手才会用到新证书
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime [2]time.Time //certFile, keyFile
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) modTimes() ([2]time.Time, error) {
+	var mt [2]time.Time
+	for i, file := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return mt, err
+		}
+		mt[i] = fi.ModTime()
+	}
+	return mt, nil
+}
+
+func (r *certReloader) load() error {
+	mt, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = mt
+	r.mu.Unlock()
+	return nil
+}
+
+//reload 失败时保留原来的证书
+func (r *certReloader) reload() error {
+	if err := r.load(); err != nil {
+		log.Printf("reload cert %s, key %s fail, keep the old one, err:%v\n", r.certFile, r.keyFile, err)
+		return err
+	}
+	log.Printf("reload cert %s, key %s ok\n", r.certFile, r.keyFile)
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+//watch 文件的修改时间变化了就重新加载, 证书轮换时cert 和key 可能不是同时写完的, 失败了下次再试
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var failed [2]time.Time //上次加载失败时的修改时间, 文件没有再变化就不重复加载
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		mt, err := r.modTimes()
+		if err != nil {
+			continue
+		}
+		r.mu.RLock()
+		changed := mt != r.modTime
+		r.mu.RUnlock()
+		if !changed || mt == failed {
+			continue
+		}
+		if r.reload() != nil {
+			failed = mt
+		}
+	}
+}
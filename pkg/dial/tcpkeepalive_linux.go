@@ -27,6 +27,7 @@ func ConvertTcpConn(conn net.Conn) *net.TCPConn {
 		log.Printf("unsupport conn network:%s \n", conn.LocalAddr().Network())
 		return nil
 	}
+	conn = UnwrapConn(conn)
 	tcpconn, ok := conn.(*net.TCPConn)
 	if ok {
 		return tcpconn
@@ -41,7 +42,7 @@ func ConvertTcpConn(conn net.Conn) *net.TCPConn {
 		underConn net.Conn
 	}
 	tconn := (*tc)(unsafe.Pointer(tlsconn))
-	tcpconn, ok = tconn.underConn.(*net.TCPConn)
+	tcpconn, ok = UnwrapConn(tconn.underConn).(*net.TCPConn)
 	if !ok {
 		return nil
 	}
@@ -84,7 +85,7 @@ func SetKeepaliveParameters(conn net.Conn, idle, intvl, cnt int) error {
 	}
 	rawConn, err := tconn.SyscallConn()
 	if err != nil {
-		log.Printf("on getting raw connection object for keepalive parameter setting", err.Error())
+		log.Printf("on getting raw connection object for keepalive parameter setting err:%s", err.Error())
 		return err
 	}
 
@@ -95,18 +96,18 @@ func SetKeepaliveParameters(conn net.Conn, idle, intvl, cnt int) error {
 			//Number of probes.
 			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, cnt) //unix.TCP_KEEPCNT
 			if err != nil {
-				log.Printf("on setting keepalive probe count", err.Error())
+				log.Printf("on setting keepalive probe count err:%s", err.Error())
 				return
 			}
 			//Wait time after an unsuccessful probe.
 			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, intvl) //unix.TCP_KEEPINTVL
 			if err != nil {
-				log.Printf("on setting keepalive retry interval", err.Error())
+				log.Printf("on setting keepalive retry interval err:%s", err.Error())
 				return
 			}
 			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, idle) //unix.TCP_KEEPIDLE
 			if err != nil {
-				log.Printf("on setting keepalive idel", err.Error())
+				log.Printf("on setting keepalive idel err:%s", err.Error())
 				return
 			}
 		})
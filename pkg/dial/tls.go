@@ -0,0 +1,138 @@
+package dial
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+var ErrSPKIMismatch = errors.New("tls: server certificate doesn't match pinned SPKI")
+
+//WithTLSConfig 用conf 作为tls:// 的基础配置, 其他tls 选项会覆盖它的对应字段
+func WithTLSConfig(conf *tls.Config) DialOption {
+	return func(c *DialConfig) {
+		c.TLSConfig = conf
+	}
+}
+
+//WithCAFile 用file 里的CA(PEM) 验证server 的证书, 而不是系统的CA
+func WithCAFile(file string) DialOption {
+	return func(c *DialConfig) {
+		c.CAFile = file
+	}
+}
+
+//WithClientCert mTLS 时client 的证书和私钥
+func WithClientCert(certFile, keyFile string) DialOption {
+	return func(c *DialConfig) {
+		c.CertFile = certFile
+		c.KeyFile = keyFile
+	}
+}
+
+//WithServerName 设置SNI 和验证证书用的名字, 比如用ip 地址连接时
+func WithServerName(name string) DialOption {
+	return func(c *DialConfig) {
+		c.ServerName = name
+	}
+}
+
+//WithPinnedSPKI 证书锁定, hashes 是证书SubjectPublicKeyInfo 的sha256, 见SPKIHash
+func WithPinnedSPKI(hashes ...[]byte) DialOption {
+	return func(c *DialConfig) {
+		c.PinnedSPKI = append(c.PinnedSPKI, hashes...)
+	}
+}
+
+//WithInsecureSkipVerify 不验证server 的证书(以前的默认行为), 只用于测试
+func WithInsecureSkipVerify() DialOption {
+	return func(c *DialConfig) {
+		c.InsecureSkipVerify = true
+	}
+}
+
+//SPKIHash 证书SubjectPublicKeyInfo 的sha256, 用于WithPinnedSPKI
+func SPKIHash(cert *x509.Certificate) []byte {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return h[:]
+}
+
+//tlsConfig 默认验证server 的证书
+func (c *DialConfig) tlsConfig() (*tls.Config, error) {
+	var conf *tls.Config
+	if c.TLSConfig != nil {
+		conf = c.TLSConfig.Clone()
+	} else {
+		conf = &tls.Config{
+			MinVersion: tls.VersionTLS11,
+			//CipherSuites:       NO_DES,
+			CipherSuites: SecureCipherSuites(), //tls.InsecureCipherSuites() 包含不安全的加密套件, 可以查看这些不安全的套件是哪些
+		}
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA file:%s", c.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if c.ServerName != "" {
+		conf.ServerName = c.ServerName
+	}
+	if c.InsecureSkipVerify {
+		conf.InsecureSkipVerify = true
+	}
+	if len(c.PinnedSPKI) > 0 {
+		pins, insecure := c.PinnedSPKI, conf.InsecureSkipVerify
+		verify := conf.VerifyConnection
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if err := checkPinnedSPKI(cs, pins, insecure); err != nil {
+				return err
+			}
+			if verify != nil {
+				return verify(cs)
+			}
+			return nil
+		}
+	}
+	return conf, nil
+}
+
+//checkPinnedSPKI 验证过的证书链里有一个证书匹配就可以; InsecureSkipVerify 时没有验证过的链, 只匹配对端的叶子证书.
+//不能匹配PeerCertificates 里的其他证书, 它们是对端随便附带的, 攻击者可以把被锁定的证书附在自己的证书后面
+func checkPinnedSPKI(cs tls.ConnectionState, pins [][]byte, insecure bool) error {
+	var certs []*x509.Certificate
+	if insecure {
+		if len(cs.PeerCertificates) > 0 {
+			certs = cs.PeerCertificates[:1]
+		}
+	} else {
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+	}
+	for _, cert := range certs {
+		h := SPKIHash(cert)
+		for _, pin := range pins {
+			if bytes.Equal(h, pin) {
+				return nil
+			}
+		}
+	}
+	return ErrSPKIMismatch
+}
@@ -0,0 +1,255 @@
+package dial
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jursonmo/practise/pkg/backoffx"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{cert: cert, key: key, file: filepath.Join(dir, "ca.pem")}
+	writePEM(t, ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+//issue 签发127.0.0.1 和localhost 的server 证书, 每次都是新的私钥
+func (ca *testCA) issue(t *testing.T, certFile, keyFile string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", kb)
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//echoHandler 回显, 对端关闭后关闭连接
+func echoHandler(conn net.Conn, lnID int) error {
+	defer conn.Close()
+	_, err := io.Copy(conn, conn)
+	return err
+}
+
+func startTestServer(t *testing.T, addrs []string, opts ...ServerOption) *Server {
+	s, err := NewServer(addrs, append([]ServerOption{WithHandler(echoHandler)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+func (s *Server) testAddr(i int) string {
+	return s.endpoints[i].Scheme + "://" + s.lns[i].Addr().String()
+}
+
+//testDial 只连一次, 失败了不backoff
+func testDial(addr string, opts ...DialOption) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	opts = append([]DialOption{WithMaxDial(1), WithBackOffer(backoffx.NewLinearBackoff(0))}, opts...)
+	conn, err := Dial(ctx, addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	//tls 握手已经完成, 再确认server 能回显
+	if _, err = conn.Write([]byte("ping")); err == nil {
+		_, err = io.ReadFull(conn, make([]byte, 4))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func TestDialTLSVerify(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	cert := ca.issue(t, certFile, keyFile)
+	addr := startTestServer(t, []string{"tls://127.0.0.1:0"}, WithServerCert(certFile, keyFile)).testAddr(0)
+
+	//默认验证server 的证书, 系统的CA 不认识测试CA
+	var uerr x509.UnknownAuthorityError
+	if _, err := testDial(addr); !errors.As(err, &uerr) {
+		t.Fatalf("expect UnknownAuthorityError, err:%v", err)
+	}
+	conn, err := testDial(addr, WithCAFile(ca.file))
+	if err != nil {
+		t.Fatalf("dial with CA file err:%v", err)
+	}
+	conn.Close()
+	//证书里没有这个名字
+	if _, err = testDial(addr, WithCAFile(ca.file), WithServerName("example.com")); err == nil {
+		t.Fatal("expect hostname mismatch")
+	}
+
+	//证书锁定: 匹配才能连接, 不管是否验证证书链
+	other := newTestCA(t, t.TempDir())
+	for _, c := range []struct {
+		name string
+		opts []DialOption
+		ok   bool
+	}{
+		{"pin match", []DialOption{WithCAFile(ca.file), WithPinnedSPKI(SPKIHash(cert))}, true},
+		{"pin ca", []DialOption{WithCAFile(ca.file), WithPinnedSPKI(SPKIHash(ca.cert))}, true},
+		{"pin match skip verify", []DialOption{WithInsecureSkipVerify(), WithPinnedSPKI(SPKIHash(cert))}, true},
+		{"pin mismatch", []DialOption{WithCAFile(ca.file), WithPinnedSPKI(SPKIHash(other.cert))}, false},
+		{"pin mismatch skip verify", []DialOption{WithInsecureSkipVerify(), WithPinnedSPKI(SPKIHash(other.cert))}, false},
+	} {
+		conn, err := testDial(addr, c.opts...)
+		if c.ok {
+			if err != nil {
+				t.Fatalf("%s: err:%v", c.name, err)
+			}
+			conn.Close()
+			continue
+		}
+		if !errors.Is(err, ErrSPKIMismatch) {
+			t.Fatalf("%s: expect ErrSPKIMismatch, err:%v", c.name, err)
+		}
+	}
+}
+
+//server 把被锁定的证书附在自己的证书链后面, 它不在验证过的链里, 也不是叶子证书, 不能通过
+func TestPinnedSPKIExtraCert(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	ca.issue(t, certFile, keyFile)
+	pinned := newTestCA(t, t.TempDir())
+	f, err := os.OpenFile(certFile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: pinned.cert.Raw})
+	f.Close()
+	addr := startTestServer(t, []string{"tls://127.0.0.1:0"}, WithServerCert(certFile, keyFile)).testAddr(0)
+
+	for name, opts := range map[string][]DialOption{
+		"verify":      {WithCAFile(ca.file), WithPinnedSPKI(SPKIHash(pinned.cert))},
+		"skip verify": {WithInsecureSkipVerify(), WithPinnedSPKI(SPKIHash(pinned.cert))},
+	} {
+		if _, err := testDial(addr, opts...); !errors.Is(err, ErrSPKIMismatch) {
+			t.Fatalf("%s: expect ErrSPKIMismatch, err:%v", name, err)
+		}
+	}
+}
+
+func TestServerCertReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	old := ca.issue(t, certFile, keyFile)
+	addr := startTestServer(t, []string{"tls://127.0.0.1:0"}, WithServerCert(certFile, keyFile),
+		WithCertReloadInterval(time.Millisecond*20)).testAddr(0)
+
+	conn, err := testDial(addr, WithCAFile(ca.file), WithPinnedSPKI(SPKIHash(old)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	//轮换证书, 修改时间往后调, 避免文件系统的时间精度不够
+	renewed := ca.issue(t, certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+	deadline := time.Now().Add(time.Second * 3)
+	for {
+		c, err := testDial(addr, WithCAFile(ca.file), WithPinnedSPKI(SPKIHash(renewed)))
+		if err == nil {
+			c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("new cert is not loaded, err:%v", err)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	//已经建立的连接不受影响
+	if _, err = conn.Write([]byte("ping")); err == nil {
+		_, err = io.ReadFull(conn, make([]byte, 4))
+	}
+	if err != nil {
+		t.Fatalf("old conn err:%v", err)
+	}
+
+	//加载失败时继续用原来的证书
+	os.WriteFile(keyFile, []byte("broken"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(keyFile, future, future)
+	time.Sleep(time.Millisecond * 100)
+	c, err := testDial(addr, WithCAFile(ca.file), WithPinnedSPKI(SPKIHash(renewed)))
+	if err != nil {
+		t.Fatalf("keep the old cert after reload fail, err:%v", err)
+	}
+	c.Close()
+}
@@ -0,0 +1,73 @@
+package dial
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+//WithUnixSocketMode unix://, unixpacket:// 的socket 文件的权限, 默认由umask 决定
+func WithUnixSocketMode(mode os.FileMode) ServerOption {
+	return func(s *Server) {
+		s.unixMode = mode
+	}
+}
+
+//unixListen 监听前删掉上次进程没有清理的socket 文件, Close 时会删掉socket 文件
+func unixListen(ctx context.Context, network, path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(network, path); err != nil {
+		return nil, err
+	}
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, network, path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 && !isAbstractSocket(path) {
+		if err = os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+//removeStaleSocket 文件存在但是连不上, 说明是残留的socket 文件; 能连上说明有其他进程在监听
+func removeStaleSocket(network, path string) error {
+	if isAbstractSocket(path) {
+		return nil
+	}
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout(network, path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	return os.Remove(path)
+}
+
+//unixAddr url.Parse("unix://@abs") 会把@ 当成userinfo 的分隔符, 得到Host="abs", 这里还原成"@abs"
+func unixAddr(u *url.URL) string {
+	addr := u.Host + u.Path
+	if u.User != nil {
+		addr = u.User.String() + "@" + addr
+	}
+	return addr
+}
+
+//linux 的abstract socket 没有文件
+func isAbstractSocket(path string) bool {
+	return len(path) > 0 && path[0] == '@'
+}
@@ -0,0 +1,17 @@
+package dial
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestUnixAbstractSocket(t *testing.T) {
+	addr := fmt.Sprintf("unix://@practise-dial-test-%d", os.Getpid())
+	startTestServer(t, []string{addr})
+	conn, err := testDial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,83 @@
+package dial
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnixAddr(t *testing.T) {
+	for addr, expect := range map[string]string{
+		"unix:///tmp/a.sock":  "/tmp/a.sock",
+		"unix://@abstract":    "@abstract",
+		"unixpacket://@a/b":   "@a/b",
+		"unix://relative.sck": "relative.sck",
+	} {
+		u, err := url.Parse(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := unixAddr(u); got != expect {
+			t.Fatalf("%s: got:%s, expect:%s", addr, got, expect)
+		}
+	}
+}
+
+func TestUnixStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	//上次进程没有删掉的socket 文件
+	stale := filepath.Join(dir, "stale.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	if _, err = os.Lstat(stale); err != nil {
+		t.Fatalf("stale socket file should be left, err:%v", err)
+	}
+	startTestServer(t, []string{"unix://" + stale}, WithUnixSocketMode(0600))
+	fi, err := os.Lstat(stale)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket file:%v, err:%v", fi, err)
+	}
+	conn, err := testDial("unix://" + stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	//正在使用的socket 文件不能删, 已经打开的listener 要关掉
+	inuse := filepath.Join(dir, "inuse.sock")
+	live, err := net.Listen("unix", inuse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	first := filepath.Join(dir, "first.sock")
+	s, err := NewServer([]string{"unix://" + first, "unix://" + inuse}, WithHandler(echoHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("expect in use, err:%v", err)
+	}
+	if _, err = os.Lstat(inuse); err != nil {
+		t.Fatalf("socket file in use is removed, err:%v", err)
+	}
+	if _, err = os.Lstat(first); !os.IsNotExist(err) {
+		t.Fatalf("listener opened before the failure should be closed, err:%v", err)
+	}
+
+	//不是socket 的文件
+	regular := filepath.Join(dir, "regular")
+	os.WriteFile(regular, nil, 0600)
+	if err = removeStaleSocket("unix", regular); err == nil {
+		t.Fatal("expect error for regular file")
+	}
+}
@@ -0,0 +1,51 @@
+package encoding
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Compressor compresses payloads, proto uses Name() to look up the compression id
+// that is written into the CompressOpt of a message.
+type Compressor interface {
+	// Compress appends the compressed src to dst and returns the result
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress returns ErrDecompressedTooLarge if the decompressed data is bigger than maxSize
+	Decompress(src []byte, maxSize int) ([]byte, error)
+	Name() string
+}
+
+var ErrDecompressedTooLarge = errors.New("decompressed data too large")
+
+var registeredCompressors = make(map[string]Compressor)
+
+// RegisterCompressor registers the Compressor, like RegisterCodec it must only be called in an init() function.
+func RegisterCompressor(c Compressor) {
+	if c == nil {
+		panic("cannot register a nil Compressor")
+	}
+	if c.Name() == "" {
+		panic("cannot register Compressor with empty string result for Name()")
+	}
+	registeredCompressors[strings.ToLower(c.Name())] = c
+}
+
+// GetCompressor gets a registered Compressor by name, or nil if no Compressor is registered for the name.
+func GetCompressor(name string) Compressor {
+	return registeredCompressors[strings.ToLower(name)]
+}
+
+// ReadAllLimit reads r until EOF, at most maxSize bytes, it is used by Decompress against zip bombs
+func ReadAllLimit(r io.Reader, maxSize int) ([]byte, error) {
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(maxSize) {
+		return nil, ErrDecompressedTooLarge
+	}
+	return buf.Bytes(), nil
+}
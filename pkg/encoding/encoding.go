@@ -0,0 +1,41 @@
+package encoding
+
+import "strings"
+
+// Codec defines the interface proto uses to encode and decode payloads.
+// Name() is the codec name, it is also used to look up the payload type that
+// is written into the 4-bit PayloadType of ProtoHeader.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	Name() string
+}
+
+var registeredCodecs = make(map[string]Codec)
+
+// RegisterCodec registers the provided Codec for use with all proto conns.
+// NOTE: this function must only be called during initialization time (i.e. in an init() function),
+// and is not thread-safe. If multiple Codecs are registered with the same name, the one registered last will take effect.
+func RegisterCodec(codec Codec) {
+	if codec == nil {
+		panic("cannot register a nil Codec")
+	}
+	if codec.Name() == "" {
+		panic("cannot register Codec with empty string result for Name()")
+	}
+	registeredCodecs[strings.ToLower(codec.Name())] = codec
+}
+
+// GetCodec gets a registered Codec by name, or nil if no Codec is registered for the name.
+func GetCodec(name string) Codec {
+	return registeredCodecs[strings.ToLower(name)]
+}
+
+// Codecs return the names of all registered codecs
+func Codecs() []string {
+	names := make([]string, 0, len(registeredCodecs))
+	for name := range registeredCodecs {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,100 @@
+package encoding_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/jursonmo/practise/pkg/encoding"
+	_ "github.com/jursonmo/practise/pkg/encoding/json"
+	_ "github.com/jursonmo/practise/pkg/encoding/msgpack"
+	_ "github.com/jursonmo/practise/pkg/encoding/proto"
+	_ "github.com/jursonmo/practise/pkg/encoding/raw"
+	_ "github.com/jursonmo/practise/pkg/encoding/zstd"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type Person struct {
+	Name string
+	Age  int
+}
+
+func TestCodecs(t *testing.T) {
+	for _, name := range []string{"json", "msgpack"} {
+		codec := encoding.GetCodec(name)
+		if codec == nil {
+			t.Fatalf("codec:%s not registered", name)
+		}
+		in := Person{Name: "tom", Age: 18}
+		d, err := codec.Marshal(&in)
+		if err != nil {
+			t.Fatalf("codec:%s, Marshal err:%v", name, err)
+		}
+		out := Person{}
+		if err := codec.Unmarshal(d, &out); err != nil {
+			t.Fatalf("codec:%s, Unmarshal err:%v", name, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Fatalf("codec:%s, in:%+v, out:%+v", name, in, out)
+		}
+	}
+
+	//protobuf
+	codec := encoding.GetCodec("protobuf")
+	d, err := codec.Marshal(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbOut := &wrapperspb.StringValue{}
+	if err := codec.Unmarshal(d, pbOut); err != nil || pbOut.Value != "hello" {
+		t.Fatalf("protobuf Unmarshal err:%v, out:%v", err, pbOut)
+	}
+	if _, err := codec.Marshal(&Person{}); err == nil {
+		t.Fatal("protobuf codec should not marshal non proto.Message")
+	}
+
+	//raw
+	codec = encoding.GetCodec("RAW")
+	d, err = codec.Marshal("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rawOut []byte
+	if err := codec.Unmarshal(d, &rawOut); err != nil || string(rawOut) != "hello" {
+		t.Fatalf("raw Unmarshal err:%v, out:%s", err, rawOut)
+	}
+	//payload 被重用后不影响Unmarshal 的结果
+	copy(d, "world")
+	if string(rawOut) != "hello" {
+		t.Fatalf("raw Unmarshal should copy the data, out:%s", rawOut)
+	}
+}
+
+func TestZstdMaxSize(t *testing.T) {
+	c := encoding.GetCompressor("zstd")
+	src := bytes.Repeat([]byte("hello"), 1024)
+	d, err := c.Compress(nil, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := c.Decompress(d, len(src))
+	if err != nil || !bytes.Equal(out, src) {
+		t.Fatalf("Decompress err:%v, len:%d", err, len(out))
+	}
+	if _, err = c.Decompress(d, len(src)-1); !errors.Is(err, encoding.ErrDecompressedTooLarge) {
+		t.Fatalf("expect ErrDecompressedTooLarge, err:%v", err)
+	}
+
+	//帧头声明的窗口超过maxSize, 不分配窗口内存, 直接拒绝
+	enc, _ := zstd.NewWriter(nil, zstd.WithWindowSize(8<<20), zstd.WithSingleSegment(false))
+	big := make([]byte, 8<<20)
+	for i := range big {
+		big[i] = byte(i * 7 >> 3)
+	}
+	d = enc.EncodeAll(big, nil)
+	if _, err = c.Decompress(d, 64<<10); !errors.Is(err, encoding.ErrDecompressedTooLarge) {
+		t.Fatalf("expect ErrDecompressedTooLarge, err:%v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package gzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"sync"
+
+	"github.com/jursonmo/practise/pkg/encoding"
+)
+
+// Name is the name registered for the gzip compressor.
+const Name = "gzip"
+
+func init() {
+	encoding.RegisterCompressor(compressor{})
+}
+
+var writerPool = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// compressor is a Compressor implementation with compress/gzip.
+type compressor struct{}
+
+func (compressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w := writerPool.Get().(*gzip.Writer)
+	defer writerPool.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (compressor) Decompress(src []byte, maxSize int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return encoding.ReadAllLimit(r, maxSize)
+}
+
+func (compressor) Name() string {
+	return Name
+}
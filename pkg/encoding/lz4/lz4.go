@@ -0,0 +1,49 @@
+package lz4
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/jursonmo/practise/pkg/encoding"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Name is the name registered for the lz4 compressor.
+const Name = "lz4"
+
+func init() {
+	encoding.RegisterCompressor(compressor{})
+}
+
+var (
+	writerPool = sync.Pool{New: func() interface{} { return lz4.NewWriter(nil) }}
+	readerPool = sync.Pool{New: func() interface{} { return lz4.NewReader(nil) }}
+)
+
+// compressor is a Compressor implementation with lz4 frame format.
+type compressor struct{}
+
+func (compressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w := writerPool.Get().(*lz4.Writer)
+	defer writerPool.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (compressor) Decompress(src []byte, maxSize int) ([]byte, error) {
+	r := readerPool.Get().(*lz4.Reader)
+	defer readerPool.Put(r)
+	r.Reset(bytes.NewReader(src))
+	return encoding.ReadAllLimit(r, maxSize)
+}
+
+func (compressor) Name() string {
+	return Name
+}
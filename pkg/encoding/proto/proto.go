@@ -0,0 +1,38 @@
+package proto
+
+import (
+	"fmt"
+
+	"github.com/jursonmo/practise/pkg/encoding"
+	"google.golang.org/protobuf/proto"
+)
+
+// Name is the name registered for the proto codec.
+const Name = "protobuf"
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+// codec is a Codec implementation with protobuf. It is the default codec for grpc.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("failed to marshal, message is %T, want proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("failed to unmarshal, message is %T, want proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+func (codec) Name() string {
+	return Name
+}
@@ -0,0 +1,45 @@
+package raw
+
+import (
+	"fmt"
+
+	"github.com/jursonmo/practise/pkg/encoding"
+)
+
+// Name is the name registered for the raw codec.
+const Name = "raw"
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+// codec passes the payload through without any encoding,
+// Marshal accepts []byte, *[]byte or string, Unmarshal only accepts *[]byte.
+// Unmarshal copies data, the payload may be returned to the pool after the handler returns
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	switch d := v.(type) {
+	case []byte:
+		return d, nil
+	case *[]byte:
+		return *d, nil
+	case string:
+		return []byte(d), nil
+	default:
+		return nil, fmt.Errorf("failed to marshal, message is %T, want []byte or string", v)
+	}
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	d, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("failed to unmarshal, message is %T, want *[]byte", v)
+	}
+	*d = append((*d)[:0], data...)
+	return nil
+}
+
+func (codec) Name() string {
+	return Name
+}
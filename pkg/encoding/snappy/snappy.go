@@ -0,0 +1,46 @@
+package snappy
+
+import (
+	"github.com/golang/snappy"
+	"github.com/jursonmo/practise/pkg/encoding"
+)
+
+// Name is the name registered for the snappy compressor.
+const Name = "snappy"
+
+func init() {
+	encoding.RegisterCompressor(compressor{})
+}
+
+// compressor is a Compressor implementation with snappy block format.
+type compressor struct{}
+
+func (compressor) Compress(dst, src []byte) ([]byte, error) {
+	n := snappy.MaxEncodedLen(len(src))
+	if n < 0 {
+		return nil, snappy.ErrTooLarge
+	}
+	if cap(dst)-len(dst) < n {
+		ndst := make([]byte, len(dst), len(dst)+n)
+		copy(ndst, dst)
+		dst = ndst
+	}
+	out := snappy.Encode(dst[len(dst):len(dst)+n], src)
+	return dst[:len(dst)+len(out)], nil
+}
+
+func (compressor) Decompress(src []byte, maxSize int) ([]byte, error) {
+	//block format 的头部就是解压后的长度, 先检查
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSize {
+		return nil, encoding.ErrDecompressedTooLarge
+	}
+	return snappy.Decode(nil, src)
+}
+
+func (compressor) Name() string {
+	return Name
+}
@@ -0,0 +1,82 @@
+package zstd
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"github.com/jursonmo/practise/pkg/encoding"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Name is the name registered for the zstd compressor.
+const Name = "zstd"
+
+func init() {
+	encoding.RegisterCompressor(compressor{})
+}
+
+var (
+	//EncodeAll 可以并发调用
+	encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	//decoder 的内存和窗口上限在创建时指定, 按maxSize 分pool, 一般只有一两个不同的maxSize
+	decoderPools sync.Map //map[int]*sync.Pool
+)
+
+//decoderPool 返回maxSize 对应的pool, decoder 的MaxMemory 和MaxWindow 都不超过maxSize,
+//避免帧头声明很大的窗口时decoder 先分配窗口内存
+func decoderPool(maxSize int) *sync.Pool {
+	if p, ok := decoderPools.Load(maxSize); ok {
+		return p.(*sync.Pool)
+	}
+	window := uint64(maxSize)
+	if window < zstd.MinWindowSize {
+		window = zstd.MinWindowSize
+	}
+	if window > zstd.MaxWindowSize {
+		window = zstd.MaxWindowSize
+	}
+	memory := uint64(maxSize)
+	if memory == 0 {
+		memory = 1
+	}
+	p, _ := decoderPools.LoadOrStore(maxSize, &sync.Pool{New: func() interface{} {
+		d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(memory), zstd.WithDecoderMaxWindow(window))
+		return d
+	}})
+	return p.(*sync.Pool)
+}
+
+// compressor is a Compressor implementation with klauspost/compress/zstd.
+type compressor struct{}
+
+func (compressor) Compress(dst, src []byte) ([]byte, error) {
+	return encoder.EncodeAll(src, dst), nil
+}
+
+func (compressor) Decompress(src []byte, maxSize int) ([]byte, error) {
+	if maxSize < 0 {
+		maxSize = 0
+	}
+	pool := decoderPool(maxSize)
+	d := pool.Get().(*zstd.Decoder)
+	defer pool.Put(d)
+	if err := d.Reset(bytes.NewReader(src)); err != nil {
+		return nil, tooLarge(err)
+	}
+	out, err := encoding.ReadAllLimit(d, maxSize)
+	return out, tooLarge(err)
+}
+
+//tooLarge decoder 超过内存或窗口上限时, 统一返回ErrDecompressedTooLarge
+func tooLarge(err error) error {
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return encoding.ErrDecompressedTooLarge
+	}
+	return err
+}
+
+func (compressor) Name() string {
+	return Name
+}
@@ -0,0 +1,206 @@
+package proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//Authenticator 和Credential 的交互过程:
+//  client                          server
+//  AuthReq(V:name)       ---->
+//                        <----     AuthChallenge(V:name, payload:challenge)
+//  AuthResp(payload:resp)---->     Verify(challenge, resp)
+//                        <----     AuthOk(V:subject) / AuthFail(V:reason)
+//challenge 每个连接都不一样, 所以抓包得到的resp 不能重放
+
+// Identity is who the peer is after auth ok
+type Identity struct {
+	Subject string
+	Method  string                 //Authenticator.Name()
+	Claims  map[string]interface{} //eg: jwt claims
+}
+
+// Authenticator is used by server to verify the client
+type Authenticator interface {
+	Name() string
+	//Challenge 返回发给client 的数据, 不需要challenge 的可以返回nil, 比如jwt
+	Challenge() ([]byte, error)
+	Verify(challenge, resp []byte) (*Identity, error)
+}
+
+// Credential is used by client to answer the challenge of the Authenticator with the same Name
+type Credential interface {
+	Name() string
+	Response(challenge []byte) ([]byte, error)
+}
+
+var ErrAuthFail = errors.New("auth fail")
+
+//WithAuthenticator for server conn, client 必须用其中一种Credential 通过验证, 否则Init 返回错误
+func WithAuthenticator(as ...Authenticator) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		if len(as) == 0 {
+			return
+		}
+		if pc.authenticators == nil {
+			pc.authenticators = make(map[string]Authenticator)
+		}
+		for _, a := range as {
+			pc.authenticators[a.Name()] = a
+		}
+		pc.authOk = false
+	}
+}
+
+//WithCredential for client conn
+func WithCredential(c Credential) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.credential = c
+	}
+}
+
+//Identity return the verified identity of peer, nil if peer is not verified by Authenticator
+func (pc *ProtoConn) Identity() *Identity {
+	return pc.identity
+}
+
+func (pc *ProtoConn) readAuthPkg() (*ProtoPkg, *ProtoHeaderOption, error) {
+	pkg, err := pc.readInitPkg(Auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pkg.PkgType() != Auth || len(pkg.options) == 0 {
+		pkg.Release()
+		return nil, nil, errors.New("isn't auth packet")
+	}
+	return pkg, &pkg.options[0], nil
+}
+
+func newAuthPkg(t byte, v []byte, payload []byte) (*ProtoPkg, error) {
+	opt := ProtoHeaderOption{T: t, L: uint16(len(v)), V: v}
+	return EncodePkg(payload, Auth, 0, opt)
+}
+
+func (pc *ProtoConn) writeAuthPkg(t byte, v []byte, payload []byte) error {
+	pkg, err := newAuthPkg(t, v, payload)
+	if err != nil {
+		return err
+	}
+	_, err = pc.writePkg(pkg)
+	return err
+}
+
+//client 的请求, 报文协议下会重传, 直到收到回应
+func (pc *ProtoConn) writeAuthReq(t byte, v []byte, payload []byte) (stop func(), err error) {
+	pkg, err := newAuthPkg(t, v, payload)
+	if err != nil {
+		return func() {}, err
+	}
+	return pc.writeCtrlPkg(pkg)
+}
+
+//clientAuthenticate 在clientAuth 里调用, 已经设置了ReadDeadline
+func (pc *ProtoConn) clientAuthenticate(ctx context.Context) error {
+	c := pc.credential
+	stop, err := pc.writeAuthReq(AuthReq, []byte(c.Name()), nil)
+	if err != nil {
+		return err
+	}
+	defer func() { stop() }()
+	for {
+		pkg, opt, err := pc.readAuthPkg()
+		if err != nil {
+			return err
+		}
+		stop()
+		switch opt.T {
+		case AuthOk:
+			//server 没有要求验证, 或者验证通过
+			pkg.Release()
+			return nil
+		case AuthFail:
+			err = fmt.Errorf("%w: %s", ErrAuthFail, opt.V)
+			pkg.Release()
+			return err
+		case AuthChallenge:
+			resp, err := c.Response(pkg.Payload)
+			pkg.Release()
+			if err != nil {
+				return err
+			}
+			if stop, err = pc.writeAuthReq(AuthResp, nil, resp); err != nil {
+				return err
+			}
+		default:
+			pkg.Release()
+			return fmt.Errorf("unexpected auth option:%s", opt.TypeName())
+		}
+	}
+}
+
+//serverAuthenticate 处理client 的AuthReq, name 是client 要用的验证方式
+func (pc *ProtoConn) serverAuthenticate(ctx context.Context, name string) error {
+	fail := func(err error) error {
+		pc.writeAuthPkg(AuthFail, []byte(ErrAuthFail.Error()), nil)
+		return fmt.Errorf("%w, method:%s, %v", ErrAuthFail, name, err)
+	}
+	a := pc.authenticators[name]
+	if a == nil {
+		return fail(errors.New("unsupported auth method"))
+	}
+	challenge, err := a.Challenge()
+	if err != nil {
+		return fail(err)
+	}
+	err = pc.writeAuthPkg(AuthChallenge, []byte(name), challenge)
+	if err != nil {
+		return err
+	}
+	var pkg *ProtoPkg
+	var opt *ProtoHeaderOption
+	for {
+		pkg, opt, err = pc.readAuthPkg()
+		if err != nil {
+			return err
+		}
+		defer pkg.Release()
+		if opt.T != AuthReq || !pc.isPacketConn {
+			break
+		}
+		//报文协议, client 没有收到challenge, 重传了AuthReq
+		if err = pc.writeAuthPkg(AuthChallenge, []byte(name), challenge); err != nil {
+			return err
+		}
+	}
+	if opt.T != AuthResp {
+		return fail(fmt.Errorf("unexpected auth option:%s", opt.TypeName()))
+	}
+	id, err := a.Verify(challenge, pkg.Payload)
+	if err != nil {
+		return fail(err)
+	}
+	if id.Method == "" {
+		id.Method = name
+	}
+	pc.identity = id
+	pc.authOk = true
+	okPkg, err := newAuthPkg(AuthOk, []byte(id.Subject), nil)
+	if err != nil {
+		return err
+	}
+	pc.setCtrlResp(okPkg)
+	_, err = pc.writePkg(okPkg)
+	return err
+}
+
+//authDeadline 设置验证过程的ReadDeadline, 返回的函数用来恢复
+func (pc *ProtoConn) authDeadline(ctx context.Context) func() {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultAuthTimeout)
+	}
+	pc.conn.SetReadDeadline(deadline)
+	return func() { pc.conn.SetReadDeadline(time.Time{}) }
+}
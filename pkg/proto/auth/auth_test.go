@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/jursonmo/practise/pkg/proto"
+)
+
+func initPair(t *testing.T, a proto.Authenticator, c proto.Credential) (*proto.ProtoConn, error, error) {
+	c1, c2 := net.Pipe()
+	srv := proto.NewProtoConn(c1, true, nil, proto.WithAuthenticator(a))
+	cli := proto.NewProtoConn(c2, false, nil, proto.WithCredential(c))
+	t.Cleanup(func() { srv.Close(); cli.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	srvErr := make(chan error, 1)
+	go func() { srvErr <- srv.Init(ctx) }()
+	cliErr := cli.Init(ctx)
+	return srv, <-srvErr, cliErr
+}
+
+func TestHMAC(t *testing.T) {
+	a := NewHMACAuthenticator(func(keyid string) ([]byte, bool) {
+		return []byte("secret"), keyid == "gw1"
+	})
+	srv, serr, cerr := initPair(t, a, NewHMACCredential("gw1", []byte("secret")))
+	if serr != nil || cerr != nil {
+		t.Fatalf("server:%v, client:%v", serr, cerr)
+	}
+	if id := srv.Identity(); id == nil || id.Subject != "gw1" || id.Method != HMACName {
+		t.Fatalf("identity:%+v", id)
+	}
+
+	_, serr, cerr = initPair(t, a, NewHMACCredential("gw1", []byte("wrong")))
+	if !errors.Is(serr, proto.ErrAuthFail) || !errors.Is(cerr, proto.ErrAuthFail) {
+		t.Fatalf("server:%v, client:%v", serr, cerr)
+	}
+}
+
+func TestHMACReplay(t *testing.T) {
+	a := NewHMACAuthenticator(func(string) ([]byte, bool) { return []byte("secret"), true })
+	c := NewHMACCredential("gw1", []byte("secret"))
+	nonce, _ := a.Challenge()
+	resp, _ := c.Response(nonce)
+	if _, err := a.Verify(nonce, resp); err != nil {
+		t.Fatal(err)
+	}
+	nonce2, _ := a.Challenge()
+	if _, err := a.Verify(nonce2, resp); err != ErrBadSignature {
+		t.Fatalf("replay err:%v", err)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	key := []byte("jwt-key")
+	v := NewJWTVerifier(func(*jwt.Token) (interface{}, error) { return key, nil }, "gateway", "HS256")
+	sign := func(claims jwt.MapClaims) *JWTCredential {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewJWTCredential(func() (string, error) { return s, nil })
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+
+	srv, serr, cerr := initPair(t, v, sign(jwt.MapClaims{"sub": "alice", "aud": "gateway", "exp": exp}))
+	if serr != nil || cerr != nil {
+		t.Fatalf("server:%v, client:%v", serr, cerr)
+	}
+	if id := srv.Identity(); id == nil || id.Subject != "alice" || id.Claims["aud"] != "gateway" {
+		t.Fatalf("identity:%+v", id)
+	}
+
+	cases := map[string]jwt.MapClaims{
+		"expired":  {"sub": "alice", "aud": "gateway", "exp": time.Now().Add(-time.Minute).Unix()},
+		"no exp":   {"sub": "alice", "aud": "gateway"},
+		"audience": {"sub": "alice", "aud": "other", "exp": exp},
+	}
+	for name, claims := range cases {
+		_, serr, cerr := initPair(t, v, sign(claims))
+		if serr == nil || !errors.Is(cerr, proto.ErrAuthFail) {
+			t.Fatalf("%s: server:%v, client:%v", name, serr, cerr)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/jursonmo/practise/pkg/proto"
+)
+
+const (
+	HMACName = "hmac-sha256"
+	//server 每个连接生成的随机数长度
+	NonceSize = 32
+)
+
+var (
+	ErrUnknownKeyId = errors.New("unknown key id")
+	ErrBadSignature = errors.New("bad signature")
+)
+
+//HMACAuthenticator: server 发随机nonce, client 回应 HMAC-SHA256(secret, nonce+keyid) + keyid,
+//secret 不会在网络上传输, nonce 每次都不一样, 所以回应不能重放
+type HMACAuthenticator struct {
+	secret func(keyid string) ([]byte, bool)
+}
+
+//NewHMACAuthenticator secret 根据client 的keyid 返回对应的secret
+func NewHMACAuthenticator(secret func(keyid string) ([]byte, bool)) *HMACAuthenticator {
+	return &HMACAuthenticator{secret: secret}
+}
+
+func (a *HMACAuthenticator) Name() string {
+	return HMACName
+}
+
+func (a *HMACAuthenticator) Challenge() ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+func (a *HMACAuthenticator) Verify(challenge, resp []byte) (*proto.Identity, error) {
+	if len(resp) < sha256.Size {
+		return nil, ErrBadSignature
+	}
+	mac, keyid := resp[:sha256.Size], string(resp[sha256.Size:])
+	secret, ok := a.secret(keyid)
+	if !ok {
+		return nil, ErrUnknownKeyId
+	}
+	if !hmac.Equal(mac, hmacSum(secret, challenge, keyid)) {
+		return nil, ErrBadSignature
+	}
+	return &proto.Identity{Subject: keyid, Method: HMACName}, nil
+}
+
+//HMACCredential is the client side of HMACAuthenticator
+type HMACCredential struct {
+	KeyId  string
+	Secret []byte
+}
+
+func NewHMACCredential(keyid string, secret []byte) *HMACCredential {
+	return &HMACCredential{KeyId: keyid, Secret: secret}
+}
+
+func (c *HMACCredential) Name() string {
+	return HMACName
+}
+
+func (c *HMACCredential) Response(challenge []byte) ([]byte, error) {
+	if len(challenge) < NonceSize {
+		return nil, errors.New("challenge too short")
+	}
+	return append(hmacSum(c.Secret, challenge, c.KeyId), c.KeyId...), nil
+}
+
+func hmacSum(secret, nonce []byte, keyid string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(nonce)
+	h.Write([]byte(keyid))
+	return h.Sum(nil)
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/jursonmo/practise/pkg/proto"
+)
+
+const JWTName = "jwt"
+
+var (
+	ErrTokenExpired = errors.New("token expired or exp missing")
+	ErrAudience     = errors.New("token audience mismatch")
+)
+
+//JWTVerifier 校验client 发来的bearer token: 签名, exp(必须有), aud
+type JWTVerifier struct {
+	keyfunc  jwt.Keyfunc
+	audience string
+	methods  []string
+}
+
+//NewJWTVerifier keyfunc 返回校验签名用的key, audience 为空表示不检查aud,
+//methods 是允许的签名算法, 比如"HS256", "RS256", 为空表示不限制(不推荐)
+func NewJWTVerifier(keyfunc jwt.Keyfunc, audience string, methods ...string) *JWTVerifier {
+	return &JWTVerifier{keyfunc: keyfunc, audience: audience, methods: methods}
+}
+
+func (v *JWTVerifier) Name() string {
+	return JWTName
+}
+
+//Challenge token 自带exp, 不需要challenge
+func (v *JWTVerifier) Challenge() ([]byte, error) {
+	return nil, nil
+}
+
+func (v *JWTVerifier) Verify(_, resp []byte) (*proto.Identity, error) {
+	var opts []jwt.ParserOption
+	if len(v.methods) > 0 {
+		opts = append(opts, jwt.WithValidMethods(v.methods))
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(string(resp), claims, v.keyfunc, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("parse token:%w", err)
+	}
+	//ParseWithClaims 只在有exp 时检查, 这里要求必须有exp
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, ErrTokenExpired
+	}
+	if v.audience != "" && !claims.VerifyAudience(v.audience, true) {
+		return nil, ErrAudience
+	}
+	sub, _ := claims["sub"].(string)
+	return &proto.Identity{Subject: sub, Method: JWTName, Claims: claims}, nil
+}
+
+//JWTCredential is the client side of JWTVerifier, token 每次连接时获取, 方便刷新
+type JWTCredential struct {
+	token func() (string, error)
+}
+
+func NewJWTCredential(token func() (string, error)) *JWTCredential {
+	return &JWTCredential{token: token}
+}
+
+func (c *JWTCredential) Name() string {
+	return JWTName
+}
+
+func (c *JWTCredential) Response(_ []byte) ([]byte, error) {
+	t, err := c.token()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(t), nil
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"context"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jursonmo/practise/pkg/backoffx"
+)
+
+// Strategy decide which endpoint to dial
+type Strategy int
+
+const (
+	Failover   Strategy = iota //按endpoints 的顺序, 总是选第一个可用的
+	RoundRobin                 //轮询
+	Random                     //随机
+	LowestRTT                  //心跳rtt 最小的, 还没有rtt 的endpoint 优先, 这样每个endpoint 都有机会测量rtt
+)
+
+var (
+	DefaultCooldownMin = time.Second * 2
+	DefaultCooldownMax = time.Second * 30
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case Failover:
+		return "failover"
+	case RoundRobin:
+		return "roundrobin"
+	case Random:
+		return "random"
+	case LowestRTT:
+		return "lowest_rtt"
+	default:
+		return "unknown"
+	}
+}
+
+type endpoint struct {
+	url        *url.URL
+	blockUntil time.Time //dial 或者handshake 失败后, 冷却期内不会再选这个endpoint
+	backoff    backoffx.Backoffer
+	rtt        time.Duration
+	connectAt  time.Time //Init 成功的时间, 用来判断连接是否稳定
+}
+
+func (e *endpoint) addr() string {
+	return e.url.String() //unix:// 的地址在Path 里
+}
+
+type picker struct {
+	sync.Mutex
+	strategy Strategy
+	eps      []*endpoint
+	next     int
+	stable   time.Duration //连接保持超过stable 才reset backoff
+}
+
+func newPicker(urls []*url.URL, strategy Strategy, cooldownMin, cooldownMax time.Duration) *picker {
+	p := &picker{strategy: strategy, stable: cooldownMax}
+	for _, u := range urls {
+		p.eps = append(p.eps, &endpoint{url: u, backoff: backoffx.NewDynamicBackoff(cooldownMin, cooldownMax, 2.0)})
+	}
+	return p
+}
+
+//pick 返回可用的endpoint, 如果都在冷却期, 返回最早结束冷却的endpoint 以及需要等待的时间
+func (p *picker) pick() (*endpoint, time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	avail := make([]*endpoint, 0, len(p.eps))
+	var earliest *endpoint
+	for _, e := range p.eps {
+		if !now.Before(e.blockUntil) {
+			avail = append(avail, e)
+			continue
+		}
+		if earliest == nil || e.blockUntil.Before(earliest.blockUntil) {
+			earliest = e
+		}
+	}
+	if len(avail) == 0 {
+		return earliest, earliest.blockUntil.Sub(now)
+	}
+
+	switch p.strategy {
+	case RoundRobin:
+		e := avail[p.next%len(avail)]
+		p.next++
+		return e, 0
+	case Random:
+		return avail[rand.Intn(len(avail))], 0
+	case LowestRTT:
+		best := avail[0]
+		for _, e := range avail[1:] {
+			if e.rtt < best.rtt {
+				best = e
+			}
+		}
+		return best, 0
+	default:
+		return avail[0], 0
+	}
+}
+
+func (p *picker) fail(e *endpoint) {
+	p.Lock()
+	defer p.Unlock()
+	e.blockUntil = time.Now().Add(e.backoff.Duration())
+}
+
+//success 不reset backoff, 不然server accept 后马上断开, client 会不停地重连, 见closed
+func (p *picker) success(e *endpoint) {
+	p.Lock()
+	defer p.Unlock()
+	e.blockUntil = time.Time{}
+	e.connectAt = time.Now()
+}
+
+//closed session 结束后调用, 只有这个endpoint 进入冷却期(至少cooldownMin), 重连时马上选其他可用的endpoint, 都在冷却期才等;
+//连接稳定超过stable 才reset backoff, 连上就断的话冷却时间会一直增长到cooldownMax
+func (p *picker) closed(e *endpoint) {
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	if now.Before(e.blockUntil) {
+		//已经fail 过了, 比如收到CloseTryAgainLater
+		return
+	}
+	if now.Sub(e.connectAt) >= p.stable {
+		e.backoff.Reset()
+	}
+	e.blockUntil = now.Add(e.backoff.Duration())
+}
+
+func (p *picker) updateRTT(e *endpoint, rtt time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	e.rtt = rtt
+}
+
+//wait until the endpoint cool down or ctx done
+func waitCooldown(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
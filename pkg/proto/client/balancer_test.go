@@ -0,0 +1,115 @@
+package client
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func testURLs(t *testing.T, addrs ...string) []*url.URL {
+	var urls []*url.URL
+	for _, addr := range addrs {
+		u, err := url.Parse(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+func TestPickerFailover(t *testing.T) {
+	p := newPicker(testURLs(t, "tcp://127.0.0.1:1", "tcp://127.0.0.1:2"), Failover, time.Second, time.Second*2)
+	e, wait := p.pick()
+	if e != p.eps[0] || wait != 0 {
+		t.Fatalf("expect first endpoint, got:%v, wait:%v", e.url, wait)
+	}
+	p.fail(e)
+	e, _ = p.pick()
+	if e != p.eps[1] {
+		t.Fatalf("expect second endpoint after first fail, got:%v", e.url)
+	}
+	p.fail(e)
+	//all in cooldown, return the earliest one with wait time
+	e, wait = p.pick()
+	if e != p.eps[0] || wait <= 0 || wait > time.Second {
+		t.Fatalf("expect first endpoint and wait, got:%v, wait:%v", e.url, wait)
+	}
+	p.success(p.eps[0])
+	if e, wait = p.pick(); e != p.eps[0] || wait != 0 {
+		t.Fatalf("expect first endpoint after success, got:%v, wait:%v", e.url, wait)
+	}
+}
+
+func TestPickerRoundRobinAndRTT(t *testing.T) {
+	urls := testURLs(t, "tcp://127.0.0.1:1", "tcp://127.0.0.1:2", "tcp://127.0.0.1:3")
+	p := newPicker(urls, RoundRobin, time.Second, time.Second)
+	for i := 0; i < 6; i++ {
+		if e, _ := p.pick(); e != p.eps[i%3] {
+			t.Fatalf("round %d, expect:%v, got:%v", i, p.eps[i%3].url, e.url)
+		}
+	}
+
+	p = newPicker(urls, LowestRTT, time.Second, time.Second)
+	p.updateRTT(p.eps[0], time.Millisecond*30)
+	p.updateRTT(p.eps[1], time.Millisecond*10)
+	p.updateRTT(p.eps[2], time.Millisecond*20)
+	if e, _ := p.pick(); e != p.eps[1] {
+		t.Fatalf("expect lowest rtt endpoint:%v, got:%v", p.eps[1].url, e.url)
+	}
+	p.fail(p.eps[1])
+	if e, _ := p.pick(); e != p.eps[2] {
+		t.Fatalf("expect endpoint:%v, got:%v", p.eps[2].url, e.url)
+	}
+}
+
+func TestPickerReconnectFloor(t *testing.T) {
+	p := newPicker(testURLs(t, "tcp://127.0.0.1:1"), Failover, time.Second, time.Second*4)
+	e := p.eps[0]
+	//重连前要等的时间
+	wait := func() time.Duration {
+		_, d := p.pick()
+		return d.Round(time.Millisecond * 100)
+	}
+	//连上就断, 重连等待时间从min 开始增长, 不会因为success 而变成0
+	var last time.Duration
+	for i := 0; i < 3; i++ {
+		p.success(e)
+		p.closed(e)
+		d := wait()
+		if d < time.Second || d < last {
+			t.Fatalf("round %d, unexpect reconnect wait:%v, last:%v", i, d, last)
+		}
+		last = d
+	}
+	if last != time.Second*4 {
+		t.Fatalf("expect wait grow to max, got:%v", last)
+	}
+
+	//连接稳定超过stable 后reset backoff
+	p.success(e)
+	e.connectAt = time.Now().Add(-p.stable)
+	p.closed(e)
+	if d := wait(); d != time.Second {
+		t.Fatalf("expect min wait after stable conn, got:%v", d)
+	}
+
+	//已经fail 进入冷却期的, 不再增加冷却时间
+	p.success(e)
+	p.fail(e)
+	before := e.blockUntil
+	p.closed(e)
+	if e.blockUntil != before {
+		t.Fatalf("closed after fail should keep the cooldown")
+	}
+}
+
+func TestPickerCloseFailover(t *testing.T) {
+	p := newPicker(testURLs(t, "tcp://127.0.0.1:1", "tcp://127.0.0.1:2"), Failover, time.Second, time.Second*4)
+	//第一个endpoint 的session 结束, 马上换第二个, 不用等冷却期
+	p.success(p.eps[0])
+	p.closed(p.eps[0])
+	if e, d := p.pick(); e != p.eps[1] || d != 0 {
+		t.Fatalf("pick:%s, wait:%v", e.addr(), d)
+	}
+}
@@ -3,13 +3,12 @@ package client
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,6 +17,7 @@ import (
 	"github.com/jursonmo/practise/pkg/heartbeat"
 	"github.com/jursonmo/practise/pkg/proto"
 	"github.com/jursonmo/practise/pkg/proto/session"
+	"github.com/jursonmo/practise/pkg/udp"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -37,8 +37,22 @@ type Client struct {
 	onDialFail func(error)
 	onConnect  func(session.Sessioner) error
 	onStop     func(string)
+	onSwitch   func(from, to *url.URL)
+	onClose    func(s session.Sessioner, code int, msg string)
+	onResume   func(session.Sessioner)
+
+	strategy    Strategy
+	cooldownMin time.Duration
+	cooldownMax time.Duration
+	picker      *picker
+	active      *url.URL //当前连接的endpoint
+	dialOpts    []dial.DialOption
 
 	pc      *proto.ProtoConn
+	pcOpts  []proto.ProtoConnOpt
+	logger  proto.Logger
+	resume  *proto.ResumeState //跨连接保存, 见WithResume
+	session *Session
 	routers *session.RouterRegister
 	// isServer bool
 	// authOk   bool
@@ -64,6 +78,12 @@ func (c *Client) Name() string {
 }
 
 func (c *Client) SessionID() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.sessionID()
+}
+
+func (c *Client) sessionID() string {
 	if c.conn != nil {
 		return fmt.Sprintf("%v->%v", c.conn.LocalAddr(), c.conn.RemoteAddr())
 	}
@@ -71,6 +91,8 @@ func (c *Client) SessionID() string {
 }
 
 func (c *Client) UnderlayConn() net.Conn {
+	c.Lock()
+	defer c.Unlock()
 	return c.conn
 }
 
@@ -78,12 +100,23 @@ func (c *Client) Endpoints() []*url.URL {
 	return c.endpoints
 }
 
+//ActiveEndpoint return the endpoint of current connection
+func (c *Client) ActiveEndpoint() *url.URL {
+	c.Lock()
+	defer c.Unlock()
+	return c.active
+}
+
 func (c *Client) String() string {
 	return fmt.Sprintf("name:%v, id:%v", c.name, c.SessionID())
 }
 
 func NewClient(endpoints []string, opts ...Option) (*Client, error) {
-	c := &Client{routers: session.NewRouterRegister()}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no endpoint")
+	}
+	c := &Client{routers: session.NewRouterRegister(), strategy: Failover,
+		cooldownMin: DefaultCooldownMin, cooldownMax: DefaultCooldownMax, logger: proto.NopLogger}
 	for _, endpoint := range endpoints {
 		url, err := url.Parse(endpoint)
 		if err != nil {
@@ -94,6 +127,7 @@ func NewClient(endpoints []string, opts ...Option) (*Client, error) {
 	for _, opt := range opts {
 		opt(c)
 	}
+	c.picker = newPicker(c.endpoints, c.strategy, c.cooldownMin, c.cooldownMax)
 	return c, nil
 }
 
@@ -105,47 +139,95 @@ func (c *Client) Start(ctx context.Context) error {
 			if err := c.ctx.Err(); err != nil {
 				return err
 			}
-			e := c.endpoints[0]
-			addr := e.Scheme + "://" + e.Host
-			conn, err := dial.Dial(c.ctx, addr,
-				dial.WithBackOffer(backoffx.NewDynamicBackoff(time.Second*2, time.Second*30, 2.0)),
-				dial.WithKeepAlive(time.Second*5), dial.WithTcpUserTimeout(time.Second*5), dial.WithDialFailFunc(c.onDialFail))
-			if err != nil {
-				log.Println("dial stoped, err:", err)
-				//dial 会一直在后台拨号，知道ctx 被cancel, 所以dial返回err 后，就需要继续dial 来，直接返回
+			//所有endpoint 都在冷却期, 就等最早的那个
+			e, wait := c.picker.pick()
+			if err := waitCooldown(c.ctx, wait); err != nil {
 				return err
 			}
+			//每个endpoint 只拨一次, 失败就进入冷却期, 换下一个endpoint
+			conn, err := c.dial(e)
+			if err != nil {
+				if c.ctx.Err() != nil {
+					c.logger.Infof("dial stoped, err:%v", err)
+					return err
+				}
+				c.logger.Errorf("dial %s err:%v", e.addr(), err)
+				c.picker.fail(e)
+				continue
+			}
 
+			pcOpts := c.pcOpts
+			if isUDP(e.url) {
+				//udp 默认要握手, 否则server 不存在也会认为连接成功
+				pcOpts = append([]proto.ProtoConnOpt{proto.WithPacketHandshake()}, pcOpts...)
+			}
+			pc := proto.NewProtoConn(conn, false, nil, pcOpts...)
+			c.Lock()
+			if c.closed {
+				c.Unlock()
+				pc.Close()
+				return nil
+			}
+			//Stop 在另一个goroutine 里读c.pc
 			c.conn = conn
-			c.pc = proto.NewProtoConn(conn, false, proto.ProtoMsgHandle(c.msgHandle))
-			//如果设置了SetMsgHandlerv2, 那么c.msgHandle 就不起作用
-			c.pc.SetMsgHandlerv2(proto.ProtoMsgHandlev2(c.msgHandlev2))
+			c.pc = pc
+			c.Unlock()
 
-			err = c.pc.Init(c.ctx)
+			err = pc.Init(c.ctx)
 			if err != nil {
-				log.Println("pc.Init err:", err)
+				c.logger.Errorf("%s pc.Init err:%v", e.addr(), err)
+				pc.Close()
+				c.picker.fail(e)
 				continue
 			}
-			s := NewSession(c, c.pc)
-			if c.onConnect != nil {
+			c.picker.success(e)
+
+			//NewSession 会设置pc 的msgHandler, 每次重连都是新的session
+			s := NewSession(c, pc)
+			s.endpoint = e.url
+			c.Lock()
+			c.session = s
+			from := c.active
+			c.active = e.url
+			c.Unlock()
+			if from != nil && from != e.url && c.onSwitch != nil {
+				c.onSwitch(from, e.url)
+			}
+			if s.Resumed() {
+				s.log.Infof("session resumed")
+				if c.onResume != nil {
+					go c.onResume(s)
+				}
+			} else if c.onConnect != nil {
 				//c.onConnect(c)
 				go c.onConnect(s)
 			}
 
 			c.eg, egctx = errgroup.WithContext(c.ctx) //要用c.ctx, 这样c.cancel 才能 取消egctx
 			c.eg.Go(func() error {
-				err := c.pc.Run(egctx)
-				log.Println(err)
+				err := s.pc.Run(egctx)
+				s.log.Infof("session quit, err:%v", err)
+				s.calls.Close(err)
+				var ce *proto.CloseError
+				if errors.As(err, &ce) {
+					//服务器重启或者让稍后再试, 这个endpoint 进入冷却期, 重连时优先选其他endpoint
+					if proto.IsCloseError(ce, proto.CloseTryAgainLater, proto.CloseServiceRestart, proto.CloseGoingAway) {
+						c.picker.fail(e)
+					}
+					if c.onClose != nil {
+						c.onClose(s, ce.Code, ce.Msg)
+					}
+				}
 				return err
 			})
 
 			//注册heartbeat 处理请求回调，默认就是回应原始数据,类型是HeartBeatRespId
 			c.addRouter(uint16(session.HeartBeatReqId),
 				session.HandleFunc(func(s session.Sessioner, msgid uint16, d []byte) {
-					log.Printf("receive hb request:%s", string(d))
-					err := s.WriteMsg(session.HeartBeatRespId, d)
+					s.Logger().Debugf("receive hb request:%s", string(d))
+					err := s.WriteTypedMsg(session.HeartBeatRespId, session.PayloadType(s), d)
 					if err != nil {
-						log.Println("receive hb request, and send hb response err:", err)
+						s.Logger().Errorf("receive hb request, and send hb response err:%v", err)
 					}
 				}))
 
@@ -158,88 +240,67 @@ func (c *Client) Start(ctx context.Context) error {
 				if err != nil {
 					return err
 				}
-				log.Printf("send heartbeat requet len:%d, data:%s", len(buf.Bytes()), buf.String())
+				s.log.Debugf("send heartbeat requet len:%d, data:%s", len(buf.Bytes()), buf.String())
 				//_, err = c.pc.Write(buf.Bytes())
 
-				_, err = c.pc.WriteWithId(session.HeartBeatReqId, buf.Bytes())
+				_, err = pc.WriteWithType(session.HeartBeatReqId, proto.JSON, buf.Bytes())
 				return err
 			}
 
 			//todo抽象出：heartbeater interface{}
 			heartbeater := heartbeat.NewHeartbeat(c.name,
-				heartbeat.DefautConfig, hbsend)
+				heartbeat.DefautConfig, hbsend, heartbeat.WithSuccessHandler(func(name string, rtt time.Duration) {
+					c.picker.updateRTT(e, rtt)
+					s.pc.SetHeartbeatRTT(rtt)
+				}))
 
 			//注册心跳回应处理
-			c.addRouter(uint16(session.HeartBeatRespId), session.HandleFunc(func(s session.Sessioner, id uint16, d []byte) {
-				hb := heartbeat.HbPkg{}
-				err := json.Unmarshal(d, &hb)
-				if err != nil {
-					log.Printf("handle hb response err:%v", err)
-					return
-				}
-				log.Printf("receive hb response:%+v\n", hb)
+			session.Handle(c.routers, uint16(session.HeartBeatRespId), func(s session.Sessioner, hb *heartbeat.HbPkg) {
+				s.Logger().Debugf("receive hb response:%+v", *hb)
 				//return //模拟心跳收不到的情况
-				heartbeater.PutResponse(hb)
-			}))
+				heartbeater.PutResponse(*hb)
+			})
 
 			c.eg.Go(func() error {
 				err := heartbeater.Start(egctx)
-				log.Printf("heartbeat quit, err:%v", err)
+				s.log.Infof("heartbeat quit, err:%v", err)
 				return err
 			})
 
 			c.eg.Go(func() error {
 				<-egctx.Done()
-				c.pc.Close() //make pc.Run() quit
+				pc.Close() //make pc.Run() quit
 				return egctx.Err()
 			})
 			c.eg.Wait()
+
+			//server accept 后马上断开的话, 不能马上重连这个endpoint, 其他endpoint 不用等
+			c.picker.closed(e)
 		}
 	}()
 	return nil
 }
 
-func (c *Client) AddRouter(msgid uint16, r session.Router) error {
+//AddRouter mws 是这个msgid 的middlewares, 见session.Middleware
+func (c *Client) AddRouter(msgid uint16, r session.Router, mws ...session.Middleware) error {
 	//业务数据id 从10开始，0-9 预留给了心跳报文
 	if err := session.CheckMsgId(msgid); err != nil {
 		return err
 	}
-	return c.addRouter(msgid, r)
-}
-
-func (c *Client) addRouter(msgid uint16, r session.Router) error {
-	return c.routers.AddRouter(msgid, r)
+	return c.addRouter(msgid, r, mws...)
 }
 
-func (c *Client) GetRouter(msgid uint16) session.Router {
-	return c.routers.GetRouter(msgid)
+func (c *Client) addRouter(msgid uint16, r session.Router, mws ...session.Middleware) error {
+	return c.routers.AddRouter(msgid, r, mws...)
 }
 
-func (c *Client) msgHandle(pc *proto.ProtoConn, d []byte, t byte) error {
-	if len(d) < 3 {
-		return ErrInvalidData
-	}
-	msgid := binary.BigEndian.Uint16(d)
-	r := c.GetRouter(msgid)
-	if r == nil {
-		return nil
-	}
-	r.Handle(c, msgid, d[2:])
-	return nil
+//Use 注册全局的middlewares, 比如session.Recover
+func (c *Client) Use(mws ...session.Middleware) {
+	c.routers.Use(mws...)
 }
 
-func (c *Client) msgHandlev2(pc *proto.ProtoConn, pkg proto.Pkger) error {
-	msgid, ok := pkg.MsgId()
-	if !ok {
-		log.Println("msgHandlev2 can't get msgid")
-		return nil
-	}
-	r := c.GetRouter(msgid)
-	if r == nil {
-		return nil
-	}
-	r.Handle(c, msgid, pkg.Paylaod())
-	return nil
+func (c *Client) GetRouter(msgid uint16) session.Router {
+	return c.routers.GetRouter(msgid)
 }
 
 func (c *Client) WriteMsg(msgid uint16, d []byte) error {
@@ -254,10 +315,34 @@ func (c *Client) WriteMsg(msgid uint16, d []byte) error {
 }
 
 func (c *Client) WriteMsgv2(msgid uint16, d []byte) error {
-	_, err := c.pc.WriteWithId(msgid, d)
+	c.Lock()
+	pc := c.pc
+	c.Unlock()
+	if pc == nil {
+		return session.ErrSessionClosed
+	}
+	_, err := pc.WriteWithId(msgid, d)
 	return err
 }
 
+//Session return the session of current connection, nil if not connected
+func (c *Client) Session() *Session {
+	c.Lock()
+	defer c.Unlock()
+	return c.session
+}
+
+//Call 在当前连接的session 上发送请求并等待回应
+func (c *Client) Call(ctx context.Context, msgid uint16, req []byte) ([]byte, error) {
+	c.Lock()
+	s := c.session
+	c.Unlock()
+	if s == nil {
+		return nil, session.ErrSessionClosed
+	}
+	return s.Call(ctx, msgid, req)
+}
+
 func (c *Client) Stop(ctx context.Context) error {
 	c.Lock()
 	defer c.Unlock()
@@ -267,14 +352,43 @@ func (c *Client) Stop(ctx context.Context) error {
 	}
 	c.closed = true
 
-	log.Printf("client:%v Stopping\n", c)
+	c.logger.Infof("client name:%v, id:%v Stopping", c.name, c.sessionID())
 	if c.cancel != nil {
 		c.cancel()
 	}
-	c.pc.Close()
+	if c.resume != nil && c.pc != nil {
+		//告诉server 不用再等client 重连
+		c.pc.WriteCloseMsg(proto.CloseNormalClosure, "client stop")
+	}
+	if c.pc != nil {
+		c.pc.Close()
+	}
 
 	if c.onStop != nil {
 		c.onStop(c.Name())
 	}
 	return nil
 }
+
+func isUDP(u *url.URL) bool {
+	return strings.HasPrefix(u.Scheme, "udp")
+}
+
+//dial udp:// 用pkg/udp, 其他的用dial.Dial
+func (c *Client) dial(e *endpoint) (net.Conn, error) {
+	if isUDP(e.url) {
+		//不用batch 读写, 这样ReadDeadline 直接设置在socket 上
+		conn, err := udp.DialWithOpt(c.ctx, e.url.Scheme, "", e.url.Host, udp.WithBatchs(0))
+		if err != nil {
+			if c.onDialFail != nil {
+				c.onDialFail(err)
+			}
+			return nil, err
+		}
+		return conn, nil
+	}
+	opts := []dial.DialOption{dial.WithMaxDial(1),
+		dial.WithBackOffer(backoffx.NewLinearBackoff(0)),
+		dial.WithKeepAlive(time.Second * 5), dial.WithTcpUserTimeout(time.Second * 5), dial.WithDialFailFunc(c.onDialFail)}
+	return dial.Dial(c.ctx, e.addr(), append(opts, c.dialOpts...)...)
+}
@@ -1,6 +1,13 @@
 package client
 
-import "github.com/jursonmo/practise/pkg/proto/session"
+import (
+	"net/url"
+	"time"
+
+	"github.com/jursonmo/practise/pkg/dial"
+	"github.com/jursonmo/practise/pkg/proto"
+	"github.com/jursonmo/practise/pkg/proto/session"
+)
 
 type Option func(*Client)
 
@@ -21,3 +28,78 @@ func WithOnStop(h func(string)) Option {
 		c.onStop = h
 	}
 }
+
+//选择endpoint 的策略, 默认是Failover
+func WithStrategy(strategy Strategy) Option {
+	return func(c *Client) {
+		c.strategy = strategy
+	}
+}
+
+//endpoint dial 或者handshake 失败后的冷却时间, 连续失败时从min 增长到max
+func WithEndpointCooldown(min, max time.Duration) Option {
+	return func(c *Client) {
+		c.cooldownMin = min
+		c.cooldownMax = max
+	}
+}
+
+//client 切换到另一个endpoint 时调用
+func WithOnEndpointSwitch(h func(from, to *url.URL)) Option {
+	return func(c *Client) {
+		c.onSwitch = h
+	}
+}
+
+//收到对端的CloseCmd 时调用, code 是proto.CloseXXX
+func WithOnClose(h func(s session.Sessioner, code int, msg string)) Option {
+	return func(c *Client) {
+		c.onClose = h
+	}
+}
+
+//WithLogger client 和它的session, ProtoConn 都用这个Logger, 默认是proto.NopLogger
+func WithLogger(l proto.Logger) Option {
+	return func(c *Client) {
+		c.logger = l
+		c.pcOpts = append(c.pcOpts, proto.WithLogger(l))
+	}
+}
+
+//WithResume 重连后恢复之前的session: 握手时带上server 分配的token, 双方重发对端没有收到的消息,
+//断线期间WriteMsg 的消息先保存起来(最多maxPending 个没有确认的消息), 恢复时调用WithOnResume 的回调, 不会再调用onConnect.
+//server 要用server.WithResume
+func WithResume(maxPending int) Option {
+	return func(c *Client) {
+		c.resume = proto.NewResumeState(maxPending, session.HeartBeatReqId, session.HeartBeatRespId)
+		c.pcOpts = append(c.pcOpts, proto.WithResume(c.resume))
+	}
+}
+
+//session 恢复到新的连接后调用
+func WithOnResume(h func(session.Sessioner)) Option {
+	return func(c *Client) {
+		c.onResume = h
+	}
+}
+
+//每次连接创建ProtoConn 时使用的option, 比如proto.WithWriteQueue
+func WithProtoConnOpts(opts ...proto.ProtoConnOpt) Option {
+	return func(c *Client) {
+		c.pcOpts = append(c.pcOpts, opts...)
+	}
+}
+
+//dial tcp:// 和tls:// 时追加的dial.DialOption, 比如tls:// 的dial.WithCAFile, dial.WithClientCert
+func WithDialOptions(opts ...dial.DialOption) Option {
+	return func(c *Client) {
+		c.dialOpts = append(c.dialOpts, opts...)
+	}
+}
+
+//连接时用Credential 回应server 的Authenticator, 见proto/auth
+func WithCredential(cred proto.Credential) Option {
+	return func(c *Client) {
+		c.pcOpts = append(c.pcOpts, proto.WithCredential(cred))
+	}
+}
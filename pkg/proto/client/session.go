@@ -1,6 +1,8 @@
 package client
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"net/url"
@@ -14,14 +16,22 @@ type Session struct {
 	id   string
 	name string
 	//srv  *Server
-	cli *Client
-	pc  *proto.ProtoConn
+	cli      *Client
+	pc       *proto.ProtoConn
+	calls    *session.Calls
+	endpoint *url.URL
+	log      proto.Logger
 	//eg  *errgroup.Group
 	//routers *session.RouterRegister
 }
 
 func NewSession(cli *Client, pc *proto.ProtoConn) *Session {
-	return &Session{cli: cli, pc: pc}
+	s := &Session{cli: cli, pc: pc, calls: session.NewCalls()}
+	s.log = proto.WithFields(pc.Logger(), "session", s.SessionID())
+	pc.SetMsgHandler(proto.ProtoMsgHandle(s.msgHandle))
+	//如果设置了SetMsgHandlerv2, 那么s.msgHandle 就不起作用
+	pc.SetMsgHandlerv2(proto.ProtoMsgHandlev2(s.msgHandlev2))
+	return s
 }
 
 //实现session.Sessioner接口
@@ -47,10 +57,95 @@ func (s *Session) SessionID() string {
 	}
 	return "nil"
 }
+
+//Resumed 表示这个连接恢复了之前的session, 见WithResume
+func (s *Session) Resumed() bool {
+	return s.pc.Resumed()
+}
+
+func (s *Session) Logger() proto.Logger {
+	return s.log
+}
+
+func (s *Session) Identity() *proto.Identity {
+	return s.pc.Identity()
+}
+
+//Endpoints return the active endpoint of this session
 func (s *Session) Endpoints() []*url.URL {
-	return s.cli.Endpoints()
+	if s.endpoint == nil {
+		return nil
+	}
+	return []*url.URL{s.endpoint}
 }
 func (s *Session) WriteMsg(msgid uint16, d []byte) error {
 	_, err := s.pc.WriteWithId(msgid, d)
 	return err
 }
+
+//Stats return the counters of the underlay ProtoConn
+func (s *Session) Stats() proto.Stats {
+	return s.pc.Stats()
+}
+
+func (s *Session) WriteTypedMsg(msgid uint16, t byte, d []byte) error {
+	_, err := s.pc.WriteWithType(msgid, t, d)
+	return err
+}
+
+//Call 发送请求并等待对端回应, 对端没有注册msgid 的router 时返回*session.NoRouterError
+func (s *Session) Call(ctx context.Context, msgid uint16, req []byte) ([]byte, error) {
+	return s.calls.Call(ctx, msgid, func(callid uint32) error {
+		_, err := s.pc.WriteCall(msgid, proto.CallReq, callid, req)
+		return err
+	})
+}
+
+func (s *Session) msgHandle(pc *proto.ProtoConn, d []byte, t byte) error {
+	if len(d) < 3 {
+		return ErrInvalidData
+	}
+	msgid := binary.BigEndian.Uint16(d)
+	r := s.cli.GetRouter(msgid)
+	if r == nil {
+		return nil
+	}
+	r.Handle(s, msgid, d[2:])
+	return nil
+}
+
+func (s *Session) msgHandlev2(pc *proto.ProtoConn, pkg proto.Pkger) error {
+	msgid, ok := pkg.MsgId()
+	if !ok {
+		s.log.Errorf("msgHandlev2 can't get msgid")
+		return nil
+	}
+	if flag, callid, ok := pkg.CallId(); ok {
+		return s.handleCall(msgid, flag, callid, pkg.Type(), pkg.Paylaod())
+	}
+	r := s.cli.GetRouter(msgid)
+	if r == nil {
+		return nil
+	}
+	r.Handle(session.WithPayloadType(s, pkg.Type()), msgid, pkg.Paylaod())
+	return nil
+}
+
+func (s *Session) handleCall(msgid uint16, flag byte, callid uint32, t byte, d []byte) error {
+	//对端的回应
+	if flag != proto.CallReq {
+		if !s.calls.Deliver(flag, callid, d) {
+			s.log.Errorf("drop call response, msgid:%d, callid:%d", msgid, callid)
+		}
+		return nil
+	}
+
+	err := session.HandleCall(session.WithPayloadType(s, t), s.cli.GetRouter(msgid), msgid, d, func(id uint16, flag byte, t byte, resp []byte) error {
+		_, err := s.pc.WriteTypedCall(id, flag, t, callid, resp)
+		return err
+	})
+	if err != nil {
+		s.log.Errorf("reply call msgid:%d, callid:%d err:%v", msgid, callid, err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package proto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var closeCodeText = map[int]string{
+	CloseNormalClosure:           "normal",
+	CloseGoingAway:               "going away",
+	CloseProtocolError:           "protocol error",
+	CloseUnsupportedData:         "unsupported data",
+	CloseNoStatusReceived:        "no status",
+	CloseAbnormalClosure:         "abnormal closure",
+	CloseInvalidFramePayloadData: "invalid payload data",
+	ClosePolicyViolation:         "policy violation",
+	CloseMessageTooBig:           "message too big",
+	CloseMandatoryExtension:      "mandatory extension missing",
+	CloseInternalServerErr:       "internal server error",
+	CloseServiceRestart:          "service restart",
+	CloseTryAgainLater:           "try again later",
+	CloseTLSHandshake:            "TLS handshake error",
+}
+
+// CloseError is returned by Decode(and ProtoConn.Run) when receive a CloseCmd from peer,
+// use errors.As to get the Code and Msg
+type CloseError struct {
+	Code int
+	Msg  string
+}
+
+func (e *CloseError) Error() string {
+	s := closeCodeText[e.Code]
+	if s == "" {
+		s = "unknown"
+	}
+	return fmt.Sprintf("close %d (%s): %s", e.Code, s, e.Msg)
+}
+
+func FormatCloseCmdErr(d []byte) error {
+	p := CloseCmdPayLoad{}
+	if err := json.Unmarshal(d, &p); err != nil {
+		return &CloseError{Code: CloseNoStatusReceived, Msg: string(d)}
+	}
+	return &CloseError{Code: p.Code, Msg: p.Msg}
+}
+
+// IsCloseError returns true if err is a *CloseError with one of the codes
+func IsCloseError(err error, codes ...int) bool {
+	var e *CloseError
+	if !errors.As(err, &e) {
+		return false
+	}
+	for _, code := range codes {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func IsServiceRestart(err error) bool {
+	return IsCloseError(err, CloseServiceRestart)
+}
+
+func IsGoingAway(err error) bool {
+	return IsCloseError(err, CloseGoingAway)
+}
+
+func IsPolicyViolation(err error) bool {
+	return IsCloseError(err, ClosePolicyViolation)
+}
+
+func IsTryAgainLater(err error) bool {
+	return IsCloseError(err, CloseTryAgainLater)
+}
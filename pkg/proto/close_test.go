@@ -0,0 +1,46 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestCloseError(t *testing.T) {
+	data, _ := json.Marshal(CloseCmdPayLoad{Code: CloseTryAgainLater, Msg: "busy"})
+	pkg, err := EncodeCmdPkg(CloseCmd, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = NewProtoPkg().Decode(bytes.NewReader(pkg.Bytes()))
+	var ce *CloseError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expect *CloseError, err:%v", err)
+	}
+	if ce.Code != CloseTryAgainLater || ce.Msg != "busy" {
+		t.Fatalf("code:%d, msg:%s", ce.Code, ce.Msg)
+	}
+	if !IsTryAgainLater(err) || IsPolicyViolation(err) || IsServiceRestart(err) {
+		t.Fatalf("helpers mismatch, err:%v", err)
+	}
+	if IsCloseError(errors.New("xx"), CloseTryAgainLater) {
+		t.Fatal("plain error is not CloseError")
+	}
+}
+
+//没有payload 的CloseCmd
+func TestBareCloseCmd(t *testing.T) {
+	pkg, err := EncodeCmdPkg(CloseCmd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Hlen != ProtoHeaderSize || pkg.Plen != 0 {
+		t.Fatalf("Hlen:%d, Plen:%d", pkg.Hlen, pkg.Plen)
+	}
+	err = NewProtoPkg().Decode(bytes.NewReader(pkg.Bytes()))
+	if !IsCloseError(err, CloseNoStatusReceived) {
+		t.Fatalf("expect *CloseError with CloseNoStatusReceived, err:%v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jursonmo/practise/pkg/encoding"
+	_ "github.com/jursonmo/practise/pkg/encoding/gzip"
+	_ "github.com/jursonmo/practise/pkg/encoding/lz4"
+	_ "github.com/jursonmo/practise/pkg/encoding/snappy"
+	_ "github.com/jursonmo/practise/pkg/encoding/zstd"
+)
+
+//compression id, CompressOpt 的V, 握手的ping 里V 是client 支持的id 列表(按优先级), pong 里是server 选中的id
+const (
+	CompressNone   = 0
+	CompressGzip   = 1
+	CompressZstd   = 2
+	CompressSnappy = 3
+	CompressLz4    = 4
+)
+
+var (
+	//小于这个大小的Msg 不压缩
+	DefaultCompressThreshold = 512
+	//解压后的最大大小, 防止zip bomb
+	DefaultMaxInflateSize = 8 * 1024 * 1024
+)
+
+var ErrInflateTooBig = encoding.ErrDecompressedTooLarge
+
+var CompressNameIdMap = map[string]byte{
+	"gzip":   CompressGzip,
+	"zstd":   CompressZstd,
+	"snappy": CompressSnappy,
+	"lz4":    CompressLz4,
+}
+
+var CompressIdNameMap = map[byte]string{
+	CompressGzip:   "gzip",
+	CompressZstd:   "zstd",
+	CompressSnappy: "snappy",
+	CompressLz4:    "lz4",
+}
+
+var ErrCompressIdUsed = errors.New("compression id is already used")
+
+// RegisterCompression 把应用自己的Compressor 注册到一个空闲的compression id 上,
+// 跟RegisterPayloadCodec 一样，只能在init() 里调用，不是并发安全的
+func RegisterCompression(id byte, c encoding.Compressor) error {
+	if id == CompressNone {
+		return errors.New("compression id 0 is reserved")
+	}
+	if c == nil || c.Name() == "" {
+		return errors.New("invalid compressor")
+	}
+	name := c.Name()
+	if used, ok := CompressIdNameMap[id]; ok {
+		return fmt.Errorf("%w, id:%d, used by:%s", ErrCompressIdUsed, id, used)
+	}
+	if old, ok := CompressNameIdMap[name]; ok {
+		return fmt.Errorf("compressor name:%s already registered with id:%d", name, old)
+	}
+	encoding.RegisterCompressor(c)
+	CompressNameIdMap[name] = id
+	CompressIdNameMap[id] = name
+	return nil
+}
+
+func getCompressor(id byte) encoding.Compressor {
+	name, ok := CompressIdNameMap[id]
+	if !ok {
+		return nil
+	}
+	return encoding.GetCompressor(name)
+}
+
+//WithCompression 按优先级设置支持的压缩算法, client 在握手的ping 里带上, server 选第一个自己也支持的,
+//没有设置握手数据的client 会用DefaultPacketHandshakeData 握手
+func WithCompression(names ...string) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.compressNames = names
+	}
+}
+
+//WithCompressThreshold 小于n 的Msg 不压缩
+func WithCompressThreshold(n int) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.compressThreshold = n
+	}
+}
+
+//WithMaxInflateSize 解压后超过n 就关闭连接
+func WithMaxInflateSize(n int) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.maxInflateSize = n
+	}
+}
+
+//Compression return the name of compression agreed in handshake, "" means no compression
+func (pc *ProtoConn) Compression() string {
+	return CompressIdNameMap[byte(atomic.LoadInt32(&pc.compressId))]
+}
+
+func (pc *ProtoConn) initCompression() {
+	if pc.compressThreshold == 0 {
+		pc.compressThreshold = DefaultCompressThreshold
+	}
+	if pc.maxInflateSize == 0 {
+		pc.maxInflateSize = DefaultMaxInflateSize
+	}
+	for _, name := range pc.compressNames {
+		id, ok := CompressNameIdMap[name]
+		if !ok || getCompressor(id) == nil {
+			pc.logger.Errorf("unknown compression:%s, ignore", name)
+			continue
+		}
+		pc.compressIds = append(pc.compressIds, id)
+	}
+}
+
+//agreeCompression server 从client 的列表里选第一个自己也支持的
+func (pc *ProtoConn) agreeCompression(ids []byte) byte {
+	for _, id := range ids {
+		for _, my := range pc.compressIds {
+			if id == my {
+				return id
+			}
+		}
+	}
+	return CompressNone
+}
+
+//setCompression client 从握手的pong 里得到server 选中的压缩算法, 没有选中返回false
+func (pc *ProtoConn) setCompression(pong *ProtoPkg) bool {
+	opt, ok := pong.option(CompressOpt)
+	if !ok || len(opt.V) != 1 {
+		return false
+	}
+	for _, id := range pc.compressIds {
+		if id == opt.V[0] {
+			atomic.StoreInt32(&pc.compressId, int32(id))
+			return true
+		}
+	}
+	return false
+}
+
+//compress 发送前压缩Msg, 压缩后的数据放在pool buffer 里, pkg Release 时放回pool;
+//不比原来小就不压缩
+func (pc *ProtoConn) compress(pkg *ProtoPkg) {
+	id := byte(atomic.LoadInt32(&pc.compressId))
+	if id == CompressNone || !pc.Capabilities().Has(CapCompression) || pkg.PkgType() != Msg || int(pkg.Plen) < pc.compressThreshold || pkg.buf != nil {
+		return
+	}
+	//CloseCmd 之类的控制报文不压缩, 分片(UnFin) 每片单独压缩
+	if cmd := pkg.GetCmd(); cmd != 0 && cmd != UnFin {
+		return
+	}
+	if _, ok := pkg.option(CompressOpt); ok {
+		return
+	}
+	c := getCompressor(id)
+	if c == nil {
+		return
+	}
+	buf := pkgBufPool.Get(len(pkg.Payload))
+	out, err := c.Compress(buf.Bytes()[:0], pkg.Payload)
+	if err != nil || len(out)+3 >= len(pkg.Payload) {
+		pkgBufPool.Put(buf)
+		return
+	}
+	pkg.buf = buf
+	pkg.Payload = out
+	pkg.Plen = uint32(len(out))
+	v := pkg.optVal[len(pkg.optVal)-1:]
+	v[0] = id
+	pkg.addOption(ProtoHeaderOption{T: CompressOpt, L: 1, V: v})
+}
+
+//inflate Decode 之后, 交给handler 之前解压
+func (pc *ProtoConn) inflate(pkg *ProtoPkg) error {
+	if pkg.PkgType() != Msg {
+		return nil
+	}
+	opt, ok := pkg.option(CompressOpt)
+	if !ok {
+		return nil
+	}
+	if len(opt.V) != 1 {
+		return fmt.Errorf("invalid compress option len:%d", len(opt.V))
+	}
+	c := getCompressor(opt.V[0])
+	if c == nil {
+		return fmt.Errorf("unknown compression id:%d", opt.V[0])
+	}
+	out, err := c.Decompress(pkg.Payload, pc.maxInflateSize)
+	if err != nil {
+		if errors.Is(err, encoding.ErrDecompressedTooLarge) {
+			return fmt.Errorf("%w, max:%d", ErrInflateTooBig, pc.maxInflateSize)
+		}
+		return err
+	}
+	pkg.Payload = out
+	pkg.Plen = uint32(len(out))
+	return nil
+}
+
+func (p *ProtoPkg) option(t byte) (ProtoHeaderOption, bool) {
+	for _, opt := range p.options {
+		if opt.T == t {
+			return opt, true
+		}
+	}
+	return ProtoHeaderOption{}, false
+}
+
+//addOption 加一个option, 并更新Hlen, 尽量用pkg 自己的optArr
+func (p *ProtoPkg) addOption(opt ProtoHeaderOption) {
+	n := len(p.options)
+	if n < len(p.optArr) {
+		copy(p.optArr[:n], p.options)
+		p.optArr[n] = opt
+		p.options = p.optArr[:n+1]
+	} else {
+		p.options = append(p.options[:n:n], opt)
+	}
+	p.Hlen += uint16(opt.Len())
+}
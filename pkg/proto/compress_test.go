@@ -0,0 +1,108 @@
+package proto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//countConn 统计写了多少字节
+type countConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.n, int64(len(b)))
+	return c.Conn.Write(b)
+}
+
+func compressPair(t *testing.T, srvOpts, cliOpts []ProtoConnOpt) (server, client *ProtoConn, cc *countConn, msgs chan []byte, srvErr chan error) {
+	c1, c2 := net.Pipe()
+	msgs = make(chan []byte, 4)
+	srvErr = make(chan error, 1)
+	server = NewProtoConn(c1, true, func(pc *ProtoConn, d []byte, t byte) error {
+		msgs <- d
+		return nil
+	}, srvOpts...)
+	cc = &countConn{Conn: c2}
+	client = NewProtoConn(cc, false, nil, cliOpts...)
+	go func() {
+		srvErr <- server.Run(context.Background())
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("client Init:%v", err)
+	}
+	return
+}
+
+func TestCompressNegotiate(t *testing.T) {
+	big := bytes.Repeat([]byte("compressible "), 1000)
+	for _, name := range []string{"gzip", "zstd", "snappy", "lz4"} {
+		server, client, cc, msgs, _ := compressPair(t,
+			[]ProtoConnOpt{WithCompression("zstd", "snappy", "lz4", "gzip")},
+			[]ProtoConnOpt{WithCompression(name, "gzip")})
+		if client.Compression() != name || server.Compression() != name {
+			t.Fatalf("agreed client:%s, server:%s, want:%s", client.Compression(), server.Compression(), name)
+		}
+		before := atomic.LoadInt64(&cc.n)
+		if _, err := client.WriteWithId(1, big); err != nil {
+			t.Fatal(err)
+		}
+		if d := <-msgs; !bytes.Equal(d, big) {
+			t.Fatalf("%s: inflated data mismatch, len:%d", name, len(d))
+		}
+		if n := atomic.LoadInt64(&cc.n) - before; n >= int64(len(big)) {
+			t.Fatalf("%s: sent %d bytes, not compressed", name, n)
+		}
+		//小于threshold 的不压缩
+		before = atomic.LoadInt64(&cc.n)
+		client.Write([]byte("tiny"))
+		if d := <-msgs; string(d) != "tiny" {
+			t.Fatalf("got %s", d)
+		}
+		if n := atomic.LoadInt64(&cc.n) - before; n != ProtoHeaderSize+4 {
+			t.Fatalf("tiny msg sent %d bytes", n)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestCompressNotAgreed(t *testing.T) {
+	server, client, _, msgs, _ := compressPair(t, nil, []ProtoConnOpt{WithCompression("zstd")})
+	defer server.Close()
+	defer client.Close()
+	if client.Compression() != "" {
+		t.Fatalf("server doesn't support compression, agreed:%s", client.Compression())
+	}
+	big := bytes.Repeat([]byte("a"), 4096)
+	client.Write(big)
+	if d := <-msgs; !bytes.Equal(d, big) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func TestInflateTooBig(t *testing.T) {
+	server, client, _, _, srvErr := compressPair(t,
+		[]ProtoConnOpt{WithCompression("gzip"), WithMaxInflateSize(1024)},
+		[]ProtoConnOpt{WithCompression("gzip")})
+	defer server.Close()
+	defer client.Close()
+	go client.Run(context.Background())
+	client.Write(make([]byte, 64*1024))
+	select {
+	case err := <-srvErr:
+		if !errors.Is(err, ErrInflateTooBig) {
+			t.Fatalf("expect ErrInflateTooBig, err:%v", err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("server should close the conn")
+	}
+}
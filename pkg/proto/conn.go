@@ -8,21 +8,30 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ProtoConn struct {
-	conn     net.Conn
-	isClosed bool
-	isServer bool
-	authOk   bool
-
-	r              *bufio.Reader
+	conn      net.Conn
+	isClosed  int32
+	closeOnce sync.Once
+	closed    chan struct{}
+	wq        *writeQueue //nil means write to conn directly
+	isServer  bool
+	authOk    bool
+
+	r              *bufio.Reader //流协议才用, 报文协议每次读一个报文到dgram
 	ReadBufferSize int
-	isPacketConn   bool //like udp
+	isPacketConn   bool //like udp, see packetconn.go
+
+	dgram           []byte
+	maxDatagramSize int
+	ctrlResp        []byte //server 在Init 阶段最后发的控制报文, 收到对端重传的请求时重发
+	closeSent       int32
 
 	//
 	handshaker    func(ctx context.Context, conn net.Conn) error
@@ -34,6 +43,50 @@ type ProtoConn struct {
 
 	authReqData func() []byte                 // for client conn, if not nil, means need to send auth request data
 	authHandler func(d []byte) ([]byte, bool) //for server conn: it will be invoked when receive request data
+
+	//challenge-response auth, see auth.go
+	authenticators map[string]Authenticator //for server conn
+	credential     Credential               //for client conn
+	identity       *Identity                //verified peer identity
+
+	//fragmented msg, see fragment.go
+	streamHandler        ProtoStreamHandle
+	fragmentSize         int
+	maxFragmentedMsgSize int64
+	fragmentBufferSize   int
+	maxStreams           int
+	activeStreams        int32                      //还没结束的stream, 包括streamHandler 还没返回的
+	fragments            map[uint32]*fragmentReader //key 是stream id, only used in Run goroutine
+	streamSeq            uint32                     //发送端分配stream id
+
+	pkgRelease bool      //Msg 处理完后是否Release, see pool.go
+	limits     Limits    //Decode 对端数据的限制, see limits.go
+	stats      connStats //see stats.go
+	logger     Logger    //see logger.go
+
+	//per-message compression, see compress.go
+	compressNames     []string
+	compressIds       []byte //支持的压缩算法, 按优先级
+	compressId        int32  //握手协商的压缩算法, 0 表示不压缩
+	compressThreshold int
+	maxInflateSize    int
+
+	//how Run hands Msg to handlers, see dispatch.go
+	dispatchMode    DispatchMode
+	dispatchWorkers int
+	dispatchKey     func(pkg Pkger) uint64
+
+	//version and capabilities negotiation, see negotiate.go
+	localCaps Capability
+	capsSet   bool
+	version   int32  //agreed version
+	caps      uint32 //agreed capabilities
+
+	//session resumption, see resume.go
+	resume         *ResumeState
+	resumeHandler  func(token []byte) (*ResumeState, bool) //for server conn
+	resumed        bool
+	resumePeerRecv uint32
 }
 
 type ProtoMsgHandle func(pc *ProtoConn, d []byte, t byte) error
@@ -42,6 +95,7 @@ type Pkger interface {
 	Paylaod() []byte
 	Type() byte //payload type
 	MsgId() (uint16, bool)
+	CallId() (flag byte, callid uint32, ok bool)
 }
 
 func (pkg *ProtoPkg) Paylaod() []byte {
@@ -59,19 +113,37 @@ func (pkg *ProtoPkg) MsgId() (uint16, bool) {
 	return 0, false
 }
 
+func (pkg *ProtoPkg) CallId() (byte, uint32, bool) {
+	for _, opt := range pkg.options {
+		if opt.T == CallOpt && len(opt.V) == callOptLen {
+			return opt.V[0], binary.BigEndian.Uint32(opt.V[1:]), true
+		}
+	}
+	return 0, 0, false
+}
+
 var defaultReadBufferSize int = 32 * 1024
 
 func NewProtoConn(c net.Conn, isServer bool, msgHandler ProtoMsgHandle, opts ...ProtoConnOpt) *ProtoConn {
-	pc := &ProtoConn{conn: c, isServer: isServer, ReadBufferSize: defaultReadBufferSize}
-	pc.r = bufio.NewReaderSize(pc.conn, pc.ReadBufferSize)
+	pc := &ProtoConn{conn: c, isServer: isServer, ReadBufferSize: defaultReadBufferSize,
+		fragmentSize: DefaultFragmentSize, fragmentBufferSize: DefaultFragmentBufferSize, maxStreams: DefaultMaxStreams,
+		limits: DefaultLimits, closed: make(chan struct{})}
 	pc.msgHandler = msgHandler
 	pc.SetPingHandler(pc.WritePong) //默认会设置回应Pong 消息，payload 不变
 	pc.SetPongHandler(nil)
 	pc.SetAuthHandler(nil) //默认是设置为nil, 即不需要验证，authOk 初始值为true, 如果需要验证，WithAuthHandler设置
+	if addr := c.LocalAddr(); addr != nil {
+		pc.isPacketConn = isPacketNetwork(addr.Network())
+	}
 
 	for _, opt := range opts {
 		opt(pc)
 	}
+	pc.initLogger()
+	pc.initPacketConn()
+	pc.initCompression()
+	pc.initNegotiate()
+	pc.startWriter()
 	return pc
 }
 
@@ -96,9 +168,20 @@ func (c *ProtoConn) SetWriteDeadline(t time.Time) error {
 }
 
 func (pc *ProtoConn) Close() {
-	pc.conn.Close()
-	pc.isClosed = true
+	pc.closeOnce.Do(func() {
+		atomic.StoreInt32(&pc.isClosed, 1)
+		close(pc.closed)
+		if pc.wq != nil {
+			//等writer goroutine 把队列里的数据发出去, 比如close msg
+			pc.conn.SetWriteDeadline(time.Now().Add(DefaultCloseFlushTimeout))
+			<-pc.wq.done
+		}
+		pc.conn.Close()
+	})
+}
 
+func (pc *ProtoConn) IsClosed() bool {
+	return atomic.LoadInt32(&pc.isClosed) == 1
 }
 
 type ProtoConnOpt func(*ProtoConn)
@@ -179,7 +262,7 @@ func (pc *ProtoConn) WritePing(d []byte) error {
 	if err != nil {
 		return err
 	}
-	_, err = pc.conn.Write(pingPkg.Bytes())
+	_, err = pc.writePkg(pingPkg)
 	return err
 }
 
@@ -188,7 +271,7 @@ func (pc *ProtoConn) WritePong(d []byte) error {
 	if err != nil {
 		return err
 	}
-	_, err = pc.conn.Write(pongPkg.Bytes())
+	_, err = pc.writePkg(pongPkg)
 	return err
 }
 
@@ -219,8 +302,7 @@ func (pc *ProtoConn) SendAuthReq(d []byte) error {
 	if err != nil {
 		return err
 	}
-	fmt.Printf("authreq:%v\n", authreq)
-	_, err = pc.conn.Write(authreq.Bytes())
+	_, err = pc.writePkg(authreq)
 	if err != nil {
 		return err
 	}
@@ -236,7 +318,14 @@ func (pc *ProtoConn) WriteCloseMsg(code int, msg string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return pc.conn.Write(pkg.Bytes())
+	if pc.isPacketConn {
+		//重传直到收到对端的ack 或者连接关闭
+		atomic.StoreInt32(&pc.closeSent, 1)
+		n := pkg.Len()
+		_, err = pc.writeCtrlPkg(pkg)
+		return n, err
+	}
+	return pc.writePkg(pkg)
 }
 
 var ErrUnauth = errors.New("unauth")
@@ -251,7 +340,7 @@ func (pc *ProtoConn) Write(d []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return pc.conn.Write(pkg.Bytes())
+	return pc.writePkg(pkg)
 }
 
 func (pc *ProtoConn) WriteWithId(id uint16, d []byte) (int, error) {
@@ -263,19 +352,66 @@ func (pc *ProtoConn) WriteWithId(id uint16, d []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return pc.conn.Write(pkg.Bytes())
+	if pc.resume != nil {
+		return pc.resume.write(pkg, id, d, writeDefault)
+	}
+	return pc.writePkg(pkg)
+}
+
+//WriteWithType 跟WriteWithId 一样, 并设置payload type, 对端按payload type 找codec 解码
+func (pc *ProtoConn) WriteWithType(id uint16, t byte, d []byte) (int, error) {
+	if !pc.authOk {
+		return 0, ErrUnauth
+	}
+	if t > MaxPayloadType {
+		return 0, ErrPayloadType
+	}
+	pkg, err := NewMsgIdOptPkg(d, id)
+	if err != nil {
+		return 0, err
+	}
+	pkg.SetPayloadType(t)
+	if pc.resume != nil {
+		return pc.resume.write(pkg, id, d, writeDefault)
+	}
+	return pc.writePkg(pkg)
+}
+
+//flag: CallReq 表示请求, CallRespOk, CallRespNoRouter 表示回应, 用callid 关联请求和回应
+func (pc *ProtoConn) WriteCall(id uint16, flag byte, callid uint32, d []byte) (int, error) {
+	return pc.WriteTypedCall(id, flag, RawBinary, callid, d)
+}
+
+//WriteTypedCall 跟WriteCall 一样, 设置payload type
+func (pc *ProtoConn) WriteTypedCall(id uint16, flag byte, t byte, callid uint32, d []byte) (int, error) {
+	if !pc.authOk {
+		return 0, ErrUnauth
+	}
+	if t > MaxPayloadType {
+		return 0, ErrPayloadType
+	}
+	if err := pc.checkCap(CapRPC); err != nil {
+		return 0, err
+	}
+	pkg, err := NewCallOptPkg(d, id, flag, callid)
+	if err != nil {
+		return 0, err
+	}
+	pkg.SetPayloadType(t)
+	return pc.writePkg(pkg)
 }
 
 func (pc *ProtoConn) clientHandshake(ctx context.Context) error {
 	d := pc.handshakeData()
-	pingPkg, err := NewPingPkg(d)
+	pingPkg, err := NewPingPkg(d, pc.handshakeOptions()...)
 	if err != nil {
 		return err
 	}
-	_, err = pc.conn.Write(pingPkg.Bytes())
+	stop, err := pc.writeCtrlPkg(pingPkg)
 	if err != nil {
 		return err
 	}
+	defer stop()
 	deadline, ok := ctx.Deadline()
 	if !ok {
 		deadline = time.Now().Add(DefaultHandShakeTimeout)
@@ -283,17 +419,16 @@ func (pc *ProtoConn) clientHandshake(ctx context.Context) error {
 	pc.conn.SetReadDeadline(deadline)
 	defer pc.conn.SetReadDeadline(time.Time{})
 
-	handshake := NewProtoPkg()
-	err = handshake.Decode(pc.r)
+	handshake, err := pc.readInitPkg(Pong)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("reply handshake:%v\n", handshake)
+	defer handshake.Release()
 	if !reflect.DeepEqual(handshake.Payload, d) {
-		fmt.Printf("receive handshake payload:%s, handshakeData:%s\n", string(handshake.Payload), string(d))
+		pc.logger.Errorf("handshake reply payload(len:%d) don't match handshakeData(len:%d)", len(handshake.Payload), len(d))
 		return errors.New("handshake fail")
 	}
-	return nil
+	return pc.setNegotiated(handshake)
 }
 
 func (pc *ProtoConn) serverHandshake(ctx context.Context) error {
@@ -306,20 +441,18 @@ func (pc *ProtoConn) serverHandshake(ctx context.Context) error {
 	defer pc.conn.SetReadDeadline(time.Time{})
 
 	handshake := NewProtoPkg()
-	err := handshake.Decode(pc.r)
+	defer handshake.Release()
+	err := pc.decode(handshake)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("receive handshake request:%v\n", handshake)
 	if !reflect.DeepEqual(handshake.Payload, d) {
-		fmt.Printf("receive handshake payload:%s, don't match handshakeData:%s\n", string(handshake.Payload), string(d))
+		pc.logger.Errorf("handshake request payload(len:%d) don't match handshakeData(len:%d)", len(handshake.Payload), len(d))
 		return errors.New("handshake fail")
 	}
 	//if this is ping ,response pong
 	if handshake.PkgType() == Ping {
-		if pc.pingHandler != nil {
-			return pc.pingHandler(handshake.Payload)
-		}
+		return pc.handlePing(handshake)
 	}
 	return nil
 }
@@ -343,14 +476,23 @@ var DefaultAuthTimeout = time.Second * 2
 
 // client send auth request
 func (pc *ProtoConn) clientAuth(ctx context.Context) error {
+	if pc.credential != nil {
+		defer pc.authDeadline(ctx)()
+		return pc.clientAuthenticate(ctx)
+	}
 	if pc.authReqData == nil {
 		return nil
 	}
 	d := pc.authReqData()
-	err := pc.SendAuthReq(d)
+	authreq, err := NewAuthReqPkg(d)
 	if err != nil {
 		return err
 	}
+	stop, err := pc.writeCtrlPkg(authreq)
+	if err != nil {
+		return err
+	}
+	defer stop()
 
 	deadline, ok := ctx.Deadline()
 	if !ok {
@@ -359,26 +501,25 @@ func (pc *ProtoConn) clientAuth(ctx context.Context) error {
 	pc.conn.SetReadDeadline(deadline)
 	defer pc.conn.SetReadDeadline(time.Time{})
 
-	authresp := NewProtoPkg()
-	err = authresp.Decode(pc.r)
+	authresp, err := pc.readInitPkg(Auth)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("auth reply :%v\n", authresp)
+	defer authresp.Release()
 	if len(authresp.options) == 0 {
 		return errors.New("get response fail")
 	}
 	opt := authresp.options[0]
-	fmt.Printf("authresp.options:%v\n", &opt)
+	pc.logger.Debugf("auth reply type:%d", opt.T)
 	if opt.T != AuthOk {
-		return errors.New(string(opt.V))
+		return fmt.Errorf("%w: %s", ErrAuthFail, opt.V)
 	}
 	return nil
 }
 
 //server handler auth request and response
 func (pc *ProtoConn) serverAuth(ctx context.Context) error {
-	if pc.authHandler == nil {
+	if pc.authHandler == nil && len(pc.authenticators) == 0 {
 		return nil
 	}
 	deadline, ok := ctx.Deadline()
@@ -388,11 +529,11 @@ func (pc *ProtoConn) serverAuth(ctx context.Context) error {
 	pc.conn.SetReadDeadline(deadline)
 	defer pc.conn.SetReadDeadline(time.Time{})
 
-	authReqPkg := NewProtoPkg()
-	err := authReqPkg.Decode(pc.r)
+	authReqPkg, err := pc.readInitPkg(Auth)
 	if err != nil {
 		return err
 	}
+	defer authReqPkg.Release()
 	if authReqPkg.PkgType() != Auth {
 		return errors.New("isn't auth packet")
 	}
@@ -400,12 +541,16 @@ func (pc *ProtoConn) serverAuth(ctx context.Context) error {
 		return errors.New("get response fail")
 	}
 	opt := authReqPkg.options[0]
+	if len(pc.authenticators) > 0 {
+		return pc.serverAuthenticate(ctx, string(opt.V))
+	}
 	authRes, authOk := pc.authHandler(opt.V)
 	authresPkg, err := NewAuthRespPkg(authRes, authOk)
 	if err != nil {
 		return err
 	}
-	_, err = pc.conn.Write(authresPkg.Bytes())
+	pc.setCtrlResp(authresPkg)
+	_, err = pc.writePkg(authresPkg)
 	if err != nil {
 		return err
 	}
@@ -414,77 +559,138 @@ func (pc *ProtoConn) serverAuth(ctx context.Context) error {
 }
 
 func (pc *ProtoConn) Auth(ctx context.Context) error {
+	var err error
 	if pc.isServer {
-		pc.serverAuth(ctx)
+		err = pc.serverAuth(ctx)
 	} else {
-		return pc.clientAuth(ctx)
+		err = pc.clientAuth(ctx)
 	}
-	return nil
+	//authHandler 验证失败时serverAuth 不返回错误, 只是authOk=false
+	if errors.Is(err, ErrAuthFail) || err == nil && !pc.authOk {
+		atomic.AddUint64(&pc.stats.authFailures, 1)
+	}
+	return err
 }
 
 //Run, read loop
 func (pc *ProtoConn) Run(ctx context.Context) error {
 	defer pc.Close()
+	defer pc.abortFragments()
 
 	var err error
 	defer func() {
-		log.Printf("ProtoConn Run task quit, err:%v", err)
+		pc.logger.Infof("ProtoConn Run task quit, err:%v", err)
 	}()
 
+	d := pc.startDispatcher()
+	if d != nil {
+		defer func() {
+			//先关闭连接, 让handler 里的写操作尽快返回
+			pc.Close()
+			d.stop()
+		}()
+	}
+
 	for {
 		pkg := NewProtoPkg()
-		err = pkg.Decode(pc.r)
+		err = pc.decode(pkg)
 		if err != nil {
+			pc.ackClose(err)
+			pc.closeOnProtocolErr(err)
+			if d != nil {
+				if derr := d.loadErr(); derr != nil {
+					err = derr
+				}
+			}
 			return err
 		}
+		if err = pc.inflate(pkg); err != nil {
+			pkg.Release()
+			if code := protocolErrCode(err); code != 0 {
+				pc.WriteCloseMsg(code, err.Error())
+			} else {
+				pc.WriteCloseMsg(CloseInvalidFramePayloadData, err.Error())
+			}
+			return fmt.Errorf("inflate err:%w", err)
+		}
+		if pc.resume != nil && !pc.resumeRecv(pkg) {
+			pkg.Release()
+			continue
+		}
 		t := pkg.PkgType()
 		switch t {
 		case Msg:
 			if !pc.authOk {
-				log.Printf("haven't auth ok")
+				pc.logger.Errorf("haven't auth ok, drop msg")
+				pkg.Release()
 				continue
 			}
-			//msgHandlerv2 优先，如果配置msgHandlerv2 就不会调用msgHandler
-			if pc.msgHandlerv2 != nil {
-				pc.msgHandlerv2(pc, pkg)
+			//报文协议不支持分片, 丢了一个分片整个消息就错了
+			if pkg.GetCmd() == UnFin && pc.isPacketConn {
+				pc.logger.Errorf("fragment on packet conn, drop it")
+				pkg.Release()
 				continue
 			}
-
-			if pc.msgHandler == nil {
-				log.Printf("haven't set raw msg Handler ?")
+			//分片消息, 每个分片都带StreamOpt, UnFin 表示后面还有分片, 最后一个分片不带UnFin
+			if _, ok := pkg.option(StreamOpt); ok || pkg.GetCmd() == UnFin {
+				pkg, err = pc.handleFragment(pkg)
+				if err != nil {
+					pc.closeOnProtocolErr(err)
+					return err
+				}
+				if pkg == nil {
+					continue
+				}
+			}
+			if d != nil {
+				if err = pc.dispatch(d, pkg); err != nil {
+					return err
+				}
 				continue
 			}
-			err = pc.msgHandler(pc, pkg.Payload, byte(pkg.PayloadType()))
-			if err != nil {
-				return fmt.Errorf("msgHandler err:%w", err)
+			if err = pc.handleMsg(pkg); err != nil {
+				return err
 			}
 		case Ping:
-			if pc.pingHandler == nil {
-				continue
-			}
-			//默认是echo, 即回应pong,数据是原来的数据
-			err = pc.pingHandler(pkg.Payload)
+			//默认是echo, 即回应pong,数据是原来的数据; 握手的ping 带CompressOpt 时回应协商结果
+			err = pc.handlePing(pkg)
+			pkg.Release()
 			if err != nil {
 				return fmt.Errorf("pingHandler err:%w", err)
 			}
 		case Pong:
 			if pc.pongHandler == nil {
+				pkg.Release()
 				continue
 			}
 			err = pc.pongHandler(pkg.Payload)
+			pkg.Release()
 			if err != nil {
 				return fmt.Errorf("pongHandler err:%w", err)
 			}
 		case Auth:
+			isReq := len(pkg.options) > 0 && (pkg.options[0].T == AuthReq || pkg.options[0].T == AuthResp)
+			pkg.Release()
+			if !isReq {
+				//报文协议下重复的AuthOk 之类的回应, 忽略
+				continue
+			}
+			if pc.ctrlResp != nil {
+				//报文协议, 对端没收到auth 的回应, 重传了请求
+				if _, err = pc.write(pc.ctrlResp); err != nil {
+					return err
+				}
+				continue
+			}
 			//如果服务器设置authHandler, 就会在serverAuth 处理auth 请求。
 			//如果服务器没有设置authHandler, 而client 要求auth, 就会走到这里，
-			if pc.authHandler == nil {
+			if pc.authHandler == nil && len(pc.authenticators) == 0 {
 				//没有设置authHandler默认认证Ok,返回认证OK信息
 				authresp, err := NewAuthRespPkg(nil, true)
 				if err != nil {
 					return err
 				}
-				_, err = pc.Write(authresp.Bytes())
+				_, err = pc.writePkg(authresp)
 				if err != nil {
 					return err
 				}
@@ -494,6 +700,28 @@ func (pc *ProtoConn) Run(ctx context.Context) error {
 	}
 }
 
+//handleMsg 把Msg 交给handler, 处理完后根据pkgRelease 决定是否Release
+func (pc *ProtoConn) handleMsg(pkg *ProtoPkg) error {
+	//msgHandlerv2 优先，如果配置msgHandlerv2 就不会调用msgHandler
+	if pc.msgHandlerv2 != nil {
+		pc.msgHandlerv2(pc, pkg)
+		pc.releaseMsgPkg(pkg)
+		return nil
+	}
+
+	if pc.msgHandler == nil {
+		pc.logger.Errorf("haven't set raw msg Handler ?")
+		pkg.Release()
+		return nil
+	}
+	err := pc.msgHandler(pc, pkg.Payload, byte(pkg.PayloadType()))
+	pc.releaseMsgPkg(pkg)
+	if err != nil {
+		return fmt.Errorf("msgHandler err:%w", err)
+	}
+	return nil
+}
+
 //初始化，握手或者验证，或者两个都做，
 func (pc *ProtoConn) Init(ctx context.Context) error {
 	//是否配置handshaker 或者 handshakeData
@@ -506,5 +734,9 @@ func (pc *ProtoConn) Init(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	//server 由session 层在确认可以恢复后调用AttachResume
+	if !pc.isServer {
+		return pc.AttachResume()
+	}
 	return nil
 }
@@ -0,0 +1,140 @@
+package proto
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// DispatchMode decide how Run hands Msg to msgHandler/msgHandlerv2
+type DispatchMode int
+
+const (
+	DispatchInline  DispatchMode = iota //在Run 的读循环里直接调用handler, 默认
+	DispatchPool                        //每个连接一个有界的worker pool, 消息之间不保证顺序
+	DispatchOrdered                     //按key(默认msgid) 分到固定的lane, 同一个key 的消息有序, 不同key 并行
+)
+
+//每个lane(DispatchPool 只有一个) 的队列大小, 队列满了Run 就不再读, 由tcp 反压对端
+var DefaultDispatchQueueSize = 128
+
+//MaxPrivateMsgId msgid 小于它的是私有控制消息(比如心跳), 非Inline 模式下也在Run 里直接处理, 不会被慢的handler 卡住
+const MaxPrivateMsgId = 10
+
+//WithDispatch workers 是worker 数或者lane 数, <=0 表示用DispatchInline
+//非Inline 模式Run 退出时会关闭连接并等正在运行的handler 返回
+func WithDispatch(mode DispatchMode, workers int) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		if workers <= 0 {
+			mode = DispatchInline
+		}
+		pc.dispatchMode = mode
+		pc.dispatchWorkers = workers
+	}
+}
+
+//WithDispatchKey DispatchOrdered 模式下用key 选择lane, 默认是msgid, 没有msgid 的消息都在lane 0
+func WithDispatchKey(f func(pkg Pkger) uint64) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.dispatchKey = f
+	}
+}
+
+func MsgIdDispatchKey(pkg Pkger) uint64 {
+	id, _ := pkg.MsgId()
+	return uint64(id)
+}
+
+//StringDispatchKey 把字符串(比如业务里的用户id) hash 成选择lane 的key
+func StringDispatchKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+type dispatcher struct {
+	lanes  []chan *ProtoPkg
+	key    func(pkg Pkger) uint64
+	wg     sync.WaitGroup
+	err    atomic.Value
+	failed int32
+}
+
+//startDispatcher 在Run 开始时调用, Inline 模式返回nil
+func (pc *ProtoConn) startDispatcher() *dispatcher {
+	if pc.dispatchMode == DispatchInline {
+		return nil
+	}
+	d := &dispatcher{key: pc.dispatchKey}
+	if d.key == nil {
+		d.key = MsgIdDispatchKey
+	}
+	if pc.dispatchMode == DispatchPool {
+		//所有worker 共享一个队列
+		ch := make(chan *ProtoPkg, DefaultDispatchQueueSize)
+		d.lanes = []chan *ProtoPkg{ch}
+		for i := 0; i < pc.dispatchWorkers; i++ {
+			d.wg.Add(1)
+			go pc.dispatchWorker(d, ch)
+		}
+		return d
+	}
+	for i := 0; i < pc.dispatchWorkers; i++ {
+		ch := make(chan *ProtoPkg, DefaultDispatchQueueSize)
+		d.lanes = append(d.lanes, ch)
+		d.wg.Add(1)
+		go pc.dispatchWorker(d, ch)
+	}
+	return d
+}
+
+func (pc *ProtoConn) dispatchWorker(d *dispatcher, ch chan *ProtoPkg) {
+	defer d.wg.Done()
+	for pkg := range ch {
+		if atomic.LoadInt32(&d.failed) == 1 {
+			pkg.Release()
+			continue
+		}
+		if err := pc.handleMsg(pkg); err != nil {
+			//跟Inline 模式一样, handler 返回错误就关闭连接, Run 返回这个错误
+			if atomic.CompareAndSwapInt32(&d.failed, 0, 1) {
+				d.err.Store(err)
+				pc.logger.Errorf("dispatch handler err:%v, close conn", err)
+				pc.Close()
+			}
+		}
+	}
+}
+
+//dispatch 放进队列, 队列满了就等, 直到连接关闭; 私有控制消息直接在Run 里处理
+func (pc *ProtoConn) dispatch(d *dispatcher, pkg *ProtoPkg) error {
+	if id, ok := pkg.MsgId(); ok && id < MaxPrivateMsgId {
+		return pc.handleMsg(pkg)
+	}
+	ch := d.lanes[0]
+	if len(d.lanes) > 1 {
+		ch = d.lanes[d.key(pkg)%uint64(len(d.lanes))]
+	}
+	select {
+	case ch <- pkg:
+		return nil
+	case <-pc.closed:
+		pkg.Release()
+		return ErrConnClosed
+	}
+}
+
+//stop 关闭队列并等所有handler 返回, 队列里剩下的消息还会被处理
+func (d *dispatcher) stop() {
+	for _, ch := range d.lanes {
+		close(ch)
+	}
+	d.wg.Wait()
+}
+
+func (d *dispatcher) loadErr() error {
+	if err, ok := d.err.Load().(error); ok {
+		return err
+	}
+	return nil
+}
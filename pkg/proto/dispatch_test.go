@@ -0,0 +1,129 @@
+package proto
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func dispatchPair(t *testing.T, h ProtoMsgHandlev2, opts ...ProtoConnOpt) (client *ProtoConn, runErr chan error) {
+	c1, c2 := net.Pipe()
+	server := NewProtoConn(c1, true, nil, opts...)
+	server.SetMsgHandlerv2(h)
+	client = NewProtoConn(c2, false, nil)
+	runErr = make(chan error, 1)
+	go func() { runErr <- server.Run(context.Background()) }()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+func TestDispatchPool(t *testing.T) {
+	block := make(chan struct{})
+	fast := make(chan struct{}, 1)
+	client, _ := dispatchPair(t, func(pc *ProtoConn, pkg Pkger) error {
+		if id, _ := pkg.MsgId(); id == 11 {
+			<-block
+			return nil
+		}
+		fast <- struct{}{}
+		return nil
+	}, WithDispatch(DispatchPool, 2))
+	defer close(block)
+
+	client.WriteWithId(11, []byte("slow"))
+	client.WriteWithId(12, []byte("fast"))
+	select {
+	case <-fast:
+	case <-time.After(time.Second):
+		t.Fatal("slow handler blocks other msgs")
+	}
+}
+
+//心跳等私有msgid 不排在慢的handler 后面
+func TestDispatchPrivateMsgId(t *testing.T) {
+	for _, mode := range []DispatchMode{DispatchPool, DispatchOrdered} {
+		block := make(chan struct{})
+		heartbeat := make(chan struct{}, 1)
+		client, _ := dispatchPair(t, func(pc *ProtoConn, pkg Pkger) error {
+			if id, _ := pkg.MsgId(); id == 0 {
+				heartbeat <- struct{}{}
+				return nil
+			}
+			<-block
+			return nil
+		}, WithDispatch(mode, 1))
+
+		client.WriteWithId(10, []byte("slow"))
+		client.WriteWithId(0, []byte("ping"))
+		select {
+		case <-heartbeat:
+		case <-time.After(time.Second):
+			t.Fatalf("mode:%d, slow handler blocks heartbeat", mode)
+		}
+		close(block)
+	}
+}
+
+func TestDispatchOrdered(t *testing.T) {
+	var mu sync.Mutex
+	got := make(map[uint16][]uint32)
+	done := make(chan struct{})
+	client, _ := dispatchPair(t, func(pc *ProtoConn, pkg Pkger) error {
+		id, _ := pkg.MsgId()
+		mu.Lock()
+		got[id] = append(got[id], binary.BigEndian.Uint32(pkg.Paylaod()))
+		if len(got[11])+len(got[12]) == 200 {
+			close(done)
+		}
+		mu.Unlock()
+		return nil
+	}, WithDispatch(DispatchOrdered, 4))
+
+	b := make([]byte, 4)
+	for i := 0; i < 100; i++ {
+		for _, id := range []uint16{11, 12} {
+			binary.BigEndian.PutUint32(b, uint32(i))
+			client.WriteWithId(id, b)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("timeout")
+	}
+	for id, seq := range got {
+		for i, v := range seq {
+			if v != uint32(i) {
+				t.Fatalf("msgid:%d out of order at %d, got %d", id, i, v)
+			}
+		}
+	}
+}
+
+func TestDispatchHandlerErr(t *testing.T) {
+	errBoom := errors.New("boom")
+	c1, c2 := net.Pipe()
+	//跟Inline 一样, msgHandler 返回错误会关闭连接
+	server := NewProtoConn(c1, true, func(*ProtoConn, []byte, byte) error { return errBoom },
+		WithDispatch(DispatchPool, 2))
+	client := NewProtoConn(c2, false, nil)
+	defer client.Close()
+	runErr := make(chan error, 1)
+	go func() { runErr <- server.Run(context.Background()) }()
+	client.WriteWithId(11, []byte("x"))
+	select {
+	case err := <-runErr:
+		if !errors.Is(err, errBoom) {
+			t.Fatalf("expect handler err, got:%v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run should quit")
+	}
+}
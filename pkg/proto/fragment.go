@@ -0,0 +1,406 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	DefaultFragmentSize = 16 * 1024
+	//DefaultMaxFragmentedMsgSize 有streamHandler 时一个分片消息的默认上限, 没有streamHandler 时默认是limits.MaxPayload
+	DefaultMaxFragmentedMsgSize = int64(1 << 30)
+	DefaultFragmentBufferSize   = 4 << 20
+	//DefaultMaxStreams 接收端同时在处理的分片消息个数的默认上限
+	DefaultMaxStreams = 64
+)
+
+var (
+	ErrFragmentedMsgTooBig = errors.New("fragmented msg too big")
+	ErrFragmentWriterClose = errors.New("fragment writer closed")
+	ErrFragmentBufferFull  = errors.New("fragment buffer full, stream handler is too slow")
+	ErrTooManyStreams      = errors.New("too many streams")
+)
+
+//大消息分片后，接收端以io.Reader 的方式交给用户, 用户一边读一边处理，不需要把整个消息放在内存里
+type ProtoStreamHandle func(pc *ProtoConn, msgid uint16, r io.Reader) error
+
+func WithStreamHandler(h ProtoStreamHandle) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.streamHandler = h
+	}
+}
+
+//发送端每个分片最大的payload size
+func WithFragmentSize(n int) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		if n > 0 {
+			pc.fragmentSize = n
+		}
+	}
+}
+
+//接收端限制一个分片消息的最大size, 超过后用户读到ErrFragmentedMsgTooBig, 剩下的分片会被丢弃;
+//默认有streamHandler 时是DefaultMaxFragmentedMsgSize, 没有streamHandler 时消息要整个放在内存里, 默认是limits.MaxPayload
+func WithMaxFragmentedMsgSize(n int64) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		if n > 0 {
+			pc.maxFragmentedMsgSize = n
+		}
+	}
+}
+
+//接收端每个分片消息最多缓存多少还没被streamHandler 读走的数据, 超过后用户读到ErrFragmentBufferFull,
+//剩下的分片会被丢弃; Run 不会因为streamHandler 读得慢而阻塞
+func WithFragmentBufferSize(n int) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		if n > 0 {
+			pc.fragmentBufferSize = n
+		}
+	}
+}
+
+//接收端同时在处理的分片消息(stream) 最多n 个, streamHandler 还没返回的也算, 超过就回应CloseProtocolError 并关闭连接
+func WithMaxStreams(n int) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		if n > 0 {
+			pc.maxStreams = n
+		}
+	}
+}
+
+func (pc *ProtoConn) SetStreamHandler(h ProtoStreamHandle) {
+	pc.streamHandler = h
+}
+
+// FragmentWriter split the data into UnFin packets, the last packet is sent without UnFin on Close().
+// 每个FragmentWriter 是一个stream, 分片都带StreamOpt, 同一个msgid 的多个FragmentWriter 可以同时写;
+// 同一个FragmentWriter 的Write/Close 是串行的
+type FragmentWriter struct {
+	mu       sync.Mutex
+	pc       *ProtoConn
+	msgid    uint16
+	streamid uint32 //发送第一个UnFin 分片时分配, 0 表示还没有发送过分片
+	buf      []byte
+	closed   bool
+}
+
+func (pc *ProtoConn) NewFragmentWriter(msgid uint16) *FragmentWriter {
+	size := pc.fragmentSize
+	if size <= 0 {
+		size = DefaultFragmentSize
+	}
+	return &FragmentWriter{pc: pc, msgid: msgid, buf: make([]byte, 0, size)}
+}
+
+//buf 满了并且还有数据要写时才发送出去，这样保证最后一个分片是在Close 时发送，并且不带UnFin
+func (w *FragmentWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrFragmentWriterClose
+	}
+	for len(p) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			if err = w.flush(UnFin); err != nil {
+				return
+			}
+		}
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		n += c
+		p = p[c:]
+	}
+	return
+}
+
+func (w *FragmentWriter) flush(cmd byte) error {
+	if !w.pc.authOk {
+		return ErrUnauth
+	}
+	if cmd == UnFin {
+		if w.pc.isPacketConn {
+			return ErrFragmentOnPacketConn
+		}
+		if err := w.pc.checkCap(CapFragment); err != nil {
+			return err
+		}
+		if w.streamid == 0 {
+			w.streamid = w.pc.nextStreamId()
+		}
+	}
+	var pkg *ProtoPkg
+	var err error
+	if w.streamid == 0 {
+		//只有一个分片, 就是普通的消息
+		pkg, err = NewMsgIdOptPkg(w.buf, w.msgid)
+	} else {
+		pkg, err = NewStreamOptPkg(w.buf, w.msgid, w.streamid)
+	}
+	if err != nil {
+		return err
+	}
+	pkg.SetCmd(cmd)
+	_, err = w.pc.writePkg(pkg)
+	w.buf = w.buf[:0]
+	return err
+}
+
+//send the last fragment
+func (w *FragmentWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(0)
+}
+
+//WriteStream 把r 的数据分片发送，直到r 返回io.EOF
+func (pc *ProtoConn) WriteStream(msgid uint16, r io.Reader) (int64, error) {
+	w := pc.NewFragmentWriter(msgid)
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+//stream id 从1 开始, 0 留给"没有分片"
+func (pc *ProtoConn) nextStreamId() uint32 {
+	for {
+		if id := atomic.AddUint32(&pc.streamSeq, 1); id != 0 {
+			return id
+		}
+	}
+}
+
+// fragmentReader 接收端重组分片的reader, Run 里把分片放进queue, 用户goroutine 读取;
+// queue 有大小限制, 满了就abort, 不会阻塞Run
+type fragmentReader struct {
+	msgid   uint16
+	size    int64 //only used in Run goroutine
+	max     int64
+	bufMax  int
+	inline  bool   //没有设置streamHandler, 在Run 里重组成一个完整的消息
+	data    []byte //inline 模式下重组的数据
+	aborted bool   //only used in Run goroutine
+	cur     []byte //only used in consumer goroutine
+
+	mu       sync.Mutex
+	queue    [][]byte
+	buffered int
+	done     bool
+	err      error
+	notify   chan struct{}
+	closed   chan struct{}
+	closeOne sync.Once
+}
+
+func newFragmentReader(msgid uint16, max int64, bufMax int) *fragmentReader {
+	return &fragmentReader{msgid: msgid, max: max, bufMax: bufMax,
+		notify: make(chan struct{}, 1), closed: make(chan struct{})}
+}
+
+func (fr *fragmentReader) Read(p []byte) (int, error) {
+	for len(fr.cur) == 0 {
+		fr.mu.Lock()
+		if len(fr.queue) > 0 {
+			fr.cur = fr.queue[0]
+			fr.queue[0] = nil
+			fr.queue = fr.queue[1:]
+			fr.buffered -= len(fr.cur)
+			fr.mu.Unlock()
+			break
+		}
+		done, err := fr.done, fr.err
+		fr.mu.Unlock()
+		if done {
+			return 0, err
+		}
+		select {
+		case <-fr.notify:
+		case <-fr.closed:
+			return 0, io.ErrClosedPipe
+		}
+	}
+	n := copy(p, fr.cur)
+	fr.cur = fr.cur[n:]
+	return n, nil
+}
+
+//Close by consumer, the left fragments will be discarded
+func (fr *fragmentReader) Close() error {
+	fr.closeOne.Do(func() { close(fr.closed) })
+	return nil
+}
+
+func (fr *fragmentReader) wakeup() {
+	select {
+	case fr.notify <- struct{}{}:
+	default:
+	}
+}
+
+//push 只在Run goroutine 里调用, 不会阻塞
+func (fr *fragmentReader) push(d []byte, last bool) {
+	if fr.aborted {
+		return
+	}
+	fr.size += int64(len(d))
+	if fr.size > fr.max {
+		fr.abort(fmt.Errorf("%w, msgid:%d, max:%d", ErrFragmentedMsgTooBig, fr.msgid, fr.max))
+		return
+	}
+	select {
+	case <-fr.closed:
+		//用户不读了, 丢掉
+	default:
+		if len(d) == 0 {
+			break
+		}
+		fr.mu.Lock()
+		if fr.buffered+len(d) > fr.bufMax {
+			fr.mu.Unlock()
+			fr.abort(fmt.Errorf("%w, msgid:%d, buffered:%d", ErrFragmentBufferFull, fr.msgid, fr.buffered))
+			return
+		}
+		fr.queue = append(fr.queue, d)
+		fr.buffered += len(d)
+		fr.mu.Unlock()
+		fr.wakeup()
+	}
+	if last {
+		fr.abort(io.EOF)
+	}
+}
+
+//abort 之后用户读完queue 里的数据, 再读到err
+func (fr *fragmentReader) abort(err error) {
+	if fr.aborted {
+		return
+	}
+	fr.aborted = true
+	fr.mu.Lock()
+	fr.done = true
+	fr.err = err
+	fr.mu.Unlock()
+	fr.wakeup()
+}
+
+func (p *ProtoPkg) streamId() (uint32, bool) {
+	opt, ok := p.option(StreamOpt)
+	if !ok || len(opt.V) != streamOptLen {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(opt.V), true
+}
+
+//maxFragmentedSize 没有配置WithMaxFragmentedMsgSize 时, inline 模式不能超过一个pkg 的限制
+func (pc *ProtoConn) maxFragmentedSize(inline bool) int64 {
+	if pc.maxFragmentedMsgSize > 0 {
+		return pc.maxFragmentedMsgSize
+	}
+	if inline && pc.limits.MaxPayload > 0 {
+		return int64(pc.limits.MaxPayload)
+	}
+	return DefaultMaxFragmentedMsgSize
+}
+
+//handleFragment 只在Run goroutine 里调用, 返回不为nil 的pkg 表示inline 模式下消息已经重组完成;
+//返回error 表示对端同时打开的stream 太多, 要关闭连接
+func (pc *ProtoConn) handleFragment(pkg *ProtoPkg) (*ProtoPkg, error) {
+	msgid, _ := pkg.MsgId()
+	streamid, ok := pkg.streamId()
+	if !ok {
+		pc.logger.Errorf("msgid:%d, fragment without stream id, drop it", msgid)
+		pkg.Release()
+		return nil, nil
+	}
+	last := pkg.GetCmd() != UnFin
+	if pc.fragments == nil {
+		pc.fragments = make(map[uint32]*fragmentReader)
+	}
+	fr := pc.fragments[streamid]
+	if fr == nil {
+		if last {
+			//第一个分片一定带UnFin, 说明前面的分片丢了, 或者这个stream 已经被丢弃
+			pc.logger.Errorf("msgid:%d, stream:%d, unknown stream, drop it", msgid, streamid)
+			pkg.Release()
+			return nil, nil
+		}
+		if n := atomic.LoadInt32(&pc.activeStreams); pc.maxStreams > 0 && int(n) >= pc.maxStreams {
+			pkg.Release()
+			return nil, fmt.Errorf("%w, msgid:%d, active:%d, max:%d", ErrTooManyStreams, msgid, n, pc.maxStreams)
+		}
+		bufMax := pc.fragmentBufferSize
+		if bufMax <= 0 {
+			bufMax = DefaultFragmentBufferSize
+		}
+		fr = newFragmentReader(msgid, pc.maxFragmentedSize(pc.streamHandler == nil), bufMax)
+		pc.fragments[streamid] = fr
+		atomic.AddInt32(&pc.activeStreams, 1)
+		if pc.streamHandler != nil {
+			go func() {
+				defer atomic.AddInt32(&pc.activeStreams, -1)
+				defer fr.Close()
+				if err := pc.streamHandler(pc, msgid, fr); err != nil {
+					pc.logger.Errorf("msgid:%d streamHandler err:%v", msgid, err)
+				}
+			}()
+		} else {
+			fr.inline = true
+		}
+	}
+	if last {
+		delete(pc.fragments, streamid)
+		if fr.inline {
+			atomic.AddInt32(&pc.activeStreams, -1)
+		}
+	}
+
+	if !fr.inline {
+		fr.push(pkg.Payload, last)
+		return nil, nil
+	}
+
+	//没有设置streamHandler, 把分片合并到最后一个pkg, 最后一个分片到达后交给msgHandler
+	//分片的数据已经复制到fr.data, 中间的分片可以直接Release
+	if fr.aborted {
+		pkg.Release()
+		return nil, nil
+	}
+	fr.size += int64(len(pkg.Payload))
+	if fr.size > fr.max {
+		pc.logger.Errorf("msgid:%d, fragmented msg size:%d over max:%d, discard", msgid, fr.size, fr.max)
+		fr.aborted = true
+		fr.data = nil
+		pkg.Release()
+		return nil, nil
+	}
+	fr.data = append(fr.data, pkg.Payload...)
+	if !last {
+		pkg.Release()
+		return nil, nil
+	}
+	pkg.SetCmd(0)
+	pkg.Payload = fr.data
+	pkg.Plen = uint32(len(fr.data))
+	return pkg, nil
+}
+
+//Run 退出时, 没有完成的分片消息, 让用户读到io.ErrUnexpectedEOF
+func (pc *ProtoConn) abortFragments() {
+	for id, fr := range pc.fragments {
+		if !fr.inline {
+			fr.abort(io.ErrUnexpectedEOF)
+		} else {
+			atomic.AddInt32(&pc.activeStreams, -1)
+		}
+		delete(pc.fragments, id)
+	}
+}
@@ -0,0 +1,316 @@
+package proto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFragmentStream(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	type result struct {
+		msgid uint16
+		data  []byte
+		err   error
+	}
+	resCh := make(chan result, 1)
+	server := NewProtoConn(c1, true, nil, WithStreamHandler(func(pc *ProtoConn, msgid uint16, r io.Reader) error {
+		d, err := io.ReadAll(r)
+		resCh <- result{msgid, d, err}
+		return err
+	}))
+	client := NewProtoConn(c2, false, nil, WithCapabilities(CapFragment), WithFragmentSize(1024))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx)
+	//握手后才知道对端支持fragment
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("client Init:%v", err)
+	}
+	go client.Run(ctx)
+
+	data := make([]byte, 100*1024+7)
+	rand.Read(data)
+	n, err := client.WriteStream(11, bytes.NewReader(data))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("WriteStream n:%d, err:%v", n, err)
+	}
+
+	select {
+	case res := <-resCh:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if res.msgid != 11 || !bytes.Equal(res.data, data) {
+			t.Fatalf("msgid:%d, len(data):%d, expect len:%d", res.msgid, len(res.data), len(data))
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("timeout")
+	}
+}
+
+func TestFragmentTooBig(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	errCh := make(chan error, 1)
+	server := NewProtoConn(c1, true, nil, WithMaxFragmentedMsgSize(4096),
+		WithStreamHandler(func(pc *ProtoConn, msgid uint16, r io.Reader) error {
+			_, err := io.ReadAll(r)
+			errCh <- err
+			return err
+		}))
+	client := NewProtoConn(c2, false, nil, WithCapabilities(CapFragment), WithFragmentSize(1024))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx)
+	//握手后才知道对端支持fragment
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("client Init:%v", err)
+	}
+	go client.Run(ctx)
+
+	_, err := client.WriteStream(11, bytes.NewReader(make([]byte, 8192)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrFragmentedMsgTooBig) {
+			t.Fatalf("expect ErrFragmentedMsgTooBig, but err:%v", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("timeout")
+	}
+}
+
+func TestFragmentInline(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	pkgCh := make(chan Pkger, 1)
+	server := NewProtoConn(c1, true, nil)
+	server.SetMsgHandlerv2(func(pc *ProtoConn, pkg Pkger) error {
+		pkgCh <- pkg
+		return nil
+	})
+	client := NewProtoConn(c2, false, nil, WithCapabilities(CapFragment), WithFragmentSize(100))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx)
+	//握手后才知道对端支持fragment
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("client Init:%v", err)
+	}
+	go client.Run(ctx)
+
+	data := bytes.Repeat([]byte("0123456789"), 55)
+	w := client.NewFragmentWriter(12)
+	w.Write(data[:123])
+	w.Write(data[123:])
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pkg := <-pkgCh:
+		msgid, _ := pkg.MsgId()
+		if msgid != 12 || !bytes.Equal(pkg.Paylaod(), data) {
+			t.Fatalf("msgid:%d, payload len:%d, expect len:%d", msgid, len(pkg.Paylaod()), len(data))
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("timeout")
+	}
+}
+
+func TestFragmentStreamsSameMsgId(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	pkgCh := make(chan []byte, 3)
+	server := NewProtoConn(c1, true, nil)
+	server.SetMsgHandlerv2(func(pc *ProtoConn, pkg Pkger) error {
+		pkgCh <- append([]byte(nil), pkg.Paylaod()...)
+		return nil
+	})
+	client := NewProtoConn(c2, false, nil, WithCapabilities(CapFragment), WithFragmentSize(10))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx)
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("client Init:%v", err)
+	}
+	go client.Run(ctx)
+
+	//同一个msgid 的两个分片消息和一个普通消息交错发送, 接收端按stream 分开重组
+	a := bytes.Repeat([]byte("a"), 25)
+	b := bytes.Repeat([]byte("b"), 25)
+	wa := client.NewFragmentWriter(12)
+	wb := client.NewFragmentWriter(12)
+	wa.Write(a[:15])
+	wb.Write(b[:15])
+	if _, err := client.WriteWithId(12, []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	wa.Write(a[15:])
+	wb.Write(b[15:])
+	if err := wb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wa.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range [][]byte{[]byte("plain"), b, a} {
+		select {
+		case d := <-pkgCh:
+			if !bytes.Equal(d, expect) {
+				t.Fatalf("got:%q, expect:%q", d, expect)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestFragmentBufferFull(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	errCh := make(chan error, 1)
+	msgCh := make(chan []byte, 1)
+	block := make(chan struct{})
+	server := NewProtoConn(c1, true, func(pc *ProtoConn, d []byte, t byte) error {
+		msgCh <- d
+		return nil
+	}, WithFragmentBufferSize(4096), WithStreamHandler(func(pc *ProtoConn, msgid uint16, r io.Reader) error {
+		<-block //streamHandler 读得慢, Run 不能被阻塞
+		_, err := io.ReadAll(r)
+		errCh <- err
+		return err
+	}))
+	client := NewProtoConn(c2, false, nil, WithCapabilities(CapFragment), WithFragmentSize(1024))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx)
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("client Init:%v", err)
+	}
+	go client.Run(ctx)
+
+	if _, err := client.WriteStream(11, bytes.NewReader(make([]byte, 8192))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteWithId(12, []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-msgCh:
+		if string(d) != "after" {
+			t.Fatalf("unexpect msg:%q", d)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("Run is blocked by slow streamHandler")
+	}
+	close(block)
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrFragmentBufferFull) {
+			t.Fatalf("expect ErrFragmentBufferFull, but err:%v", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("timeout")
+	}
+}
+
+func TestFragmentMaxStreams(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	block := make(chan struct{})
+	defer close(block)
+	server := NewProtoConn(c1, true, nil, WithMaxStreams(2), WithStreamHandler(func(pc *ProtoConn, msgid uint16, r io.Reader) error {
+		<-block
+		return nil
+	}))
+	client := NewProtoConn(c2, false, nil, WithCapabilities(CapFragment), WithFragmentSize(10))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srvErr := make(chan error, 1)
+	go func() { srvErr <- server.Run(ctx) }()
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("client Init:%v", err)
+	}
+	cliErr := make(chan error, 1)
+	go func() { cliErr <- client.Run(ctx) }()
+
+	//每个stream 都发了UnFin 分片但没有结束, 第三个stream 超过限制
+	for i := 0; i < 3; i++ {
+		client.NewFragmentWriter(11).Write(make([]byte, 20))
+	}
+	select {
+	case err := <-srvErr:
+		if !errors.Is(err, ErrTooManyStreams) {
+			t.Fatalf("server err:%v", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("server should quit")
+	}
+	if err := <-cliErr; !IsCloseError(err, CloseProtocolError) {
+		t.Fatalf("client should receive CloseProtocolError, err:%v", err)
+	}
+}
+
+//没有streamHandler 时重组的消息默认不能超过MaxPayload
+func TestFragmentInlineMaxPayload(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	msgCh := make(chan []byte, 2)
+	server := NewProtoConn(c1, true, func(pc *ProtoConn, d []byte, t byte) error {
+		msgCh <- append([]byte(nil), d...)
+		return nil
+	}, WithMaxPayload(1024))
+	client := NewProtoConn(c2, false, nil, WithCapabilities(CapFragment), WithFragmentSize(100))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx)
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("client Init:%v", err)
+	}
+	go client.Run(ctx)
+
+	if _, err := client.WriteStream(11, bytes.NewReader(make([]byte, 2048))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteWithId(12, []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-msgCh:
+		if string(d) != "after" {
+			t.Fatalf("fragmented msg over MaxPayload should be discarded, got len:%d", len(d))
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("timeout")
+	}
+}
@@ -0,0 +1,96 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+//Limits Decode 时对对端数据的限制, 防止一个8字节的header 就让本端分配4GB 内存
+type Limits struct {
+	MaxPayload int //Plen
+	MaxHeader  int //Hlen, 包括ProtoHeaderSize 和所有options
+	MaxOptions int //options 个数
+}
+
+//DefaultLimits 用于ProtoPkg.Decode 和没有配置limit 的ProtoConn
+var DefaultLimits = Limits{MaxPayload: 16 * 1024 * 1024, MaxHeader: 4096, MaxOptions: 16}
+
+//option 的L 最多15bit, 见ProtoHeaderOption.Len
+const MaxOptionLen = 1<<15 - 1
+
+var (
+	ErrPayloadTooBig  = errors.New("payload too big")
+	ErrHeaderTooBig   = errors.New("header too big")
+	ErrTooManyOptions = errors.New("too many options")
+	ErrOptionTooBig   = fmt.Errorf("option value too big, max:%d", MaxOptionLen)
+	ErrInvalidHeader  = errors.New("invalid header")
+)
+
+//WithMaxPayload 对端发来的payload 超过n 就回应CloseMessageTooBig 并关闭连接
+func WithMaxPayload(n int) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.limits.MaxPayload = n
+	}
+}
+
+//WithMaxHeader header(包括options) 超过n 就回应CloseMessageTooBig 并关闭连接
+func WithMaxHeader(n int) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.limits.MaxHeader = n
+	}
+}
+
+//WithMaxOptions options 个数超过n 就回应CloseProtocolError 并关闭连接
+func WithMaxOptions(n int) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.limits.MaxOptions = n
+	}
+}
+
+func (l *Limits) check(ph *ProtoHeader) error {
+	if ph.Hlen < ProtoHeaderSize {
+		return fmt.Errorf("%w, Hlen:%d", ErrInvalidHeader, ph.Hlen)
+	}
+	if l.MaxHeader > 0 && int(ph.Hlen) > l.MaxHeader {
+		return fmt.Errorf("%w, Hlen:%d, max:%d", ErrHeaderTooBig, ph.Hlen, l.MaxHeader)
+	}
+	if l.MaxPayload > 0 && int64(ph.Plen) > int64(l.MaxPayload) {
+		return fmt.Errorf("%w, Plen:%d, max:%d", ErrPayloadTooBig, ph.Plen, l.MaxPayload)
+	}
+	return nil
+}
+
+func (pc *ProtoConn) decode(pkg *ProtoPkg) error {
+	var err error
+	if pc.isPacketConn {
+		err = pc.decodeDatagram(pkg)
+	} else {
+		err = pkg.decodeWithLimits(pc.r, &pc.limits, pc.pkgRelease, true)
+	}
+	if err == nil {
+		pc.countIn(pkg)
+	} else if protocolErrCode(err) != 0 {
+		atomic.AddUint64(&pc.stats.decodeErrors, 1)
+	}
+	return err
+}
+
+//protocolErrCode 本端不能继续处理对端数据的错误, 返回要发给对端的close code, 0 表示不是这类错误
+func protocolErrCode(err error) int {
+	switch {
+	case errors.Is(err, ErrPayloadTooBig), errors.Is(err, ErrHeaderTooBig), errors.Is(err, ErrInflateTooBig):
+		return CloseMessageTooBig
+	case errors.Is(err, ErrTooManyOptions), errors.Is(err, ErrOptionTruncated), errors.Is(err, ErrInvalidOptionLen),
+		errors.Is(err, ErrInvalidHeader), errors.Is(err, ErrUnsupportedVersion), errors.Is(err, ErrTooManyStreams):
+		return CloseProtocolError
+	}
+	return 0
+}
+
+//closeOnProtocolErr 数据流已经不能继续解析, 告诉对端为什么关闭
+func (pc *ProtoConn) closeOnProtocolErr(err error) {
+	if code := protocolErrCode(err); code != 0 {
+		pc.WriteCloseMsg(code, err.Error())
+	}
+}
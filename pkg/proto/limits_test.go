@@ -0,0 +1,148 @@
+package proto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOptionLenRoundTrip(t *testing.T) {
+	for _, l := range []int{0, 126, 127, 128, 200, 255, 300, 1000, MaxOptionLen} {
+		v := bytes.Repeat([]byte{'v'}, l)
+		pkg, err := EncodePkg([]byte("payload"), Msg, 0, ProtoHeaderOption{T: 100, L: uint16(l), V: v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range [][]byte{pkg.Bytes(), pkg.AppendTo(nil)} {
+			p := NewProtoPkg()
+			limits := Limits{MaxHeader: 1 << 16}
+			if err := p.DecodeWithLimits(bytes.NewReader(b), &limits); err != nil {
+				t.Fatalf("len:%d, decode err:%v", l, err)
+			}
+			if opt, ok := p.option(100); !ok || !bytes.Equal(opt.V, v) || string(p.Payload) != "payload" {
+				t.Fatalf("len:%d, got option len:%d, payload:%s", l, len(opt.V), p.Payload)
+			}
+			p.Release()
+		}
+	}
+	if _, err := EncodePkg(nil, Msg, 0, ProtoHeaderOption{T: 100, V: make([]byte, MaxOptionLen+1)}); !errors.Is(err, ErrOptionTooBig) {
+		t.Fatalf("expect ErrOptionTooBig, err:%v", err)
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	hdr := func(ph ProtoHeader) []byte {
+		b := make([]byte, ProtoHeaderSize)
+		ph.EncodeWithBuf(b)
+		return b
+	}
+	cases := []struct {
+		b   []byte
+		err error
+	}{
+		{hdr(ProtoHeader{Ver: Ver1, Hlen: ProtoHeaderSize, Plen: 1<<32 - 1}), ErrPayloadTooBig},
+		{hdr(ProtoHeader{Ver: Ver1, Hlen: 1<<16 - 1}), ErrHeaderTooBig},
+		{hdr(ProtoHeader{Ver: Ver1, Hlen: 4}), ErrInvalidHeader},
+		{append(hdr(ProtoHeader{Ver: Ver1, Hlen: ProtoHeaderSize + 3}), MsgIdOpt, 2, 0), ErrOptionTruncated},
+		{append(hdr(ProtoHeader{Ver: Ver1, Hlen: ProtoHeaderSize + 6}), 100, 0, 100, 0, 100, 0), ErrTooManyOptions},
+		{append(hdr(ProtoHeader{Ver: Ver1, Hlen: ProtoHeaderSize + 3}), 100, 0x80, 0), ErrInvalidOptionLen},
+	}
+	limits := Limits{MaxPayload: 1024, MaxHeader: 64, MaxOptions: 2}
+	for i, c := range cases {
+		err := NewProtoPkg().DecodeWithLimits(bytes.NewReader(c.b), &limits)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("case %d, expect %v, err:%v", i, c.err, err)
+		}
+	}
+}
+
+func TestRunCloseOnLimit(t *testing.T) {
+	//option 的L 用2byte 编码了0
+	ph := ProtoHeader{Ver: Ver1, Hlen: ProtoHeaderSize + 3}
+	badOptLen := make([]byte, ProtoHeaderSize)
+	ph.EncodeWithBuf(badOptLen)
+	badOptLen = append(badOptLen, 100, 0x80, 0)
+
+	for _, c := range []struct {
+		name  string
+		write func(client *ProtoConn, conn net.Conn)
+		err   error
+		code  int
+	}{
+		{"payload too big", func(client *ProtoConn, _ net.Conn) { client.Write(make([]byte, 2048)) }, ErrPayloadTooBig, CloseMessageTooBig},
+		{"invalid option len", func(_ *ProtoConn, conn net.Conn) { conn.Write(badOptLen) }, ErrInvalidOptionLen, CloseProtocolError},
+	} {
+		c1, c2 := net.Pipe()
+		server := NewProtoConn(c1, true, func(*ProtoConn, []byte, byte) error { return nil }, WithMaxPayload(1024))
+		client := NewProtoConn(c2, false, nil)
+		srvErr := make(chan error, 1)
+		go func() { srvErr <- server.Run(context.Background()) }()
+		cliErr := make(chan error, 1)
+		go func() { cliErr <- client.Run(context.Background()) }()
+
+		c.write(client, c2)
+		select {
+		case err := <-srvErr:
+			if !errors.Is(err, c.err) {
+				t.Fatalf("%s: server err:%v", c.name, err)
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatalf("%s: server should quit", c.name)
+		}
+		if err := <-cliErr; !IsCloseError(err, c.code) {
+			t.Fatalf("%s: client should receive close code %d, err:%v", c.name, c.code, err)
+		}
+		if n := server.Stats().DecodeErrors; n != 1 {
+			t.Fatalf("%s: DecodeErrors:%d", c.name, n)
+		}
+		client.Close()
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []func() (*ProtoPkg, error){
+		func() (*ProtoPkg, error) { return EncodePkg([]byte("hello"), Msg, JSON) },
+		func() (*ProtoPkg, error) { return NewMsgIdOptPkg([]byte("hello"), 11) },
+		func() (*ProtoPkg, error) { return NewCallOptPkg([]byte("hello"), 11, CallReq, 1) },
+		func() (*ProtoPkg, error) { return EncodeCmdPkg(CloseCmd, []byte(`{"Code":1000}`)) },
+		func() (*ProtoPkg, error) {
+			return NewPingPkg(nil, ProtoHeaderOption{T: HelloOpt, L: 200, V: make([]byte, 200)})
+		},
+	} {
+		pkg, err := seed()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(pkg.Bytes())
+	}
+	//option 的L 用2byte 编码了0, 重新编码时变成1byte, 以前会导致Hlen 不对
+	f.Add([]byte("10\x00\x13\x00\x00\x00\x050\x02000\x80\x000\x000\x0000000"))
+	limits := Limits{MaxPayload: 4096, MaxHeader: 1024, MaxOptions: 8}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p := NewProtoPkg()
+		defer p.Release()
+		if err := p.DecodeWithLimits(bytes.NewReader(b), &limits); err != nil {
+			return
+		}
+		if len(p.Payload) > limits.MaxPayload || len(p.options) > limits.MaxOptions || int(p.Hlen) > limits.MaxHeader {
+			t.Fatalf("limits not enforced, Hlen:%d, payload:%d, options:%d", p.Hlen, len(p.Payload), len(p.options))
+		}
+		//重新编码再解码应该得到一样的options 和payload
+		p2 := NewProtoPkg()
+		defer p2.Release()
+		if err := p2.DecodeWithLimits(bytes.NewReader(p.AppendTo(nil)), &Limits{}); err != nil {
+			t.Fatalf("re-decode err:%v", err)
+		}
+		if p2.ProtoHeader.Type != p.ProtoHeader.Type || !bytes.Equal(p2.Payload, p.Payload) || len(p2.options) != len(p.options) {
+			t.Fatalf("re-decode mismatch, %v, %v", p, p2)
+		}
+		for i := range p.options {
+			if p2.options[i].T != p.options[i].T || !bytes.Equal(p2.options[i].V, p.options[i].V) {
+				t.Fatalf("option %d mismatch", i)
+			}
+		}
+	})
+}
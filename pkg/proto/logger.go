@@ -0,0 +1,119 @@
+package proto
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+//Logger 跟redislock 的Logger 一样, 用户可以用自己的日志库实现, 通过WithLogger 设置
+type Logger interface {
+	Debugf(format string, a ...interface{})
+	Infof(format string, a ...interface{})
+	Errorf(format string, a ...interface{})
+	Fatalf(format string, a ...interface{})
+}
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelError
+	LevelFatal
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelError:
+		return "ERROR"
+	case LevelFatal:
+		return "FATAL"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+//NopLogger 什么都不打印, 是ProtoConn, client, server 默认的Logger
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, a ...interface{}) {}
+func (nopLogger) Infof(format string, a ...interface{})  {}
+func (nopLogger) Errorf(format string, a ...interface{}) {}
+func (nopLogger) Fatalf(format string, a ...interface{}) {}
+
+type stdLogger struct {
+	l     *log.Logger
+	level LogLevel
+}
+
+//NewStdLogger 用标准库的log 打印level 及以上的日志, l 为nil 时用log.Default()
+//Fatalf 只打印, 不会退出进程
+func NewStdLogger(l *log.Logger, level LogLevel) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return &stdLogger{l: l, level: level}
+}
+
+func (l *stdLogger) output(level LogLevel, format string, a ...interface{}) {
+	if level < l.level {
+		return
+	}
+	l.l.Output(3, level.String()+" "+fmt.Sprintf(format, a...))
+}
+
+func (l *stdLogger) Debugf(format string, a ...interface{}) { l.output(LevelDebug, format, a...) }
+func (l *stdLogger) Infof(format string, a ...interface{})  { l.output(LevelInfo, format, a...) }
+func (l *stdLogger) Errorf(format string, a ...interface{}) { l.output(LevelError, format, a...) }
+func (l *stdLogger) Fatalf(format string, a ...interface{}) { l.output(LevelFatal, format, a...) }
+
+type fieldLogger struct {
+	l      Logger
+	prefix string //已经转义了%
+}
+
+//WithFields 在每条日志前加上"k=v ", 比如WithFields(l, "session", id, "remote", addr)
+func WithFields(l Logger, kv ...interface{}) Logger {
+	if l == nil || l == NopLogger || len(kv) == 0 {
+		return l
+	}
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(&b, "%v=%v ", kv[i], kv[i+1])
+	}
+	prefix := strings.ReplaceAll(b.String(), "%", "%%")
+	if fl, ok := l.(*fieldLogger); ok {
+		return &fieldLogger{l: fl.l, prefix: fl.prefix + prefix}
+	}
+	return &fieldLogger{l: l, prefix: prefix}
+}
+
+func (l *fieldLogger) Debugf(format string, a ...interface{}) { l.l.Debugf(l.prefix+format, a...) }
+func (l *fieldLogger) Infof(format string, a ...interface{})  { l.l.Infof(l.prefix+format, a...) }
+func (l *fieldLogger) Errorf(format string, a ...interface{}) { l.l.Errorf(l.prefix+format, a...) }
+func (l *fieldLogger) Fatalf(format string, a ...interface{}) { l.l.Fatalf(l.prefix+format, a...) }
+
+//WithLogger 设置ProtoConn 的Logger, 日志会带上remote 地址, 默认是NopLogger
+func WithLogger(l Logger) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.logger = l
+	}
+}
+
+func (pc *ProtoConn) initLogger() {
+	if pc.logger == nil {
+		pc.logger = NopLogger
+	}
+	pc.logger = WithFields(pc.logger, "remote", pc.RemoteAddr())
+}
+
+//Logger 返回ProtoConn 的Logger, session 在此基础上加上session 字段
+func (pc *ProtoConn) Logger() Logger {
+	return pc.logger
+}
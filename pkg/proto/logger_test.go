@@ -0,0 +1,22 @@
+package proto
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := WithFields(NewStdLogger(log.New(&buf, "", 0), LevelInfo), "session", "100%")
+	l = WithFields(l, "remote", "127.0.0.1:80")
+	l.Debugf("debug %d", 1)
+	l.Infof("info %d", 2)
+	if got := strings.TrimSpace(buf.String()); got != "INFO session=100% remote=127.0.0.1:80 info 2" {
+		t.Fatalf("got:%q", got)
+	}
+	if WithFields(NopLogger, "k", "v") != NopLogger {
+		t.Fatal("NopLogger with fields should be NopLogger")
+	}
+}
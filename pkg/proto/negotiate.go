@@ -0,0 +1,216 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+//Capability 握手时交换的能力bitmap, HelloOpt 的V: caps(4byte) + versions(每个1byte)
+type Capability uint32
+
+const (
+	CapCompression Capability = 1 << iota
+	CapFragment
+	CapRPC
+	CapEncryption
+)
+
+var capNames = []string{"compression", "fragment", "rpc", "encryption"}
+
+func (c Capability) Has(f Capability) bool {
+	return c&f == f
+}
+
+func (c Capability) String() string {
+	var ss []string
+	for i, name := range capNames {
+		if c.Has(1 << uint(i)) {
+			ss = append(ss, name)
+		}
+	}
+	return strings.Join(ss, "|")
+}
+
+var (
+	//SupportedVersions 本端能Decode 的版本, 握手时发给对端, 选双方都支持的最高版本
+	SupportedVersions = []byte{Ver1}
+	//DefaultCapabilities 默认宣告的能力, 配置了WithCompression 时会加上CapCompression
+	DefaultCapabilities = CapFragment | CapRPC
+	//legacyCapabilities 对端没有回应HelloOpt(旧版本或者没有握手)时认为对端支持的能力,
+	//旧版本不认识UnFin 和Call/Reply, 所以什么都不支持
+	legacyCapabilities Capability = 0
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported pkg version")
+	ErrPeerNotSupport     = errors.New("peer doesn't support")
+)
+
+//WithCapabilities 指定宣告给对端的能力, 默认是DefaultCapabilities; 能力只在握手时宣告, 没有握手就什么能力都没有.
+//client 没有配置握手时, 设置了WithCapabilities, WithCompression 或resume 才用DefaultPacketHandshakeData 握手,
+//不能对没有配置握手的旧server 使用, 旧server 会把握手的ping 当成auth 请求
+func WithCapabilities(caps Capability) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.localCaps = caps
+		pc.capsSet = true
+	}
+}
+
+//Version return the agreed pkg version
+func (pc *ProtoConn) Version() byte {
+	return byte(atomic.LoadInt32(&pc.version))
+}
+
+//Capabilities return the agreed capabilities, that is supported by both sides
+func (pc *ProtoConn) Capabilities() Capability {
+	return Capability(atomic.LoadUint32(&pc.caps))
+}
+
+func (pc *ProtoConn) initNegotiate() {
+	if !pc.capsSet {
+		pc.localCaps = DefaultCapabilities
+	}
+	if len(pc.compressIds) > 0 {
+		pc.localCaps |= CapCompression
+	}
+	atomic.StoreInt32(&pc.version, Ver1)
+	atomic.StoreUint32(&pc.caps, uint32(pc.localCaps&legacyCapabilities))
+	//只有明确要求时才自动握手, 默认配置的client 和旧版本一样, 没有配置握手就不发HelloOpt
+	if !pc.isServer && (pc.capsSet || len(pc.compressIds) > 0 || pc.resume != nil) && pc.handshakeData == nil && pc.handshaker == nil {
+		pc.handshakeData = func() []byte { return DefaultPacketHandshakeData }
+	}
+}
+
+//checkCap 发送对端没有宣告的功能时返回ErrPeerNotSupport
+func (pc *ProtoConn) checkCap(c Capability) error {
+	if !pc.Capabilities().Has(c) {
+		return fmt.Errorf("%w %s", ErrPeerNotSupport, c)
+	}
+	return nil
+}
+
+func helloOption(caps Capability, versions []byte) ProtoHeaderOption {
+	v := make([]byte, 4+len(versions))
+	binary.BigEndian.PutUint32(v, uint32(caps))
+	copy(v[4:], versions)
+	return ProtoHeaderOption{T: HelloOpt, L: uint16(len(v)), V: v}
+}
+
+func parseHello(v []byte) (Capability, []byte, error) {
+	if len(v) < 4 {
+		return 0, nil, fmt.Errorf("invalid hello option len:%d", len(v))
+	}
+	return Capability(binary.BigEndian.Uint32(v)), v[4:], nil
+}
+
+//handshakeOptions client 握手的ping 里带上支持的版本, 能力和压缩算法
+func (pc *ProtoConn) handshakeOptions() []ProtoHeaderOption {
+	if pc.isServer {
+		return nil
+	}
+	opts := []ProtoHeaderOption{helloOption(pc.localCaps, SupportedVersions)}
+	if len(pc.compressIds) > 0 {
+		opts = append(opts, ProtoHeaderOption{T: CompressOpt, L: uint16(len(pc.compressIds)), V: pc.compressIds})
+	}
+	if pc.resume != nil {
+		opts = append(opts, pc.resumeOption())
+	}
+	return opts
+}
+
+//agreeVersion 选双方都支持的最高版本, 0 表示没有
+func agreeVersion(peer []byte) byte {
+	var ver byte
+	for _, v := range peer {
+		for _, my := range SupportedVersions {
+			if v == my && v > ver {
+				ver = v
+			}
+		}
+	}
+	return ver
+}
+
+//handlePing server 收到带HelloOpt/CompressOpt 的ping(client 握手), 回应的pong 带上协商的结果,
+//其他ping 交给pingHandler
+func (pc *ProtoConn) handlePing(pkg *ProtoPkg) error {
+	hello, hasHello := pkg.option(HelloOpt)
+	copt, hasCompress := pkg.option(CompressOpt)
+	ropt, hasResume := pkg.option(ResumeOpt)
+	hasResume = hasResume && pc.resumeHandler != nil
+	if !pc.isServer || !hasHello && !hasCompress && !hasResume {
+		if pc.pingHandler == nil {
+			return nil
+		}
+		return pc.pingHandler(pkg.Payload)
+	}
+
+	var opts []ProtoHeaderOption
+	var verErr error
+	if hasHello {
+		peerCaps, versions, err := parseHello(hello.V)
+		if err != nil {
+			return err
+		}
+		ver := agreeVersion(versions)
+		if ver == 0 {
+			verErr = fmt.Errorf("%w, peer versions:%v, supported:%v", ErrUnsupportedVersion, versions, SupportedVersions)
+		}
+		caps := pc.localCaps & peerCaps
+		if !hasCompress {
+			caps &^= CapCompression
+		}
+		atomic.StoreInt32(&pc.version, int32(ver))
+		atomic.StoreUint32(&pc.caps, uint32(caps))
+		opts = append(opts, helloOption(caps, []byte{ver}))
+	}
+	if hasCompress {
+		id := pc.agreeCompression(copt.V)
+		atomic.StoreInt32(&pc.compressId, int32(id))
+		if id == CompressNone {
+			pc.clearCap(CapCompression)
+		}
+		opts = append(opts, ProtoHeaderOption{T: CompressOpt, L: 1, V: []byte{id}})
+	}
+	if hasResume {
+		opt, err := pc.handleResume(ropt.V)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, opt)
+	}
+	pong, err := NewPongPkg(pkg.Payload, opts...)
+	if err != nil {
+		return err
+	}
+	if _, err = pc.writePkg(pong); err != nil {
+		return err
+	}
+	return verErr
+}
+
+//setNegotiated client 从握手的pong 里得到协商的结果, 没有HelloOpt 说明对端是旧版本
+func (pc *ProtoConn) setNegotiated(pong *ProtoPkg) error {
+	if hello, ok := pong.option(HelloOpt); ok {
+		caps, versions, err := parseHello(hello.V)
+		if err != nil {
+			return err
+		}
+		if len(versions) != 1 || agreeVersion(versions) == 0 {
+			return fmt.Errorf("%w, peer agreed:%v, supported:%v", ErrUnsupportedVersion, versions, SupportedVersions)
+		}
+		atomic.StoreInt32(&pc.version, int32(versions[0]))
+		atomic.StoreUint32(&pc.caps, uint32(caps&pc.localCaps))
+	}
+	if !pc.setCompression(pong) {
+		pc.clearCap(CapCompression)
+	}
+	return pc.setResumed(pong)
+}
+
+func (pc *ProtoConn) clearCap(c Capability) {
+	atomic.StoreUint32(&pc.caps, uint32(pc.Capabilities()&^c))
+}
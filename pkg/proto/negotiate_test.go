@@ -0,0 +1,117 @@
+package proto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNegotiateCapabilities(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server := NewProtoConn(c1, true, func(*ProtoConn, []byte, byte) error { return nil })
+	client := NewProtoConn(c2, false, nil, WithCapabilities(CapRPC))
+	defer server.Close()
+	defer client.Close()
+	go server.Run(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("client Init:%v", err)
+	}
+	if client.Version() != Ver1 || client.Capabilities() != CapRPC {
+		t.Fatalf("client agreed ver:%d, caps:%s", client.Version(), client.Capabilities())
+	}
+	//server Run 里处理握手, 等它记录下协商结果
+	for i := 0; server.Capabilities() != CapRPC; i++ {
+		if i > 100 {
+			t.Fatalf("server agreed caps:%s", server.Capabilities())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	//client 没有宣告fragment, 需要分片的数据不能发
+	_, err := server.WriteStream(1, bytes.NewReader(make([]byte, DefaultFragmentSize*2)))
+	if !errors.Is(err, ErrPeerNotSupport) {
+		t.Fatalf("expect ErrPeerNotSupport, err:%v", err)
+	}
+	go client.Run(context.Background())
+	if _, err = server.WriteCall(1, CallReq, 1, []byte("req")); err != nil {
+		t.Fatalf("rpc is agreed, err:%v", err)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	if v := agreeVersion([]byte{Ver1, 15}); v != Ver1 {
+		t.Fatalf("agreed:%d", v)
+	}
+	if v := agreeVersion([]byte{15}); v != 0 {
+		t.Fatalf("agreed:%d", v)
+	}
+	ph := ProtoHeader{Ver: 15, Hlen: ProtoHeaderSize}
+	b := make([]byte, ProtoHeaderSize)
+	ph.EncodeWithBuf(b)
+	if err := NewProtoPkg().Decode(bytes.NewReader(b)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expect ErrUnsupportedVersion, err:%v", err)
+	}
+}
+
+func TestLegacyPeerCapabilities(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	//自定义handshaker 不带HelloOpt, 当作旧版本的对端, 不支持fragment 和rpc
+	client := NewProtoConn(c2, false, nil, WithHandShake(func(context.Context, net.Conn) error { return nil }))
+	if err := client.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if caps := client.Capabilities(); caps != 0 {
+		t.Fatalf("expect no capabilities, got:%s", caps)
+	}
+	if _, err := client.WriteStream(1, bytes.NewReader(make([]byte, DefaultFragmentSize*2))); !errors.Is(err, ErrPeerNotSupport) {
+		t.Fatalf("expect ErrPeerNotSupport, err:%v", err)
+	}
+	if _, err := client.WriteCall(1, CallReq, 1, []byte("req")); !errors.Is(err, ErrPeerNotSupport) {
+		t.Fatalf("expect ErrPeerNotSupport, err:%v", err)
+	}
+}
+
+//旧版本的server 配置了auth 但没有配置握手, 第一个包必须是auth 请求, 默认配置的client 不能先发握手的ping
+func TestLegacyAuthServer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewProtoConn(c2, false, nil, WithAuthReqData(func() []byte { return []byte("token") }))
+	defer c1.Close()
+	defer client.Close()
+
+	//和旧版本的serverAuth 一样处理
+	errc := make(chan error, 1)
+	go func() {
+		req := NewProtoPkg()
+		if err := req.Decode(c1); err != nil {
+			errc <- err
+			return
+		}
+		if req.PkgType() != Auth || len(req.options) == 0 {
+			errc <- errors.New("isn't auth packet")
+			return
+		}
+		resp, _ := NewAuthRespPkg([]byte("ok"), string(req.options[0].V) == "token")
+		_, err := c1.Write(resp.Bytes())
+		errc <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("client Init:%v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("legacy server:%v", err)
+	}
+	if caps := client.Capabilities(); caps != 0 {
+		t.Fatalf("expect no capabilities without handshake, got:%s", caps)
+	}
+}
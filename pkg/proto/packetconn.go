@@ -0,0 +1,192 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//udp 这种报文协议: 一个ProtoPkg 就是一个udp 报文, 不会合并也不会拆开; 每次Read 读一个报文, 不经过bufio,
+//解析失败的报文直接丢掉, 不影响后面的报文; 报文会丢失和乱序, 所以不支持分片;
+//握手, auth 这些控制报文丢了就会导致Init 失败, 所以由client 负责超时重传请求, server 收到重复的请求就再回应一次;
+//close 报文没有回应, 对端收到后回一个close 报文当作ack, 发送方收到ack 或者超过重传次数为止
+
+var (
+	//控制报文第一次重传的超时时间, 之后每次翻倍, 最大DefaultCtrlMaxRTO
+	DefaultCtrlRTO     = time.Millisecond * 200
+	DefaultCtrlMaxRTO  = time.Second * 2
+	DefaultCtrlRetries = 8
+	//默认不超过以太网mtu: 1500 - ip header(20) - udp header(8)
+	DefaultMaxDatagramSize = 1472
+)
+
+//报文协议没有建立连接的过程, client 和server 默认用这个数据做ping pong 握手
+var DefaultPacketHandshakeData = []byte("proto-packet-handshake")
+
+//一个报文最大64KB
+const maxDatagramReadSize = 64 * 1024
+
+var (
+	ErrDatagramTooBig       = errors.New("pkg size over max datagram size")
+	ErrInvalidDatagram      = errors.New("invalid datagram")
+	ErrFragmentOnPacketConn = errors.New("fragmentation is not supported on packet conn")
+)
+
+//WithPacketConn 指定conn 是否是报文协议, 默认根据conn.LocalAddr().Network() 判断, conn 被包装过时才需要设置
+func WithPacketConn(b bool) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.isPacketConn = b
+	}
+}
+
+//WithMaxDatagramSize 只对报文协议有效, 超过的pkg 发送时返回ErrDatagramTooBig
+func WithMaxDatagramSize(n int) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		if n > ProtoHeaderSize {
+			pc.maxDatagramSize = n
+		}
+	}
+}
+
+//WithPacketHandshake 用DefaultPacketHandshakeData 握手, 放在其他option 前面, 这样可以被WithHandShakeData 覆盖
+func WithPacketHandshake() ProtoConnOpt {
+	return WithHandShakeData(func() []byte { return DefaultPacketHandshakeData })
+}
+
+func isPacketNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram", "unixpacket":
+		return true
+	}
+	return false
+}
+
+//initPacketConn 在option 之后调用, 流协议用bufio 读, 报文协议每次读一个报文
+func (pc *ProtoConn) initPacketConn() {
+	if !pc.isPacketConn {
+		pc.r = bufio.NewReaderSize(pc.conn, pc.ReadBufferSize)
+		return
+	}
+	if pc.maxDatagramSize == 0 {
+		pc.maxDatagramSize = DefaultMaxDatagramSize
+	}
+	pc.dgram = make([]byte, maxDatagramReadSize)
+}
+
+//decodeDatagram 读一个报文, 解析出一个pkg; 解析失败(或者有多余的数据) 就丢掉这个报文, 读下一个
+func (pc *ProtoConn) decodeDatagram(pkg *ProtoPkg) error {
+	for {
+		n, err := pc.conn.Read(pc.dgram)
+		if err != nil {
+			return err
+		}
+		r := bytes.NewReader(pc.dgram[:n])
+		err = pkg.decodeWithLimits(r, &pc.limits, pc.pkgRelease, true)
+		if err == nil && r.Len() > 0 {
+			err = fmt.Errorf("%w, %d bytes left after pkg", ErrInvalidDatagram, r.Len())
+		}
+		var ce *CloseError
+		if err == nil || errors.As(err, &ce) {
+			return err
+		}
+		atomic.AddUint64(&pc.stats.decodeErrors, 1)
+		pc.logger.Debugf("drop datagram len:%d, decode err:%v", n, err)
+		pkg.reset()
+	}
+}
+
+//writeCtrlPkg 发送控制报文, 报文协议会一直重传, 直到调用stop 或者连接关闭或者超过DefaultCtrlRetries 次
+func (pc *ProtoConn) writeCtrlPkg(pkg *ProtoPkg) (stop func(), err error) {
+	if !pc.isPacketConn {
+		_, err = pc.writePkg(pkg)
+		return func() {}, err
+	}
+	b := pkg.AppendTo(nil)
+	pc.countOut(pkg)
+	pkg.Release()
+	if _, err = pc.write(b); err != nil {
+		return func() {}, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		rto := DefaultCtrlRTO
+		t := time.NewTimer(rto)
+		defer t.Stop()
+		for i := 0; i < DefaultCtrlRetries; i++ {
+			select {
+			case <-done:
+				return
+			case <-pc.closed:
+				return
+			case <-t.C:
+			}
+			if _, err := pc.write(b); err != nil {
+				return
+			}
+			if rto *= 2; rto > DefaultCtrlMaxRTO {
+				rto = DefaultCtrlMaxRTO
+			}
+			t.Reset(rto)
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }, nil
+}
+
+//readInitPkg 读Init 阶段的报文, 报文协议下会忽略重传导致的重复报文, 对端重传的握手ping 再回应一次
+func (pc *ProtoConn) readInitPkg(pkgType byte) (*ProtoPkg, error) {
+	for {
+		pkg := NewProtoPkg()
+		err := pc.decode(pkg)
+		if err != nil {
+			pkg.Release()
+			return nil, err
+		}
+		if pkg.PkgType() == pkgType {
+			return pkg, nil
+		}
+		//server 没有设置握手时, client 协商压缩的ping 会在这里收到
+		if pkg.PkgType() == Ping && pc.isServer {
+			err = pc.handlePing(pkg)
+		} else if !pc.isPacketConn {
+			return pkg, nil
+		}
+		pkg.Release()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+//setCtrlResp server 记住Init 阶段最后的回应, Run 里收到对端重传的请求时再发一次
+func (pc *ProtoConn) setCtrlResp(pkg *ProtoPkg) {
+	if pc.isPacketConn {
+		pc.ctrlResp = pkg.AppendTo(nil)
+	}
+}
+
+//ackClose 报文协议下收到对端的close 报文, 回一个close 报文当作ack, 让对端停止重传
+func (pc *ProtoConn) ackClose(err error) {
+	if !pc.isPacketConn || atomic.LoadInt32(&pc.closeSent) == 1 {
+		return
+	}
+	var ce *CloseError
+	if !errors.As(err, &ce) {
+		return
+	}
+	data, e := json.Marshal(CloseCmdPayLoad{Code: ce.Code, Msg: ce.Msg})
+	if e != nil {
+		return
+	}
+	pkg, e := EncodeCmdPkg(CloseCmd, data)
+	if e != nil {
+		return
+	}
+	pc.writePkg(pkg)
+}
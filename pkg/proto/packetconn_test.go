@@ -0,0 +1,133 @@
+package proto
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//lossyConn 丢掉前drop 个报文, 模拟udp 丢包
+type lossyConn struct {
+	net.Conn
+	drop int32
+}
+
+func (c *lossyConn) Write(b []byte) (int, error) {
+	if atomic.AddInt32(&c.drop, -1) >= 0 {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func TestPacketConnInitRetransmit(t *testing.T) {
+	c1, c2 := net.Pipe()
+	//client 的ping 和server 的pong 都丢一次, server 的auth 回应也丢一次
+	sc := &lossyConn{Conn: c1, drop: 1}
+	cc := &lossyConn{Conn: c2, drop: 1}
+	hs := WithHandShakeData(func() []byte { return []byte("hs") })
+	server := NewProtoConn(sc, true, nil, WithPacketConn(true), hs,
+		WithAuthHandler(func(d []byte) ([]byte, bool) {
+			atomic.StoreInt32(&sc.drop, 1)
+			return []byte("ok"), string(d) == "token"
+		}))
+	client := NewProtoConn(cc, false, nil, WithPacketConn(true), hs,
+		WithAuthReqData(func() []byte { return []byte("token") }))
+	defer server.Close()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	srvErr := make(chan error, 1)
+	go func() {
+		err := server.Init(ctx)
+		srvErr <- err
+		if err == nil {
+			server.Run(ctx)
+		}
+	}()
+	if err := client.Init(ctx); err != nil {
+		t.Fatalf("client Init:%v", err)
+	}
+	if err := <-srvErr; err != nil {
+		t.Fatalf("server Init:%v", err)
+	}
+	if !server.authOk {
+		t.Fatal("server not auth ok")
+	}
+}
+
+func TestPacketConnCloseAck(t *testing.T) {
+	c1, c2 := net.Pipe()
+	sc := &lossyConn{Conn: c1, drop: 1} //第一个close 报文丢了
+	server := NewProtoConn(sc, true, nil, WithPacketConn(true))
+	client := NewProtoConn(c2, false, nil, WithPacketConn(true))
+	defer server.Close()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	srvErr := make(chan error, 1)
+	cliErr := make(chan error, 1)
+	go func() { srvErr <- server.Run(ctx) }()
+	go func() { cliErr <- client.Run(ctx) }()
+
+	if _, err := server.WriteCloseMsg(CloseServiceRestart, "restart"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-cliErr; !IsServiceRestart(err) {
+		t.Fatalf("client Run err:%v", err)
+	}
+	//server 收到client 的ack 后Run 退出
+	if err := <-srvErr; !IsServiceRestart(err) {
+		t.Fatalf("server Run err:%v", err)
+	}
+}
+
+func TestPacketConnDatagramTooBig(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	pc := NewProtoConn(c1, false, nil, WithPacketConn(true), WithMaxDatagramSize(512))
+	if _, err := pc.WriteWithId(11, make([]byte, 512)); err != ErrDatagramTooBig {
+		t.Fatalf("err:%v", err)
+	}
+	pc.authOk = true
+	if _, err := pc.NewFragmentWriter(11).Write(make([]byte, pc.fragmentSize+1)); err != ErrFragmentOnPacketConn {
+		t.Fatalf("err:%v", err)
+	}
+}
+
+//一个报文解析失败就丢掉, 不影响后面的报文
+func TestPacketConnDropMalformed(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	msgCh := make(chan string, 1)
+	server := NewProtoConn(c1, true, func(pc *ProtoConn, d []byte, t byte) error {
+		msgCh <- string(d)
+		return nil
+	}, WithPacketConn(true))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx)
+
+	good, _ := NewMsgIdOptPkg([]byte("hello"), 11)
+	b := good.Bytes()
+	for _, bad := range [][]byte{b[:len(b)-2], append(append([]byte(nil), b...), 'x'), []byte("garbage")} {
+		c2.Write(bad)
+	}
+	c2.Write(b)
+	select {
+	case msg := <-msgCh:
+		if msg != "hello" {
+			t.Fatalf("msg:%s", msg)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("timeout")
+	}
+	if n := server.Stats().DecodeErrors; n != 3 {
+		t.Fatalf("decode errors:%d", n)
+	}
+}
@@ -0,0 +1,137 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	bufferpool "github.com/jursonmo/practise/pkg/bufferPool"
+	pool "github.com/jursonmo/practise/pkg/bufferPool/multipool"
+)
+
+var pkgPool = sync.Pool{New: func() interface{} { return new(ProtoPkg) }}
+
+//Decode 和发送时用到的buffer, 64B, 128B ... 64KB, 超过64KB 的不会放回pool
+var pkgBufPool bufferpool.MyBufferPool
+
+func init() {
+	p, err := pool.NewSyncPool(64, 64*1024, 2)
+	if err != nil {
+		panic(err)
+	}
+	pkgBufPool = p
+}
+
+//SetBufferPool replace the default buffer pool, must be called before any ProtoConn is created
+func SetBufferPool(p bufferpool.MyBufferPool) {
+	if p != nil {
+		pkgBufPool = p
+	}
+}
+
+//WithPkgRelease Msg 交给handler 处理完后就Release, payload 所在的buffer 会被复用,
+//所以handler 不能在返回后继续持有payload, 需要的话自己复制一份;
+//默认Msg 读到刚好大小的新buffer 里, handler 可以一直持有, 其他报文总是用pool buffer, 处理完就Release
+func WithPkgRelease() ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.pkgRelease = true
+	}
+}
+
+func (pc *ProtoConn) releaseMsgPkg(pkg *ProtoPkg) {
+	if pc.pkgRelease {
+		pkg.Release()
+	}
+}
+
+var (
+	ErrOptionTruncated  = errors.New("option truncated")
+	ErrInvalidOptionLen = errors.New("invalid option len")
+)
+
+//Release put the pkg and its decode buffer back to pool,
+//the pkg, its Payload and options can't be used any more after Release
+func (p *ProtoPkg) Release() {
+	if p == nil {
+		return
+	}
+	p.reset()
+	pkgPool.Put(p)
+}
+
+//reset 把decode buffer 放回pool, pkg 可以再用来Decode
+func (p *ProtoPkg) reset() {
+	if p.buf != nil {
+		pkgBufPool.Put(p.buf)
+	}
+	*p = ProtoPkg{}
+}
+
+//Len return the encoded size of pkg
+func (p *ProtoPkg) Len() int {
+	return int(p.Hlen) + int(p.Plen)
+}
+
+//AppendTo append the encoded pkg to dst
+func (p *ProtoPkg) AppendTo(dst []byte) []byte {
+	ph := &p.ProtoHeader
+	var h [ProtoHeaderSize]byte
+	ph.EncodeWithBuf(h[:])
+	dst = append(dst, h[:]...)
+	for _, po := range p.options {
+		dst = append(dst, po.T)
+		if po.L < 128 {
+			dst = append(dst, byte(po.L))
+		} else {
+			dst = append(dst, byte(po.L&0x7f)|1<<7, byte(po.L>>7))
+		}
+		dst = append(dst, po.V...)
+	}
+	return append(dst, p.Payload...)
+}
+
+//EncodeTo write the encoded pkg to w with one Write, the buffer is from pool, no concatenation
+func (p *ProtoPkg) EncodeTo(w io.Writer) (int64, error) {
+	b := pkgBufPool.Get(p.Len())
+	data := p.AppendTo(b.Bytes()[:0])
+	n, err := w.Write(data)
+	pkgBufPool.Put(b)
+	return int64(n), err
+}
+
+//decodeOpts 直接从b 里解析options, option.V 指向b, maxOptions <= 0 表示不限制个数
+func decodeOpts(b []byte, opts []ProtoHeaderOption, maxOptions int) ([]ProtoHeaderOption, error) {
+	for len(b) > 0 {
+		if maxOptions > 0 && len(opts) >= maxOptions {
+			return opts, fmt.Errorf("%w, max:%d", ErrTooManyOptions, maxOptions)
+		}
+		if len(b) < 2 {
+			return opts, ErrOptionTruncated
+		}
+		opt := ProtoHeaderOption{T: b[0]}
+		l := b[1]
+		b = b[2:]
+		if l&0x80 == 0 {
+			opt.L = uint16(l)
+		} else {
+			if len(b) < 1 {
+				return opts, ErrOptionTruncated
+			}
+			l1 := uint16(l & 0x7f) //clear high bit
+			opt.L = (uint16(b[0]) << 7) | l1
+			b = b[1:]
+			//小于128 的L 只能用1byte 编码, 否则重新编码后长度不一样, Hlen 就不对了
+			if opt.L < 128 {
+				return opts, fmt.Errorf("%w, 2byte len:%d", ErrInvalidOptionLen, opt.L)
+			}
+		}
+		if len(b) < int(opt.L) {
+			return opts, ErrOptionTruncated
+		}
+		opt.V = b[:opt.L:opt.L]
+		b = b[opt.L:]
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
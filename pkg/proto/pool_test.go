@@ -0,0 +1,60 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAppendToAndRelease(t *testing.T) {
+	pkg, err := NewCallOptPkg([]byte("hello"), 7, CallReq, 99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pkg.Bytes()
+	if got := pkg.AppendTo(nil); !bytes.Equal(got, want) {
+		t.Fatalf("AppendTo:%v, Bytes:%v", got, want)
+	}
+	var w bytes.Buffer
+	if _, err := pkg.EncodeTo(&w); err != nil || !bytes.Equal(w.Bytes(), want) {
+		t.Fatalf("EncodeTo:%v, err:%v", w.Bytes(), err)
+	}
+	pkg.Release()
+
+	p := NewProtoPkg()
+	if err := p.Decode(bytes.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	msgid, _ := p.MsgId()
+	flag, callid, ok := p.CallId()
+	if msgid != 7 || !ok || flag != CallReq || callid != 99 || string(p.Payload) != "hello" {
+		t.Fatalf("decode msgid:%d, flag:%d, callid:%d, payload:%s", msgid, flag, callid, p.Payload)
+	}
+	p.Release()
+	if p.Payload != nil || p.options != nil {
+		t.Fatal("pkg not reset after Release")
+	}
+}
+
+func TestDecodeOptsTruncated(t *testing.T) {
+	if _, err := decodeOpts([]byte{MsgIdOpt, 2, 0}, nil, 0); err != ErrOptionTruncated {
+		t.Fatalf("err:%v", err)
+	}
+}
+
+//默认Decode 的payload 在刚好大小的buffer 里, DecodePooled 才用pool buffer
+func TestDecodeBuffer(t *testing.T) {
+	pkg, _ := NewMsgIdOptPkg(bytes.Repeat([]byte("x"), 100), 7)
+	data := pkg.Bytes()
+	p := NewProtoPkg()
+	if err := p.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if p.buf != nil || cap(p.Payload) != 100 {
+		t.Fatalf("buf:%v, cap(Payload):%d", p.buf != nil, cap(p.Payload))
+	}
+	p = NewProtoPkg()
+	if err := p.DecodePooled(bytes.NewReader(data), &DefaultLimits); err != nil || p.buf == nil || len(p.Payload) != 100 {
+		t.Fatalf("err:%v, buf:%v", err, p.buf != nil)
+	}
+	p.Release()
+}
@@ -0,0 +1,99 @@
+//Package promexporter export the proto.Stats of client and server sessions to Prometheus
+package promexporter
+
+import (
+	"strconv"
+
+	"github.com/jursonmo/practise/pkg/proto"
+	"github.com/jursonmo/practise/pkg/proto/client"
+	"github.com/jursonmo/practise/pkg/proto/server"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//StatsSession client.Session 和server.Session 都实现了
+type StatsSession interface {
+	SessionID() string
+	Stats() proto.Stats
+}
+
+type collector struct {
+	sessions func() []StatsSession
+
+	pkts, bytes       *prometheus.Desc
+	msgPkts, msgBytes *prometheus.Desc
+	decodeErrors      *prometheus.Desc
+	authFailures      *prometheus.Desc
+	rtt               *prometheus.Desc
+}
+
+//NewCollector 每次采集时调用sessions 取当前的session, 每个session 的指标带session label
+func NewCollector(namespace string, sessions func() []StatsSession) prometheus.Collector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "proto", name), help, append([]string{"session"}, labels...), nil)
+	}
+	return &collector{sessions: sessions,
+		pkts:         desc("packets_total", "Packets by direction and pkg type.", "direction", "type"),
+		bytes:        desc("bytes_total", "Encoded bytes by direction and pkg type.", "direction", "type"),
+		msgPkts:      desc("msg_packets_total", "Msg packets by direction and msgid.", "direction", "msgid"),
+		msgBytes:     desc("msg_bytes_total", "Msg encoded bytes by direction and msgid.", "direction", "msgid"),
+		decodeErrors: desc("decode_errors_total", "Packets that violate the protocol or the limits."),
+		authFailures: desc("auth_failures_total", "Failed authentications."),
+		rtt:          desc("heartbeat_rtt_seconds", "RTT of the last heartbeat."),
+	}
+}
+
+//ServerCollector 导出server 所有session 的指标
+func ServerCollector(namespace string, s *server.Server) prometheus.Collector {
+	return NewCollector(namespace, func() []StatsSession {
+		ss := s.Sessions()
+		res := make([]StatsSession, 0, len(ss))
+		for _, s := range ss {
+			res = append(res, s)
+		}
+		return res
+	})
+}
+
+//ClientCollector 导出client 当前连接的session 的指标
+func ClientCollector(namespace string, c *client.Client) prometheus.Collector {
+	return NewCollector(namespace, func() []StatsSession {
+		if s := c.Session(); s != nil {
+			return []StatsSession{s}
+		}
+		return nil
+	})
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.pkts, c.bytes, c.msgPkts, c.msgBytes, c.decodeErrors, c.authFailures, c.rtt} {
+		ch <- d
+	}
+}
+
+var pkgTypeNames = map[int]string{proto.Msg: "msg", proto.Ping: "ping", proto.Pong: "pong", proto.Auth: "auth"}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	counter := func(d *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), labels...)
+	}
+	for _, s := range c.sessions() {
+		id := s.SessionID()
+		st := s.Stats()
+		for t, name := range pkgTypeNames {
+			counter(c.pkts, st.In[t].Pkts, id, "in", name)
+			counter(c.bytes, st.In[t].Bytes, id, "in", name)
+			counter(c.pkts, st.Out[t].Pkts, id, "out", name)
+			counter(c.bytes, st.Out[t].Bytes, id, "out", name)
+		}
+		for dir, m := range map[string]map[uint16]proto.Counter{"in": st.MsgIn, "out": st.MsgOut} {
+			for msgid, v := range m {
+				mid := strconv.Itoa(int(msgid))
+				counter(c.msgPkts, v.Pkts, id, dir, mid)
+				counter(c.msgBytes, v.Bytes, id, dir, mid)
+			}
+		}
+		counter(c.decodeErrors, st.DecodeErrors, id)
+		counter(c.authFailures, st.AuthFailures, id)
+		ch <- prometheus.MustNewConstMetric(c.rtt, prometheus.GaugeValue, st.HeartbeatRTT.Seconds(), id)
+	}
+}
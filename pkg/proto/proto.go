@@ -9,15 +9,26 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"strings"
 
+	bufferpool "github.com/jursonmo/practise/pkg/bufferPool"
 	"github.com/jursonmo/practise/pkg/encoding"
 	_ "github.com/jursonmo/practise/pkg/encoding/json"
+	_ "github.com/jursonmo/practise/pkg/encoding/msgpack"
+	_ "github.com/jursonmo/practise/pkg/encoding/proto"
+	_ "github.com/jursonmo/practise/pkg/encoding/raw"
 )
 
 type ProtoPkg struct {
 	ProtoHeader
 	options []ProtoHeaderOption
 	Payload []byte
+
+	//下面的字段用于减少内存分配, 见pool.go
+	hdr    [ProtoHeaderSize]byte
+	optArr [3]ProtoHeaderOption
+	optVal [2 + callOptLen + seqOptLen + 1]byte //msgid + call + seq + compression id
+	buf    bufferpool.MyBuffer                  //Decode 时options 和payload 所在的buffer, Release 时放回pool
 }
 
 type ProtoHeader struct {
@@ -29,7 +40,7 @@ type ProtoHeader struct {
 
 type ProtoHeaderOption struct {
 	T byte
-	L uint16 // l < 127, if >127, need 2byte
+	L uint16 // l < 128 need 1byte, else need 2byte, max MaxOptionLen
 	V []byte
 }
 
@@ -61,15 +72,24 @@ const (
 	MaxPkgType = 15
 
 	//options type
-	AuthReq  = 1
-	AuthOk   = 2
-	AuthFail = 3
-	MsgIdOpt = 4
+	AuthReq       = 1
+	AuthOk        = 2
+	AuthFail      = 3
+	MsgIdOpt      = 4
+	CallOpt       = 5  //rpc correlation id, V: flag(1byte) + callid(4byte)
+	AuthChallenge = 6  //V: auth method name, payload: challenge
+	AuthResp      = 7  //payload: response of challenge
+	CompressOpt   = 8  //V: compression id, see compress.go
+	HelloOpt      = 9  //V: capabilities(4byte) + versions, see negotiate.go
+	ResumeOpt     = 10 //V: token + received seq(4byte) [+ resumed flag(1byte)], see resume.go
+	SeqOpt        = 11 //V: seq(4byte) + ack(4byte), see resume.go
+	StreamOpt     = 12 //V: stream id(4byte), 分片消息的每个分片都带, see fragment.go
 
 	//payload Type, 0 mean raw Binary
 	RawBinary      = 0
 	JSON           = 1
 	PROTOBUF       = 2
+	MSGPACK        = 3
 	MaxPayloadType = 15
 )
 
@@ -98,30 +118,66 @@ var (
 )
 
 var PayloadNameTypeMap = map[string]byte{
-	"json": JSON,
+	"raw":      RawBinary,
+	"json":     JSON,
+	"protobuf": PROTOBUF,
+	"msgpack":  MSGPACK,
 }
 
 var PayloadTypeNameMap = map[byte]string{
-	JSON: "json",
+	RawBinary: "raw",
+	JSON:      "json",
+	PROTOBUF:  "protobuf",
+	MSGPACK:   "msgpack",
 }
 
+var ErrPayloadTypeUsed = errors.New("payload type is already used")
+
+//name 跟encoding 的codec 一样不区分大小写, PayloadNameTypeMap 里都是小写
 func GetPayloadTypeByName(name string) byte {
-	v := PayloadNameTypeMap[name]
+	v := PayloadNameTypeMap[strings.ToLower(name)]
 	return v
 }
 
+func LookupPayloadType(name string) (byte, bool) {
+	v, ok := PayloadNameTypeMap[strings.ToLower(name)]
+	return v, ok
+}
+
 func GetPayloadTypeName(b byte) string {
 	v := PayloadTypeNameMap[b]
 	return v
 }
 
+// RegisterPayloadCodec 把应用自己的codec 注册到一个空闲的payload type 上(4 bit, 最大MaxPayloadType)
+// 跟encoding.RegisterCodec 一样，只能在init() 里调用，不是并发安全的
+func RegisterPayloadCodec(t byte, codec encoding.Codec) error {
+	if t > MaxPayloadType {
+		return ErrPayloadType
+	}
+	if codec == nil || codec.Name() == "" {
+		return errors.New("invalid codec")
+	}
+	name := strings.ToLower(codec.Name())
+	if used, ok := PayloadTypeNameMap[t]; ok {
+		return fmt.Errorf("%w, type:%d, used by:%s", ErrPayloadTypeUsed, t, used)
+	}
+	if old, ok := PayloadNameTypeMap[name]; ok {
+		return fmt.Errorf("codec name:%s already registered with payload type:%d", name, old)
+	}
+	encoding.RegisterCodec(codec)
+	PayloadNameTypeMap[name] = t
+	PayloadTypeNameMap[t] = name
+	return nil
+}
+
 func NewPkg() *ProtoPkg {
 	return NewProtoPkg()
 }
 
+//NewProtoPkg get a ProtoPkg from pool, call Release() to put it back if the pkg is no longer used
 func NewProtoPkg() *ProtoPkg {
-	//todo: sync.Pool
-	return &ProtoPkg{}
+	return pkgPool.Get().(*ProtoPkg)
 }
 
 func NewPingPkg(payload []byte, opts ...ProtoHeaderOption) (*ProtoPkg, error) {
@@ -157,31 +213,94 @@ func EncodeCmdPkg(cmd byte, payload []byte) (*ProtoPkg, error) {
 }
 
 func NewMsgIdOptPkg(payload []byte, msgid uint16) (*ProtoPkg, error) {
-	v := make([]byte, 2)
+	p := NewProtoPkg()
+	//option 的数据放在pkg 自己的数组里, 避免make 小对象
+	v := p.optVal[:2]
+	binary.BigEndian.PutUint16(v, msgid)
+	p.optArr[0] = ProtoHeaderOption{T: byte(MsgIdOpt), L: uint16(len(v)), V: v}
+	if err := p.encode(payload, Msg, 0, p.optArr[:1]); err != nil {
+		p.Release()
+		return nil, err
+	}
+	return p, nil
+}
+
+const streamOptLen = 4
+
+//NewStreamOptPkg 分片消息的分片, 接收端按stream id 重组, 同一个msgid 可以同时有多个分片消息
+func NewStreamOptPkg(payload []byte, msgid uint16, streamid uint32) (*ProtoPkg, error) {
+	p := NewProtoPkg()
+	v := p.optVal[:2+streamOptLen]
 	binary.BigEndian.PutUint16(v, msgid)
-	msgIdOpt := ProtoHeaderOption{T: byte(MsgIdOpt), L: uint16(len(v)), V: v}
-	return EncodePkg(payload, Msg, 0, []ProtoHeaderOption{msgIdOpt}...)
+	binary.BigEndian.PutUint32(v[2:], streamid)
+	p.optArr[0] = ProtoHeaderOption{T: byte(MsgIdOpt), L: 2, V: v[:2]}
+	p.optArr[1] = ProtoHeaderOption{T: byte(StreamOpt), L: streamOptLen, V: v[2:]}
+	if err := p.encode(payload, Msg, 0, p.optArr[:2]); err != nil {
+		p.Release()
+		return nil, err
+	}
+	return p, nil
+}
+
+//CallOpt flag
+const (
+	CallReq          = 0 //request
+	CallRespOk       = 1 //response ok
+	CallRespNoRouter = 2 //response, peer has no router for the msgid
+)
+
+const callOptLen = 5
+
+func NewCallOptPkg(payload []byte, msgid uint16, flag byte, callid uint32) (*ProtoPkg, error) {
+	p := NewProtoPkg()
+	v := p.optVal[:2+callOptLen]
+	binary.BigEndian.PutUint16(v, msgid)
+	v[2] = flag
+	binary.BigEndian.PutUint32(v[3:], callid)
+	p.optArr[0] = ProtoHeaderOption{T: byte(MsgIdOpt), L: 2, V: v[:2]}
+	p.optArr[1] = ProtoHeaderOption{T: byte(CallOpt), L: callOptLen, V: v[2:]}
+	if err := p.encode(payload, Msg, 0, p.optArr[:2]); err != nil {
+		p.Release()
+		return nil, err
+	}
+	return p, nil
 }
 
 func EncodePkg(payload []byte, pkgType byte, payloadType PayloadType, opts ...ProtoHeaderOption) (*ProtoPkg, error) {
+	p := NewProtoPkg()
+	if err := p.encode(payload, pkgType, payloadType, opts); err != nil {
+		p.Release()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *ProtoPkg) encode(payload []byte, pkgType byte, payloadType PayloadType, opts []ProtoHeaderOption) error {
 	if pkgType > MaxPkgType {
-		return nil, ErrPkgType
+		return ErrPkgType
 	}
 
 	if payloadType > MaxPayloadType {
-		return nil, ErrPayloadType
+		return ErrPayloadType
 	}
 
 	phType := pkgType | byte(payloadType<<4)
-	optsLen := uint16(OptionsLen(opts))
+	sum := 0
+	for _, po := range opts {
+		if len(po.V) > MaxOptionLen {
+			return ErrOptionTooBig
+		}
+		sum += po.Len()
+	}
+	if sum > math.MaxUint16-ProtoHeaderSize {
+		return fmt.Errorf("%w, options len:%d", ErrHeaderTooBig, sum)
+	}
+	optsLen := uint16(sum)
 
-	//p := &ProtoPkg{ProtoHeader: ProtoHeader{Ver: Ver1, Type: byte(phType), Hlen: ProtoHeaderSize + optsLen, Plen: uint32(len(payload))}}
-	p := NewProtoPkg()
 	p.ProtoHeader = ProtoHeader{Ver: Ver1, Type: byte(phType), Hlen: ProtoHeaderSize + optsLen, Plen: uint32(len(payload))}
-
 	p.options = opts
 	p.Payload = payload
-	return p, nil
+	return nil
 }
 
 func (p *ProtoPkg) String() string {
@@ -228,8 +347,8 @@ func (p *ProtoPkg) Marshal(v interface{}, codecName string) error {
 		return fmt.Errorf("GetCodec err, payload type name:%s", codecName)
 	}
 
-	t := GetPayloadTypeByName(codecName)
-	if t == 0 {
+	t, ok := LookupPayloadType(codecName)
+	if !ok {
 		return fmt.Errorf("GetPayloadTypeByName err, codec name:%s", codecName)
 	}
 	//fmt.Printf("Marshal payload t:%d\n", t)
@@ -263,8 +382,26 @@ func (p *ProtoPkg) Unmarshal(v interface{}) error {
 	return codec.Unmarshal(p.Payload, v)
 }
 
+//Decode 用DefaultLimits 检查对端的数据
 func (p *ProtoPkg) Decode(r io.Reader) error {
-	phBuf := make([]byte, ProtoHeaderSize)
+	return p.DecodeWithLimits(r, &DefaultLimits)
+}
+
+//DecodeWithLimits 超过limits 返回错误, 不会读后面的数据, r 不能再继续解析;
+//options 和payload 读到刚好大小的新buffer 里, 可以一直持有
+func (p *ProtoPkg) DecodeWithLimits(r io.Reader, limits *Limits) error {
+	return p.decodeWithLimits(r, limits, false, false)
+}
+
+//DecodePooled 跟DecodeWithLimits 一样, 但是options 和payload 读到pool buffer 里,
+//用完必须Release, Release 之后不能再持有Payload
+func (p *ProtoPkg) DecodePooled(r io.Reader, limits *Limits) error {
+	return p.decodeWithLimits(r, limits, true, true)
+}
+
+//poolMsg, poolOther 分别表示Msg 和其他报文是否用pool buffer
+func (p *ProtoPkg) decodeWithLimits(r io.Reader, limits *Limits, poolMsg, poolOther bool) error {
+	phBuf := p.hdr[:]
 	n, err := io.ReadFull(r, phBuf)
 	if err != nil {
 		return err
@@ -279,51 +416,35 @@ func (p *ProtoPkg) Decode(r io.Reader) error {
 	ver := ph.GetVer()
 	switch ver {
 	case Ver1:
-		return p.Ver1Decode(r, ph)
+		if err = limits.check(&ph); err != nil {
+			return err
+		}
+		pooled := poolOther
+		if ph.PkgType() == Msg {
+			pooled = poolMsg
+		}
+		return p.ver1Decode(r, ph, limits.MaxOptions, pooled)
 	default:
-		return fmt.Errorf("unspport pkg version:%d", ver)
+		return fmt.Errorf("%w:%d", ErrUnsupportedVersion, ver)
 	}
 }
 
+//Ver1Decode 只用DefaultLimits.MaxOptions 检查, 调用者自己检查Hlen 和Plen
 func (p *ProtoPkg) Ver1Decode(r io.Reader, ph ProtoHeader) error {
+	return p.ver1Decode(r, ph, DefaultLimits.MaxOptions, false)
+}
+
+func (p *ProtoPkg) ver1Decode(r io.Reader, ph ProtoHeader, maxOptions int, pooled bool) error {
 	p.ProtoHeader = ph
-	//have options?
+	optsLen := 0
 	if ph.Hlen > ProtoHeaderSize {
-		buf := make([]byte, int(ph.Hlen-ProtoHeaderSize))
-		_, err := io.ReadFull(r, buf)
-		if err != nil {
-			return err
-		}
-		//log.Printf("options buf, len:%d, buf[0]:%d\n", len(buf), buf[0])
-		opts := make([]ProtoHeaderOption, 0, 1)
-		buffer := bytes.NewBuffer(buf)
-		i := 0
-		for {
-			i++
-			opt := ProtoHeaderOption{}
-			err := opt.DecodeFromBuffer(buffer)
-			if err == io.EOF { //read the end of buffer, it is normal, just break and go on
-				break
-			}
-			if err != nil {
-				log.Printf("DecodeFromBuffer:%v", err)
-				return err
-			}
-			//log.Printf("Decode, opt_index:%d, opt:%v\n", i, &opt)
-			opts = append(opts, opt)
-		}
-		p.options = opts
+		optsLen = int(ph.Hlen - ProtoHeaderSize)
 	}
-	//have payload ?
-	if ph.Plen > 0 {
-		buf := make([]byte, int(ph.Plen))
-		_, err := io.ReadFull(r, buf)
-		if err != nil {
-			return err
-		}
-		p.Payload = buf
+	if err := p.readBody(r, optsLen, maxOptions, pooled); err != nil {
+		return err
 	}
 
+	//没有options 和payload 的CloseCmd 也是*CloseError
 	cmd := ph.GetCmd()
 	if cmd == CloseCmd {
 		return FormatCloseCmdErr(p.Payload)
@@ -331,8 +452,39 @@ func (p *ProtoPkg) Ver1Decode(r io.Reader, ph ProtoHeader) error {
 	return nil
 }
 
-func FormatCloseCmdErr(d []byte) error {
-	return fmt.Errorf("%s", string(d))
+//readBody 读options 和payload
+func (p *ProtoPkg) readBody(r io.Reader, optsLen, maxOptions int, pooled bool) error {
+	//options 和payload 一次读到同一个buffer 里; pool buffer 是按大小分级的, 最多大一倍,
+	//所以不会Release 的pkg 用刚好大小的buffer, 避免一直持有大一倍的内存
+	n := optsLen + int(p.Plen)
+	if n == 0 {
+		return nil
+	}
+	var buf []byte
+	if pooled {
+		p.buf = pkgBufPool.Get(n)
+		buf = p.buf.Bytes()
+	}
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return err
+	}
+	//have options?
+	if optsLen > 0 {
+		p.options, err = decodeOpts(buf[:optsLen], p.optArr[:0], maxOptions)
+		if err != nil {
+			return err
+		}
+	}
+	//have payload ?
+	if p.Plen > 0 {
+		p.Payload = buf[optsLen:]
+	}
+	return nil
 }
 
 func (opt *ProtoHeaderOption) String() string {
@@ -347,14 +499,33 @@ func (opt *ProtoHeaderOption) TypeName() string {
 		return "AuthOk"
 	case AuthFail:
 		return "AuthFial"
+	case MsgIdOpt:
+		return "MsgId"
+	case CallOpt:
+		return "Call"
+	case AuthChallenge:
+		return "AuthChallenge"
+	case AuthResp:
+		return "AuthResponse"
+	case CompressOpt:
+		return "Compress"
+	case HelloOpt:
+		return "Hello"
+	case ResumeOpt:
+		return "Resume"
+	case SeqOpt:
+		return "Seq"
+	case StreamOpt:
+		return "Stream"
 	default:
 		return fmt.Sprintf("Unkown Option Type:%d", opt.T)
 	}
 }
 
+//L < 128 用1byte, 否则用2byte: 第一个byte 的最高位是1, 低7bit 是L 的低7bit, 第二个byte 是L>>7, 所以L 最大是MaxOptionLen
 func (po ProtoHeaderOption) Len() int {
 	l := len(po.V)
-	if len(po.V) < 127 {
+	if len(po.V) < 128 {
 		return l + 2 // len(V)+ T(1byte)+ L(1byte)
 	}
 	return l + 3 // len(V)+ T(1byte)+ L(2byte)
@@ -367,12 +538,12 @@ func (po ProtoHeaderOption) WriteToBuffer(b *bytes.Buffer) {
 		log.Panicf("len(po.V) != int(po.L), opt:%s", po.String())
 	}
 	b.WriteByte(po.T)
-	if po.L < 127 {
+	if po.L < 128 {
 		b.WriteByte(byte(po.L))
 	} else {
-		l1 := byte(po.L) | 1<<7 //add high bite, 添加高位
+		l1 := byte(po.L&0x7f) | 1<<7 //add high bite, 添加高位
 		b.WriteByte(l1)
-		l2 := byte(po.L >> 8)
+		l2 := byte(po.L >> 7)
 		b.WriteByte(l2)
 	}
 	b.Write(po.V)
@@ -387,20 +558,23 @@ func (po *ProtoHeaderOption) DecodeFromBuffer(b *bytes.Buffer) (err error) {
 	if err != nil {
 		return
 	}
-	if l < 127 {
+	if l&0x80 == 0 {
 		po.L = uint16(l)
 	} else {
 		l2, err := b.ReadByte()
 		if err != nil {
 			return err
 		}
-		l1 := uint16((l << 1) >> 1) //clear high bit
-		po.L = (uint16(l2) << 8) | l1
+		l1 := uint16(l & 0x7f) //clear high bit
+		po.L = (uint16(l2) << 7) | l1
+		if po.L < 128 {
+			return fmt.Errorf("%w, 2byte len:%d", ErrInvalidOptionLen, po.L)
+		}
 	}
 	po.V = b.Next(int(po.L))
 	//check
 	if len(po.V) != int(po.L) {
-		log.Panicf("opt.L:%d, len(opt.V):%d, not the same", int(po.L), len(po.V))
+		return fmt.Errorf("%w, opt.L:%d, len(opt.V):%d", ErrOptionTruncated, int(po.L), len(po.V))
 	}
 	return nil
 }
@@ -432,8 +606,7 @@ func EncodeOpts(pos []ProtoHeaderOption) []byte {
 
 	//check
 	if len(b) != len(buf) {
-		log.Printf("notice, ProtoHeaderOption len:%d, but after encode len:%d\n", l, len(b))
-		panic("")
+		log.Panicf("notice, ProtoHeaderOption len:%d, but after encode len:%d", l, len(b))
 	}
 	return b
 }
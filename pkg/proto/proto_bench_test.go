@@ -0,0 +1,59 @@
+package proto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+var benchPayload = bytes.Repeat([]byte("x"), 256)
+
+// before: pkg.Bytes() allocate a new slice for every write
+func BenchmarkEncodeBytes(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pkg, _ := NewMsgIdOptPkg(benchPayload, 11)
+		_ = pkg.Bytes()
+	}
+}
+
+func BenchmarkEncodeTo(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pkg, _ := NewMsgIdOptPkg(benchPayload, 11)
+		pkg.EncodeTo(ioutil.Discard)
+		pkg.Release()
+	}
+}
+
+// the pkg is not released, like ProtoConn.Run without WithPkgRelease, the buffer is exactly sized
+func BenchmarkDecode(b *testing.B) {
+	pkg, _ := NewMsgIdOptPkg(benchPayload, 11)
+	data := pkg.Bytes()
+	r := bytes.NewReader(data)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		p := NewProtoPkg()
+		if err := p.Decode(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeRelease(b *testing.B) {
+	pkg, _ := NewMsgIdOptPkg(benchPayload, 11)
+	data := pkg.Bytes()
+	r := bytes.NewReader(data)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		p := NewProtoPkg()
+		if err := p.DecodePooled(r, &DefaultLimits); err != nil {
+			b.Fatal(err)
+		}
+		p.Release()
+	}
+}
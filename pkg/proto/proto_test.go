@@ -0,0 +1,46 @@
+package proto
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jursonmo/practise/pkg/encoding"
+)
+
+type upperCodec struct{}
+
+func (upperCodec) Marshal(v interface{}) ([]byte, error)      { return v.([]byte), nil }
+func (upperCodec) Unmarshal(data []byte, v interface{}) error { *(v.(*[]byte)) = data; return nil }
+func (upperCodec) Name() string                               { return "Test-Upper" }
+
+func TestRegisterPayloadCodec(t *testing.T) {
+	const pt = MaxPayloadType
+	defer func() {
+		delete(PayloadNameTypeMap, "test-upper")
+		delete(PayloadTypeNameMap, pt)
+	}()
+	if err := RegisterPayloadCodec(MaxPayloadType+1, upperCodec{}); !errors.Is(err, ErrPayloadType) {
+		t.Fatalf("expect ErrPayloadType, err:%v", err)
+	}
+	if err := RegisterPayloadCodec(JSON, upperCodec{}); !errors.Is(err, ErrPayloadTypeUsed) {
+		t.Fatalf("expect ErrPayloadTypeUsed, err:%v", err)
+	}
+	if err := RegisterPayloadCodec(pt, upperCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	//跟encoding 一样按小写保存, 查找时不区分大小写
+	if name := GetPayloadTypeName(pt); name != "test-upper" {
+		t.Fatalf("name:%s", name)
+	}
+	for _, name := range []string{"Test-Upper", "test-upper", "TEST-UPPER"} {
+		if v, ok := LookupPayloadType(name); !ok || v != pt {
+			t.Fatalf("lookup %s, got:%d, ok:%v", name, v, ok)
+		}
+		if encoding.GetCodec(name) == nil {
+			t.Fatalf("codec %s is not registered", name)
+		}
+	}
+	if err := RegisterPayloadCodec(pt-1, upperCodec{}); err == nil {
+		t.Fatal("same name with another payload type should fail")
+	}
+}
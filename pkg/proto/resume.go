@@ -0,0 +1,313 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+//session resumption, 断线重连后恢复之前的session, 重发对端没有确认的消息:
+//1. client 握手的ping 带上ResumeOpt(token + 已经收到的seq), 第一次连接token 为空
+//2. server 用token 找之前的ResumeState, 找不到就新建一个, pong 里回应ResumeOpt(token + 已经收到的seq + 是否恢复)
+//3. Init 成功后重发对端没有收到的消息, client 在Init 里自动重发, server 由session 层调用AttachResume
+//4. resume 模式下每个Msg 带SeqOpt(seq + ack), ack 是收到的对端的最大seq, 对端据此删掉已经确认的消息; 收到重复的seq 就丢掉
+//只有WriteWithId/WriteWithType/WriteWithPolicy 发送的消息会重发, rpc 和分片的消息不会
+
+var (
+	DefaultResumeBufferSize = 1024
+	ErrResumeBufferFull     = errors.New("resume buffer full")
+)
+
+const (
+	resumeTokenLen = 16
+	seqOptLen      = 8 //seq(4byte) + ack(4byte)
+)
+
+type resumeMsg struct {
+	seq   uint32
+	msgid uint16
+	t     byte
+	d     []byte
+}
+
+//ResumeState 跨连接保存的session 状态, 重连后交给新的ProtoConn, 见WithResume, WithResumeHandler
+type ResumeState struct {
+	token   []byte
+	max     int
+	exclude map[uint16]bool
+
+	mu      sync.Mutex //保证seq 的顺序跟发送的顺序一样
+	pc      *ProtoConn //当前的连接
+	sendSeq uint32
+	buf     []resumeMsg //没有确认的消息, seq 递增
+
+	peerAck uint32 //对端确认收到的seq
+	recvSeq uint32 //收到的对端的最大seq
+	unacked int32  //收到后还没有ack 的消息个数
+}
+
+//NewResumeState max 是最多保存多少个没有确认的消息, 超过时发送返回ErrResumeBufferFull;
+//exclude 的msgid 不会重发, 比如心跳
+func NewResumeState(max int, exclude ...uint16) *ResumeState {
+	if max <= 0 {
+		max = DefaultResumeBufferSize
+	}
+	rs := &ResumeState{max: max, exclude: make(map[uint16]bool)}
+	for _, id := range exclude {
+		rs.exclude[id] = true
+	}
+	return rs
+}
+
+func newResumeToken() []byte {
+	token := make([]byte, resumeTokenLen)
+	rand.Read(token)
+	return token
+}
+
+//Token server 分配的token, client 第一次连接成功之前是nil
+func (rs *ResumeState) Token() []byte {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.token
+}
+
+//Pending 没有被对端确认的消息个数
+func (rs *ResumeState) Pending() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.trim()
+	return len(rs.buf)
+}
+
+//reset 开始一个新的session, 没有确认的消息都丢掉
+func (rs *ResumeState) reset(token []byte) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.token = token
+	rs.sendSeq = 0
+	rs.buf = nil
+	atomic.StoreUint32(&rs.peerAck, 0)
+	atomic.StoreUint32(&rs.recvSeq, 0)
+	atomic.StoreInt32(&rs.unacked, 0)
+}
+
+//trim 删掉对端已经确认的消息, 调用者持有rs.mu
+func (rs *ResumeState) trim() {
+	ack := atomic.LoadUint32(&rs.peerAck)
+	i := 0
+	for ; i < len(rs.buf) && rs.buf[i].seq <= ack; i++ {
+		rs.buf[i].d = nil
+	}
+	rs.buf = rs.buf[i:]
+}
+
+func (rs *ResumeState) acked(ack uint32) {
+	for {
+		old := atomic.LoadUint32(&rs.peerAck)
+		if ack <= old || atomic.CompareAndSwapUint32(&rs.peerAck, old, ack) {
+			return
+		}
+	}
+}
+
+//received 返回false 表示是重复的消息
+func (rs *ResumeState) received(seq uint32) bool {
+	for {
+		old := atomic.LoadUint32(&rs.recvSeq)
+		if seq <= old {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&rs.recvSeq, old, seq) {
+			return true
+		}
+	}
+}
+
+//addSeqOption seq 为0 表示只带ack
+func (rs *ResumeState) addSeqOption(pkg *ProtoPkg, seq uint32) {
+	v := pkg.optVal[2+callOptLen : 2+callOptLen+seqOptLen]
+	binary.BigEndian.PutUint32(v, seq)
+	binary.BigEndian.PutUint32(v[4:], atomic.LoadUint32(&rs.recvSeq))
+	atomic.StoreInt32(&rs.unacked, 0)
+	pkg.addOption(ProtoHeaderOption{T: SeqOpt, L: seqOptLen, V: v})
+}
+
+//write 消息先保存到buf 再发送, 连接断开时也返回成功, 重连后重发
+func (rs *ResumeState) write(pkg *ProtoPkg, msgid uint16, d []byte, policy WritePolicy) (int, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	var seq uint32
+	if !rs.exclude[msgid] {
+		rs.trim()
+		if len(rs.buf) >= rs.max {
+			pkg.Release()
+			return 0, fmt.Errorf("%w, max:%d", ErrResumeBufferFull, rs.max)
+		}
+		rs.sendSeq++
+		seq = rs.sendSeq
+		rs.buf = append(rs.buf, resumeMsg{seq: seq, msgid: msgid, t: pkg.Type(), d: append([]byte(nil), d...)})
+	}
+	rs.addSeqOption(pkg, seq)
+
+	pc := rs.pc
+	if pc == nil || pc.IsClosed() {
+		pkg.Release()
+		if seq == 0 {
+			return 0, ErrConnClosed
+		}
+		return len(d), nil
+	}
+	n, err := pc.writePkgWithPolicy(pkg, policy)
+	if err != nil && seq != 0 {
+		if pc.IsClosed() {
+			return len(d), nil
+		}
+		//没有发出去, 也不用重发
+		rs.buf = rs.buf[:len(rs.buf)-1]
+		rs.sendSeq--
+	}
+	return n, err
+}
+
+//attach 以后的消息都从pc 发送, 并重发对端没有收到的消息, peerRecv 是对端已经收到的seq
+func (rs *ResumeState) attach(pc *ProtoConn, peerRecv uint32) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.pc = pc
+	rs.acked(peerRecv)
+	rs.trim()
+	for _, m := range rs.buf {
+		pkg, err := NewMsgIdOptPkg(m.d, m.msgid)
+		if err != nil {
+			return err
+		}
+		pkg.SetPayloadType(m.t)
+		rs.addSeqOption(pkg, m.seq)
+		if _, err = pc.writePkg(pkg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//WithResume client 用, 同一个ResumeState 用在每次重连的ProtoConn 上, 对端不支持时不起作用
+func WithResume(rs *ResumeState) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.resume = rs
+	}
+}
+
+//WithResumeHandler server 用, h 用client 给的token 找之前的ResumeState, 找不到(或者token 为空)就返回NewResumeState, resumed 为false,
+//新的ResumeState 由ProtoConn 分配token
+//server 的ProtoConn 要设置握手数据, client 在握手的ping 里带上token
+func WithResumeHandler(h func(token []byte) (rs *ResumeState, resumed bool)) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		pc.resumeHandler = h
+	}
+}
+
+//ResumeState 返回nil 表示没有协商resume
+func (pc *ProtoConn) ResumeState() *ResumeState {
+	return pc.resume
+}
+
+//Resumed 表示这个连接恢复了之前的session
+func (pc *ProtoConn) Resumed() bool {
+	return pc.resumed
+}
+
+//AttachResume server Init 成功后调用, 开始用这个连接发送消息, 并重发client 没有收到的消息
+func (pc *ProtoConn) AttachResume() error {
+	if pc.resume == nil {
+		return nil
+	}
+	return pc.resume.attach(pc, pc.resumePeerRecv)
+}
+
+//resumeOption client 握手的ping 里带上token 和收到的seq
+func (pc *ProtoConn) resumeOption() ProtoHeaderOption {
+	rs := pc.resume
+	token := rs.Token()
+	v := make([]byte, len(token)+4)
+	copy(v, token)
+	binary.BigEndian.PutUint32(v[len(token):], atomic.LoadUint32(&rs.recvSeq))
+	return ProtoHeaderOption{T: ResumeOpt, L: uint16(len(v)), V: v}
+}
+
+//handleResume server 处理client 握手的ResumeOpt, 报文协议下重传的ping 用第一次的结果
+func (pc *ProtoConn) handleResume(v []byte) (ProtoHeaderOption, error) {
+	if len(v) != 4 && len(v) != resumeTokenLen+4 {
+		return ProtoHeaderOption{}, fmt.Errorf("invalid resume option len:%d", len(v))
+	}
+	if pc.resume == nil {
+		pc.resumePeerRecv = binary.BigEndian.Uint32(v[len(v)-4:])
+		pc.resume, pc.resumed = pc.resumeHandler(v[:len(v)-4])
+		if !pc.resumed {
+			pc.resume.reset(newResumeToken())
+		}
+	}
+	rs := pc.resume
+	token := rs.Token()
+	resp := make([]byte, resumeTokenLen+4+1)
+	copy(resp, token)
+	binary.BigEndian.PutUint32(resp[resumeTokenLen:], atomic.LoadUint32(&rs.recvSeq))
+	if pc.resumed {
+		resp[resumeTokenLen+4] = 1
+	}
+	return ProtoHeaderOption{T: ResumeOpt, L: uint16(len(resp)), V: resp}, nil
+}
+
+//setResumed client 从握手的pong 里得到server 的结果, 没有ResumeOpt 说明server 不支持
+func (pc *ProtoConn) setResumed(pong *ProtoPkg) error {
+	if pc.resume == nil {
+		return nil
+	}
+	opt, ok := pong.option(ResumeOpt)
+	if !ok {
+		pc.logger.Infof("peer doesn't support resume")
+		pc.resume = nil
+		return nil
+	}
+	if len(opt.V) != resumeTokenLen+4+1 {
+		return fmt.Errorf("invalid resume option len:%d", len(opt.V))
+	}
+	token := opt.V[:resumeTokenLen]
+	pc.resumePeerRecv = binary.BigEndian.Uint32(opt.V[resumeTokenLen:])
+	pc.resumed = opt.V[resumeTokenLen+4] == 1 && bytes.Equal(token, pc.resume.Token())
+	if !pc.resumed {
+		pc.resume.reset(append([]byte(nil), token...))
+	}
+	return nil
+}
+
+//resumeRecv 处理对端的ack, 返回false 表示是重复的消息, 要丢掉
+func (pc *ProtoConn) resumeRecv(pkg *ProtoPkg) bool {
+	opt, ok := pkg.option(SeqOpt)
+	if !ok || len(opt.V) != seqOptLen {
+		return true
+	}
+	rs := pc.resume
+	rs.acked(binary.BigEndian.Uint32(opt.V[4:]))
+	seq := binary.BigEndian.Uint32(opt.V)
+	if seq == 0 || pkg.PkgType() != Msg {
+		return true
+	}
+	if !rs.received(seq) {
+		pc.logger.Debugf("drop duplicate msg seq:%d", seq)
+		return false
+	}
+	//对端一直发送而我们没有消息回应时, 用pong 单独回应ack, 让对端可以删掉buf 里的消息
+	if atomic.AddInt32(&rs.unacked, 1) >= int32(rs.max/4+1) {
+		pong, err := NewPongPkg(nil)
+		if err == nil {
+			rs.addSeqOption(pong, 0)
+			pc.writePkg(pong)
+		}
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package proto
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type resumeRecorder struct {
+	sync.Mutex
+	msgs []string
+}
+
+func (r *resumeRecorder) handler(pc *ProtoConn, pkg Pkger) error {
+	r.Lock()
+	r.msgs = append(r.msgs, string(pkg.Paylaod()))
+	r.Unlock()
+	return nil
+}
+
+func (r *resumeRecorder) wait(t *testing.T, n int) []string {
+	for i := 0; i < 100; i++ {
+		r.Lock()
+		msgs := append([]string(nil), r.msgs...)
+		r.Unlock()
+		if len(msgs) >= n {
+			time.Sleep(time.Millisecond * 50) //重复的消息也会在这期间到达
+			r.Lock()
+			defer r.Unlock()
+			return append([]string(nil), r.msgs...)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("timeout, got:%v, expect %d msgs", r.msgs, n)
+	return nil
+}
+
+func TestResume(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var serverRS *ResumeState
+	handler := func(token []byte) (*ResumeState, bool) {
+		if serverRS != nil && string(token) == string(serverRS.Token()) {
+			return serverRS, true
+		}
+		serverRS = NewResumeState(16)
+		return serverRS, false
+	}
+	var srvGot, cliGot resumeRecorder
+	clientRS := NewResumeState(16)
+	ctx := context.Background()
+
+	connect := func() (server, client *ProtoConn) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			server = NewProtoConn(c, true, nil, WithPacketHandshake(), WithResumeHandler(handler))
+			server.SetMsgHandlerv2(srvGot.handler)
+			if err := server.Init(ctx); err != nil {
+				t.Errorf("server Init:%v", err)
+				return
+			}
+			if err := server.AttachResume(); err != nil {
+				t.Errorf("server AttachResume:%v", err)
+			}
+			go server.Run(ctx)
+		}()
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client = NewProtoConn(c, false, nil, WithResume(clientRS))
+		client.SetMsgHandlerv2(cliGot.handler)
+		if err := client.Init(ctx); err != nil {
+			t.Fatalf("client Init:%v", err)
+		}
+		go client.Run(ctx)
+		<-done
+		if server == nil {
+			t.FailNow()
+		}
+		return
+	}
+
+	server, client := connect()
+	if client.Resumed() || server.Resumed() || len(clientRS.Token()) != resumeTokenLen {
+		t.Fatalf("first connection shouldn't be resumed")
+	}
+	client.WriteWithId(100, []byte("a"))
+	client.WriteWithId(100, []byte("b"))
+	srvGot.wait(t, 2)
+
+	//断线期间发送的消息保存在buf 里
+	client.Close()
+	server.Close()
+	if _, err := client.WriteWithId(100, []byte("c")); err != nil {
+		t.Fatalf("write when disconnected:%v", err)
+	}
+	if _, err := client.WriteWithPolicy(100, []byte("d"), WriteFailFast); err != nil {
+		t.Fatalf("WriteWithPolicy when disconnected:%v", err)
+	}
+	if _, err := server.WriteWithId(100, []byte("x")); err != nil {
+		t.Fatalf("write when disconnected:%v", err)
+	}
+
+	server, client = connect()
+	defer server.Close()
+	defer client.Close()
+	if !client.Resumed() || !server.Resumed() {
+		t.Fatalf("client resumed:%v, server resumed:%v", client.Resumed(), server.Resumed())
+	}
+	//a, b 没有被确认, 会重发, server 按seq 丢掉重复的
+	if got := srvGot.wait(t, 4); len(got) != 4 || got[2] != "c" || got[3] != "d" {
+		t.Fatalf("server got:%v", got)
+	}
+	if got := cliGot.wait(t, 1); len(got) != 1 || got[0] != "x" {
+		t.Fatalf("client got:%v", got)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"time"
+
+	"github.com/jursonmo/practise/pkg/dial"
+	"github.com/jursonmo/practise/pkg/proto"
+	"github.com/jursonmo/practise/pkg/proto/session"
+)
+
+type Option func(*Server)
+
+func WithOnConnect(h func(session.Sessioner)) Option {
+	return func(s *Server) {
+		s.onConnect = h
+	}
+}
+
+//client 必须用其中一种Authenticator 验证通过才能建立session, 见proto/auth
+func WithAuthenticator(as ...proto.Authenticator) Option {
+	return func(s *Server) {
+		s.authn = true
+		s.pcOpts = append(s.pcOpts, proto.WithAuthenticator(as...))
+	}
+}
+
+//session 的连接断开后调用
+func WithOnStop(h func(session.Sessioner)) Option {
+	return func(s *Server) {
+		s.onStop = h
+	}
+}
+
+//Stop 时发给所有session 的close code, 默认是proto.CloseServiceRestart
+func WithStopCloseCode(code int, msg string) Option {
+	return func(s *Server) {
+		s.stopCode = code
+		s.stopMsg = msg
+	}
+}
+
+//收到对端的CloseCmd 时调用, code 是proto.CloseXXX
+func WithOnClose(h func(s session.Sessioner, code int, msg string)) Option {
+	return func(s *Server) {
+		s.onClose = h
+	}
+}
+
+//WithLogger server 和它的session, ProtoConn 都用这个Logger, 默认是proto.NopLogger
+func WithLogger(l proto.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+		s.pcOpts = append(s.pcOpts, proto.WithLogger(l))
+	}
+}
+
+//WithResume 开启session resumption: 连接断开后session 挂起grace 时间, 期间发给它的消息保存起来(最多maxPending 个没有确认的消息),
+//client 用token 重连后恢复session, 双方重发对端没有收到的消息; 恢复时调用WithOnResume 的回调, 不会再调用onConnect.
+//client 要用client.WithResume, 见proto/resume.go.
+//token 在auth 之前的握手里交换, 不是在auth 里; 所以必须同时配置WithAuthenticator(否则NewServer 返回ErrResumeWithoutAuth),
+//auth 通过并且Identity 跟原来的session 一样才会恢复, token 泄露了也不能接管别人的session
+func WithResume(grace time.Duration, maxPending int) Option {
+	return func(s *Server) {
+		s.resumeGrace = grace
+		s.resumeMaxPending = maxPending
+	}
+}
+
+//session 恢复到新的连接后调用
+func WithOnResume(h func(session.Sessioner)) Option {
+	return func(s *Server) {
+		s.onResume = h
+	}
+}
+
+//每个连接创建ProtoConn 时使用的option, 比如proto.WithWriteQueue
+func WithProtoConnOpts(opts ...proto.ProtoConnOpt) Option {
+	return func(s *Server) {
+		s.pcOpts = append(s.pcOpts, opts...)
+	}
+}
+
+//tcp:// 和tls:// 监听用的dial.ServerOption, 比如tls:// 的dial.WithServerCert, dial.WithClientCA
+func WithListenOptions(opts ...dial.ServerOption) Option {
+	return func(s *Server) {
+		s.lnOpts = append(s.lnOpts, opts...)
+	}
+}
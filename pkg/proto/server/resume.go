@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jursonmo/practise/pkg/proto"
+	"github.com/jursonmo/practise/pkg/proto/session"
+)
+
+var (
+	ErrResumeTimeout  = errors.New("resume timeout")
+	ErrResumeIdentity = errors.New("resume with different identity")
+)
+
+//lookupResume 握手时用client 的token 找挂起(或者还没有发现断开)的session; 这时还没有auth,
+//只是准备好ResumeState, auth 之后resume 检查Identity 才真正切换session
+func (s *Server) lookupResume(token []byte) (*proto.ResumeState, bool) {
+	if len(token) > 0 {
+		if v, ok := s.resumes.Load(string(token)); ok {
+			return v.(*Session).rs, true
+		}
+	}
+	return proto.NewResumeState(s.resumeMaxPending, session.HeartBeatReqId, session.HeartBeatRespId), false
+}
+
+//resumeSession Init 成功后, 把之前的session 切换到新的连接
+func (s *Server) resumeSession(pc *proto.ProtoConn) error {
+	s.Lock()
+	closed := s.closed
+	s.Unlock()
+	if closed {
+		pc.Close()
+		return ErrServerClosed
+	}
+	v, ok := s.resumes.Load(string(pc.ResumeState().Token()))
+	if !ok {
+		//握手之后session 超时了, client 重连时会新建session
+		pc.Close()
+		return fmt.Errorf("%v, %w", pc, ErrResumeTimeout)
+	}
+	ss := v.(*Session)
+	if err := ss.resume(pc); err != nil {
+		pc.Close()
+		return err
+	}
+	ss.log.Infof("resumed by %v", pc.RemoteAddr())
+	if s.onResume != nil {
+		s.onResume(ss)
+	}
+	return nil
+}
+
+//suspend 连接断开时, 开启resume 的session 挂起等client 重连, 返回false 表示要结束session.
+//对端主动close 或者server 停止时不挂起
+func (s *Session) suspend(err error) bool {
+	var ce *proto.CloseError
+	if s.rs == nil || errors.As(err, &ce) || s.ctx.Err() != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped || s.finished {
+		return false
+	}
+	s.suspended = true
+	s.grace = time.AfterFunc(s.srv.resumeGrace, func() { s.expire(ErrResumeTimeout) })
+	s.log.Infof("suspended, wait %v for resume, err:%v", s.srv.resumeGrace, err)
+	return true
+}
+
+//expire 结束挂起的session
+func (s *Session) expire(err error) {
+	s.mu.Lock()
+	if !s.suspended || s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.mu.Unlock()
+	s.log.Infof("session end without resume, err:%v", err)
+	s.end(err)
+}
+
+//cancelResume 以后连接断开就结束session, 已经挂起的直接结束
+func (s *Session) cancelResume() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.expire(session.ErrSessionClosed)
+}
+
+//resume client 用token 重连, session 换成新的连接, 并重发client 没有收到的消息
+func (s *Session) resume(pc *proto.ProtoConn) error {
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+
+	s.mu.Lock()
+	old, connDone := s.pc, s.connDone
+	s.mu.Unlock()
+	if !sameIdentity(old.Identity(), pc.Identity()) {
+		//token 泄露了? 只拒绝新的连接, 不能影响原来的session
+		return ErrResumeIdentity
+	}
+
+	//client 重连时旧的连接可能还没有发现断开, 先关闭它, 等它挂起
+	old.Close()
+	select {
+	case <-connDone:
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+
+	s.mu.Lock()
+	if !s.suspended || s.finished {
+		s.mu.Unlock()
+		return session.ErrSessionClosed
+	}
+	s.suspended = false
+	s.grace.Stop()
+	s.pc = pc
+	s.mu.Unlock()
+
+	pc.SetMsgHandler(proto.ProtoMsgHandle(s.msgHandle))
+	pc.SetMsgHandlerv2(proto.ProtoMsgHandlev2(s.msgHandlev2))
+	if err := pc.AttachResume(); err != nil {
+		//连接又断了, serve 里Run 退出后再挂起
+		s.log.Errorf("resend to %v err:%v", pc.RemoteAddr(), err)
+	}
+	s.serve(pc)
+	return nil
+}
+
+//Resumed 表示当前的连接恢复了之前的session
+func (s *Session) Resumed() bool {
+	return s.protoConn().Resumed()
+}
+
+//sameIdentity 没有Identity(没有通过Authenticator 验证) 的连接不能恢复session
+func sameIdentity(a, b *proto.Identity) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return a.Subject == b.Subject && a.Method == b.Method
+}
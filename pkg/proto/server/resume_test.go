@@ -0,0 +1,36 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jursonmo/practise/pkg/proto"
+	"github.com/jursonmo/practise/pkg/proto/auth"
+)
+
+func TestResumeRequiresAuth(t *testing.T) {
+	if _, err := NewServer([]string{"tcp://127.0.0.1:0"}, WithResume(time.Second, 10)); !errors.Is(err, ErrResumeWithoutAuth) {
+		t.Fatalf("expect ErrResumeWithoutAuth, err:%v", err)
+	}
+	a := auth.NewHMACAuthenticator(func(string) ([]byte, bool) { return []byte("secret"), true })
+	if _, err := NewServer([]string{"tcp://127.0.0.1:0"}, WithResume(time.Second, 10), WithAuthenticator(a)); err != nil {
+		t.Fatal(err)
+	}
+
+	//没有Identity 的连接不能恢复session
+	gw := &proto.Identity{Subject: "gw", Method: "hmac"}
+	for _, c := range []struct {
+		a, b *proto.Identity
+		same bool
+	}{
+		{nil, nil, false},
+		{gw, nil, false},
+		{gw, &proto.Identity{Subject: "gw", Method: "hmac"}, true},
+		{gw, &proto.Identity{Subject: "other", Method: "hmac"}, false},
+	} {
+		if sameIdentity(c.a, c.b) != c.same {
+			t.Fatalf("sameIdentity(%v, %v) should be %v", c.a, c.b, c.same)
+		}
+	}
+}
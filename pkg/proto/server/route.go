@@ -4,16 +4,22 @@ import (
 	"github.com/jursonmo/practise/pkg/proto/session"
 )
 
-func (c *Server) AddRouter(msgid uint16, r session.Router) error {
+//AddRouter mws 是这个msgid 的middlewares, 见session.Middleware
+func (c *Server) AddRouter(msgid uint16, r session.Router, mws ...session.Middleware) error {
 	//业务数据id 从10开始，0-9 预留私有控制消息，比如心跳报文
 	if err := session.CheckMsgId(msgid); err != nil {
 		return err
 	}
-	return c.addRouter(msgid, r)
+	return c.addRouter(msgid, r, mws...)
 }
 
-func (s *Server) addRouter(msgid uint16, r session.Router) error {
-	return s.routers.AddRouter(msgid, r)
+func (s *Server) addRouter(msgid uint16, r session.Router, mws ...session.Middleware) error {
+	return s.routers.AddRouter(msgid, r, mws...)
+}
+
+//Use 注册全局的middlewares, 比如session.Recover
+func (s *Server) Use(mws ...session.Middleware) {
+	s.routers.Use(mws...)
 }
 
 func (s *Server) GetRouter(msgid uint16) session.Router {
@@ -3,20 +3,27 @@ package server
 import (
 	"context"
 	"errors"
-	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/jursonmo/practise/pkg/dial"
 	"github.com/jursonmo/practise/pkg/proto"
 	"github.com/jursonmo/practise/pkg/proto/session"
+	"github.com/jursonmo/practise/pkg/safemap"
+	"github.com/jursonmo/practise/pkg/udp"
 )
 
 const (
 	HeartBeatId = 0
 )
 
-var ErrInvalidData = errors.New("invalid data")
+var (
+	ErrInvalidData  = errors.New("invalid data")
+	ErrServerClosed = errors.New("server closed")
+	//ErrResumeWithoutAuth token 在auth 之前的握手里交换, 只有auth 得到的Identity 能证明是同一个client
+	ErrResumeWithoutAuth = errors.New("resume requires WithAuthenticator")
+)
 
 type Server struct {
 	sync.Mutex
@@ -24,43 +31,100 @@ type Server struct {
 	cancel context.CancelFunc
 	closed bool
 
-	server *dial.Server
+	server *dial.Server //tcp, tls
+	udp    *udpServer   //udp, see udp.go
+	lnOpts []dial.ServerOption
+
+	routers  *session.RouterRegister
+	sessions *safemap.SafeMap //SessionID -> *Session
+	pcOpts   []proto.ProtoConnOpt
+	logger   proto.Logger
+	authn    bool //配置了WithAuthenticator
+
+	//session resumption, see resume.go
+	resumeGrace      time.Duration
+	resumeMaxPending int
+	resumes          sync.Map //token -> *Session
 
-	routers *session.RouterRegister
+	//Stop 时发给所有session 的close code
+	stopCode int
+	stopMsg  string
 
 	//handlers
 	onConnect func(session.Sessioner)
 	onStop    func(session.Sessioner)
+	onClose   func(s session.Sessioner, code int, msg string)
+	onResume  func(session.Sessioner)
 }
 
-type Option func(*Server)
-
 func NewServer(endpoints []string, opts ...Option) (*Server, error) {
 	var err error
-	s := &Server{routers: session.NewRouterRegister()}
-	s.server, err = dial.NewServer(endpoints, dial.WithHandler(s.connHandle))
+	s := &Server{routers: session.NewRouterRegister(), sessions: safemap.NewSafeMap(),
+		stopCode: proto.CloseServiceRestart, stopMsg: "server stopping", logger: proto.NopLogger}
+	for _, opt := range opts {
+		opt(s)
+	}
+	//udp:// 的endpoint 由pkg/udp 监听, 其他的交给dial.Server
+	streamEndpoints, udpEndpoints, err := splitEndpoints(endpoints)
 	if err != nil {
 		return nil, err
 	}
-	for _, opt := range opts {
-		opt(s)
+	if len(streamEndpoints) > 0 {
+		s.server, err = dial.NewServer(streamEndpoints, append(s.lnOpts, dial.WithHandler(s.connHandle))...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(udpEndpoints) > 0 {
+		s.udp = &udpServer{endpoints: udpEndpoints, handler: s.connHandle, log: s.logger}
+	}
+	if s.resumeGrace > 0 {
+		if !s.authn {
+			return nil, ErrResumeWithoutAuth
+		}
+		//client 在握手的ping 里带上token, 用户可以用WithProtoConnOpts 设置自己的握手数据
+		s.pcOpts = append([]proto.ProtoConnOpt{proto.WithPacketHandshake()}, s.pcOpts...)
+		s.pcOpts = append(s.pcOpts, proto.WithResumeHandler(s.lookupResume))
 	}
 	return s, nil
 }
 
 func (s *Server) connHandle(conn net.Conn, listener_id int) error {
-	log.Printf("new conn:%v->%v", conn.LocalAddr(), conn.RemoteAddr())
-	pconn := proto.NewProtoConn(conn, true, nil)
+	s.logger.Debugf("new conn:%v->%v", conn.LocalAddr(), conn.RemoteAddr())
+	pcOpts := s.pcOpts
+	if _, ok := dial.UnwrapConn(conn).(*udp.UDPConn); ok {
+		pcOpts = append([]proto.ProtoConnOpt{proto.WithPacketHandshake()}, pcOpts...)
+	}
+	pconn := proto.NewProtoConn(conn, true, nil, pcOpts...)
 	err := pconn.Init(s.ctx)
 	if err != nil {
-		log.Println(err)
+		s.logger.Errorf("%v init err:%v", pconn, err)
+		pconn.Close()
 		return err
 	}
+	if pconn.Resumed() {
+		return s.resumeSession(pconn)
+	}
 
+	if err = pconn.AttachResume(); err != nil {
+		s.logger.Errorf("%v attach resume err:%v", pconn, err)
+		pconn.Close()
+		return err
+	}
 	session := NewSession(s, pconn)
+	session.rs = pconn.ResumeState()
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		pconn.WriteCloseMsg(s.stopCode, s.stopMsg)
+		pconn.Close()
+		return ErrServerClosed
+	}
+	s.addSession(session)
+	s.Unlock()
 	go session.Start(s.ctx)
 
-	log.Println("session start")
+	session.log.Infof("session start")
 	if s.onConnect != nil {
 		s.onConnect(session)
 	}
@@ -69,9 +133,34 @@ func (s *Server) connHandle(conn net.Conn, listener_id int) error {
 
 func (s *Server) Start(ctx context.Context) error {
 	s.ctx, s.cancel = context.WithCancel(ctx)
-	return s.server.Start(s.ctx)
+	if s.server != nil {
+		if err := s.server.Start(s.ctx); err != nil {
+			return err
+		}
+	}
+	if s.udp != nil {
+		if err := s.udp.start(s.ctx); err != nil {
+			s.stopListen()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) stopListen() {
+	if s.server != nil {
+		s.server.Stop()
+	}
+	if s.udp != nil {
+		s.udp.stop()
+	}
 }
 
+var DefaultStopTimeout = time.Second * 10
+
+//Stop 优雅退出: 停止accept, 给所有session 发送close code(默认CloseServiceRestart),
+//等待对端断开以及正在处理的消息处理完, 直到ctx 超时(ctx 没有deadline 就用DefaultStopTimeout), 然后强制关闭剩下的session;
+//强制关闭后还是要等session 结束(正在运行的handler 返回), Stop 返回后不会再调用onClose/onStop
 func (s *Server) Stop(ctx context.Context) error {
 	s.Lock()
 	if s.closed {
@@ -81,8 +170,56 @@ func (s *Server) Stop(ctx context.Context) error {
 	s.closed = true
 	s.Unlock()
 
+	//stop accepting, udp 的session 共用listener 的socket, 要等session 都结束后再关闭
+	if s.server != nil {
+		s.server.Stop()
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultStopTimeout)
+		defer cancel()
+	}
+
+	//挂起的session 直接结束, 其他的session 连接断开后也不再挂起
+	for _, ss := range s.Sessions() {
+		ss.cancelResume()
+	}
+	sessions := s.Sessions()
+	for _, ss := range sessions {
+		if _, err := ss.protoConn().WriteCloseMsg(s.stopCode, s.stopMsg); err != nil {
+			ss.log.Errorf("write close msg err:%v", err)
+		}
+	}
+
+	var err error
+	for _, ss := range sessions {
+		select {
+		case <-ss.Done():
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		//force close
+		left := s.Sessions()
+		s.logger.Errorf("server stop, %v, force close %d sessions", err, len(left))
+		for _, ss := range left {
+			ss.protoConn().Close()
+		}
+		for _, ss := range left {
+			<-ss.Done()
+		}
+	}
+
+	if s.udp != nil {
+		s.udp.stop()
+	}
 	if s.cancel != nil {
 		s.cancel()
 	}
-	return nil
+	return err
 }
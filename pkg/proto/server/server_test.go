@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jursonmo/practise/pkg/proto"
+	"github.com/jursonmo/practise/pkg/proto/session"
+)
+
+func TestStopDrain(t *testing.T) {
+	s, addr := startTestServer(t, WithStopCloseCode(proto.CloseTryAgainLater, "bye"))
+	c := dialTestClient(t, addr)
+	waitFor(t, "session", func() bool { return s.SessionNum() == 1 })
+
+	//client 收到close code 后断开, session 都结束后Stop 返回
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("Stop err:%v", err)
+	}
+	if err := <-c.runErr; !proto.IsCloseError(err, proto.CloseTryAgainLater) {
+		t.Fatalf("client should receive CloseTryAgainLater, err:%v", err)
+	}
+	if n := s.SessionNum(); n != 0 {
+		t.Fatalf("%d sessions left after Stop", n)
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	var stopped int32
+	s, addr := startTestServer(t, WithOnStop(func(session.Sessioner) { atomic.AddInt32(&stopped, 1) }))
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	s.AddRouter(20, session.HandleFunc(func(session.Sessioner, uint16, []byte) {
+		close(entered)
+		<-release
+	}))
+	c := dialTestClient(t, addr)
+	c.pc.WriteWithId(20, []byte("slow"))
+	<-entered
+
+	//handler 一直不返回, ctx 超时后强制关闭, 还要等handler 返回后Stop 才返回
+	time.AfterFunc(time.Millisecond*300, func() { close(release) })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	err := s.Stop(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect DeadlineExceeded, err:%v", err)
+	}
+	if cost := time.Since(start); cost < time.Millisecond*300 {
+		t.Fatalf("Stop returns before the session finished, cost:%v", cost)
+	}
+	if atomic.LoadInt32(&stopped) != 1 || s.SessionNum() != 0 {
+		t.Fatalf("onStop:%d, sessions:%d", atomic.LoadInt32(&stopped), s.SessionNum())
+	}
+}
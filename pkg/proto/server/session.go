@@ -5,9 +5,12 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jursonmo/practise/pkg/heartbeat"
 	"github.com/jursonmo/practise/pkg/proto"
@@ -20,14 +23,38 @@ type Session struct {
 	id   string
 	name string
 	srv  *Server
-	pc   *proto.ProtoConn
-	eg   *errgroup.Group
+	ctx  context.Context
+
+	mu       sync.Mutex
+	pc       *proto.ProtoConn //resume 后会换成新的连接
+	connDone chan struct{}    //当前连接的goroutine 都退出后close
 
 	routers *session.RouterRegister
+	calls   *session.Calls
+	done    chan struct{} //closed when the session finished
+	log     proto.Logger
+
+	//session resumption, see resume.go
+	rs        *proto.ResumeState
+	resumeMu  sync.Mutex
+	grace     *time.Timer
+	suspended bool
+	stopped   bool //不再挂起
+	finished  bool
 }
 
+//sessionSeq 保证SessionID 唯一, unix socket 的连接RemoteAddr 是空的, 只用地址会重复
+var sessionSeq uint64
+
 func NewSession(s *Server, pc *proto.ProtoConn) *Session {
-	ss := &Session{srv: s, pc: pc, name: "a session from server", routers: session.NewRouterRegister()}
+	ss := &Session{srv: s, pc: pc, name: "a session from server", routers: session.NewRouterRegister(), calls: session.NewCalls(), done: make(chan struct{})}
+	seq := atomic.AddUint64(&sessionSeq, 1)
+	if conn := pc.Conn(); conn != nil {
+		ss.id = fmt.Sprintf("%v->%v#%d", conn.LocalAddr(), conn.RemoteAddr(), seq)
+	} else {
+		ss.id = fmt.Sprintf("#%d", seq)
+	}
+	ss.log = proto.WithFields(pc.Logger(), "session", ss.id)
 	pc.SetMsgHandler(proto.ProtoMsgHandle(ss.msgHandle))
 	//设置了SetMsgHandlerv2, 上面设置的SetMsgHandler 就不起作用了
 	pc.SetMsgHandlerv2(proto.ProtoMsgHandlev2(ss.msgHandlev2))
@@ -35,7 +62,13 @@ func NewSession(s *Server, pc *proto.ProtoConn) *Session {
 }
 
 func (s *Session) String() string {
-	return fmt.Sprintf("name:%s, id:%s, %v", s.Name(), s.SessionID(), s.pc)
+	return fmt.Sprintf("name:%s, id:%s, %v", s.Name(), s.SessionID(), s.protoConn())
+}
+
+func (s *Session) protoConn() *proto.ProtoConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pc
 }
 
 func (s *Session) addRouter(id uint16, r session.Router) {
@@ -70,13 +103,16 @@ func (s *Session) msgHandle(pc *proto.ProtoConn, d []byte, t byte) error {
 func (s *Session) msgHandlev2(pc *proto.ProtoConn, pkg proto.Pkger) error {
 	msgid, ok := pkg.MsgId()
 	if !ok {
-		log.Println("session msgHandlev2 can't get msgid")
+		s.log.Errorf("session msgHandlev2 can't get msgid")
 		return nil
 	}
-	//log.Printf("session get msgid:%d", msgid)
+	if flag, callid, ok := pkg.CallId(); ok {
+		return s.handleCall(msgid, flag, callid, pkg.Type(), pkg.Paylaod())
+	}
 	//主要是 session 内部注册的私有数据处理，比如心跳处理
+	ss := session.WithPayloadType(s, pkg.Type())
 	if r := s.GetRouter(msgid); r != nil {
-		r.Handle(s, msgid, pkg.Paylaod())
+		r.Handle(ss, msgid, pkg.Paylaod())
 		return nil
 	}
 
@@ -85,28 +121,64 @@ func (s *Session) msgHandlev2(pc *proto.ProtoConn, pkg proto.Pkger) error {
 	if r == nil {
 		return nil
 	}
-	r.Handle(s, msgid, pkg.Paylaod())
+	r.Handle(ss, msgid, pkg.Paylaod())
 	return nil
 }
 
-func (s *Session) Start(ctx context.Context) error {
-	var egctx context.Context
-	s.eg, egctx = errgroup.WithContext(ctx) //要用c.ctx, 这样c.cancel 才能 取消egctx
-	s.eg.Go(func() error {
-		err := s.pc.Run(egctx)
-		log.Println(err)
+func (s *Session) handleCall(msgid uint16, flag byte, callid uint32, t byte, d []byte) error {
+	//对端的回应
+	if flag != proto.CallReq {
+		if !s.calls.Deliver(flag, callid, d) {
+			s.log.Errorf("drop call response, msgid:%d, callid:%d", msgid, callid)
+		}
+		return nil
+	}
+
+	r := s.GetRouter(msgid)
+	if r == nil {
+		r = s.srv.GetRouter(msgid)
+	}
+	err := session.HandleCall(session.WithPayloadType(s, t), r, msgid, d, func(id uint16, flag byte, t byte, resp []byte) error {
+		_, err := s.protoConn().WriteTypedCall(id, flag, t, callid, resp)
 		return err
 	})
+	if err != nil {
+		s.log.Errorf("reply call msgid:%d, callid:%d err:%v", msgid, callid, err)
+	}
+	return nil
+}
 
+func (s *Session) Start(ctx context.Context) error {
+	s.ctx = ctx
 	//注册heartbeat 处理请求回调，默认就是回应原始数据,类型是HeartBeatRespId
 	s.addRouter(uint16(session.HeartBeatReqId),
 		session.HandleFunc(func(s session.Sessioner, msgid uint16, d []byte) {
-			log.Printf("receive hb request:%s", string(d))
-			err := s.WriteMsg(session.HeartBeatRespId, d)
+			s.Logger().Debugf("receive hb request:%s", string(d))
+			err := s.WriteTypedMsg(session.HeartBeatRespId, session.PayloadType(s), d)
 			if err != nil {
-				log.Println(err)
+				s.Logger().Errorf("send hb response err:%v", err)
 			}
 		}))
+	s.serve(s.protoConn())
+	return nil
+}
+
+//serve 启动连接的读循环和心跳, 连接断开后结束session, 开启resume 时先挂起, 等client 重连, 见resume.go
+func (s *Session) serve(pc *proto.ProtoConn) {
+	eg, egctx := errgroup.WithContext(s.ctx) //要用server 的ctx, 这样server cancel 才能取消egctx
+	connDone := make(chan struct{})
+	s.mu.Lock()
+	s.connDone = connDone
+	s.mu.Unlock()
+
+	eg.Go(func() error {
+		err := pc.Run(egctx)
+		s.log.Infof("session quit, err:%v", err)
+		if !s.suspend(err) {
+			s.finish(err)
+		}
+		return err
+	})
 
 	//发送心跳
 	hbsend := func(req heartbeat.HbPkg) error {
@@ -117,43 +189,76 @@ func (s *Session) Start(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
-		log.Printf("send heartbeat req:%+v\n", req)
-		//_, err = s.pc.Write(buf.Bytes())
-		_, err = s.pc.WriteWithId(session.HeartBeatReqId, buf.Bytes())
+		s.log.Debugf("send heartbeat req:%+v", req)
+		_, err = pc.WriteWithType(session.HeartBeatReqId, proto.JSON, buf.Bytes())
 		return err
 	}
 
 	heartbeater := heartbeat.NewHeartbeat(s.name,
-		heartbeat.DefautConfig, hbsend)
+		heartbeat.DefautConfig, hbsend, heartbeat.WithSuccessHandler(func(name string, rtt time.Duration) {
+			pc.SetHeartbeatRTT(rtt)
+		}))
 
 	//注册心跳回应处理
-	s.addRouter(uint16(session.HeartBeatRespId), session.HandleFunc(func(s session.Sessioner, id uint16, d []byte) {
-		hb := heartbeat.HbPkg{}
-		err := json.Unmarshal(d, &hb)
-		if err != nil {
-			log.Println("handle hb response err:", err)
-			return
-		}
-		log.Printf("receive hb response:%+v\n", hb)
-		heartbeater.PutResponse(hb)
-	}))
+	session.Handle(s.routers, uint16(session.HeartBeatRespId), func(s session.Sessioner, hb *heartbeat.HbPkg) {
+		s.Logger().Debugf("receive hb response:%+v", *hb)
+		heartbeater.PutResponse(*hb)
+	})
 
-	s.eg.Go(func() error {
+	eg.Go(func() error {
 		err := heartbeater.Start(egctx)
-		log.Printf("heartbeat quit, err:%v", err)
+		s.log.Infof("heartbeat quit, err:%v", err)
 		return err
 	})
 
-	return nil
+	eg.Go(func() error {
+		<-egctx.Done()
+		pc.Close() //make pc.Run() quit
+		return egctx.Err()
+	})
+
+	go func() {
+		eg.Wait()
+		close(connDone)
+	}()
+}
+
+//finish 结束session, 只执行一次
+func (s *Session) finish(err error) {
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.mu.Unlock()
+	s.end(err)
+}
+
+func (s *Session) end(err error) {
+	s.calls.Close(err)
+	var ce *proto.CloseError
+	if errors.As(err, &ce) && s.srv.onClose != nil {
+		s.srv.onClose(s, ce.Code, ce.Msg)
+	}
+	//从server 的session 表里删除
+	s.srv.delSession(s)
+	close(s.done)
 }
 
 //实现session.Sessioner接口
 func (s *Session) UnderlayConn() net.Conn {
-	return s.pc.Conn()
+	return s.protoConn().Conn()
 }
 func (s *Session) SessionID() string {
 	return s.id
 }
+func (s *Session) Identity() *proto.Identity {
+	return s.protoConn().Identity()
+}
+func (s *Session) Logger() proto.Logger {
+	return s.log
+}
 
 func (s *Session) WriteMsg(msgid uint16, d []byte) error {
 	// 这里需要make 一个大的内存对象，还需要copy一次
@@ -167,14 +272,43 @@ func (s *Session) WriteMsg(msgid uint16, d []byte) error {
 }
 
 func (s *Session) WriteMsgv2(msgid uint16, d []byte) error {
-	_, err := s.pc.WriteWithId(msgid, d)
+	_, err := s.protoConn().WriteWithId(msgid, d)
 	return err
 }
+
+//Stats return the counters of the underlay ProtoConn
+func (s *Session) Stats() proto.Stats {
+	return s.protoConn().Stats()
+}
+
+func (s *Session) WriteTypedMsg(msgid uint16, t byte, d []byte) error {
+	_, err := s.protoConn().WriteWithType(msgid, t, d)
+	return err
+}
+
+//Call 发送请求并等待对端回应, 对端没有注册msgid 的router 时返回*session.NoRouterError
+func (s *Session) Call(ctx context.Context, msgid uint16, req []byte) ([]byte, error) {
+	return s.calls.Call(ctx, msgid, func(callid uint32) error {
+		_, err := s.protoConn().WriteCall(msgid, proto.CallReq, callid, req)
+		return err
+	})
+}
+
+//Done is closed when the session finished, all the msg handlers have returned.
+//开启resume 时连接断开后session 先挂起, 超时没有恢复才结束
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
 func (s *Session) Stop() {
-	log.Printf("session:%v, stopping...", s)
-	if s.srv.onStop != nil {
-		s.srv.onStop(s)
+	s.log.Infof("stopping...")
+	s.cancelResume()
+	s.mu.Lock()
+	pc, connDone := s.pc, s.connDone
+	s.mu.Unlock()
+	pc.Close()
+	if connDone != nil {
+		<-connDone
 	}
-	s.eg.Wait()
-	log.Printf("session:%v, stoped", s)
+	s.log.Infof("stoped")
 }
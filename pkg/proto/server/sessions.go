@@ -0,0 +1,66 @@
+package server
+
+func (s *Server) addSession(ss *Session) {
+	s.sessions.Set(ss.SessionID(), ss)
+	if ss.rs != nil {
+		s.resumes.Store(string(ss.rs.Token()), ss)
+	}
+}
+
+// session 的pc.Run 退出后调用
+func (s *Server) delSession(ss *Session) {
+	if v, ok := s.sessions.Get(ss.SessionID()); !ok || v != ss {
+		return
+	}
+	s.sessions.Del(ss.SessionID())
+	if ss.rs != nil {
+		s.resumes.Delete(string(ss.rs.Token()))
+	}
+	if s.onStop != nil {
+		s.onStop(ss)
+	}
+}
+
+func (s *Server) GetSession(id string) *Session {
+	v, ok := s.sessions.Get(id)
+	if !ok {
+		return nil
+	}
+	return v.(*Session)
+}
+
+// Sessions return a snapshot of live sessions
+func (s *Server) Sessions() []*Session {
+	ss := make([]*Session, 0, s.sessions.Size())
+	s.sessions.Range(func(key, val interface{}) bool {
+		ss = append(ss, val.(*Session))
+		return true
+	})
+	return ss
+}
+
+func (s *Server) SessionNum() int {
+	return s.sessions.Size()
+}
+
+// Broadcast 发送消息给所有的session, 返回发送成功的session 数量
+func (s *Server) Broadcast(msgid uint16, d []byte) int {
+	return s.Multicast(nil, msgid, d)
+}
+
+// Multicast 发送消息给filter 返回true 的session, filter 为nil 表示所有session, 返回发送成功的session 数量.
+// 每个session 都走WriteMsg, 各自检查能力, 压缩, udp 报文大小, 统计, 开启resume 的还会记录seq
+func (s *Server) Multicast(filter func(*Session) bool, msgid uint16, d []byte) int {
+	n := 0
+	for _, ss := range s.Sessions() {
+		if filter != nil && !filter(ss) {
+			continue
+		}
+		if err := ss.WriteMsg(msgid, d); err != nil {
+			ss.log.Errorf("Multicast msgid:%d, err:%v", msgid, err)
+			continue
+		}
+		n++
+	}
+	return n
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jursonmo/practise/pkg/proto"
+	"github.com/jursonmo/practise/pkg/proto/session"
+)
+
+func startTestServer(t *testing.T, opts ...Option) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	s, err := NewServer([]string{"tcp://" + addr}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Stop(ctx)
+	})
+	return s, addr
+}
+
+//testClient 直接用ProtoConn 连接server, 记录收到的消息
+type testClient struct {
+	pc     *proto.ProtoConn
+	runErr chan error
+
+	mu   sync.Mutex
+	msgs map[uint16][]string
+}
+
+func dialTestClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{runErr: make(chan error, 1), msgs: make(map[uint16][]string)}
+	c.pc = proto.NewProtoConn(conn, false, nil)
+	c.pc.SetMsgHandlerv2(func(pc *proto.ProtoConn, pkg proto.Pkger) error {
+		id, _ := pkg.MsgId()
+		c.mu.Lock()
+		c.msgs[id] = append(c.msgs[id], string(pkg.Paylaod()))
+		c.mu.Unlock()
+		return nil
+	})
+	if err = c.pc.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	go func() { c.runErr <- c.pc.Run(context.Background()) }()
+	t.Cleanup(func() { c.pc.Close() })
+	return c
+}
+
+func (c *testClient) received(msgid uint16) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.msgs[msgid]...)
+}
+
+//waitFor 最多等1s
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; !cond(); i++ {
+		if i > 100 {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestSessionRegistry(t *testing.T) {
+	var mu sync.Mutex
+	var stopped []string
+	s, addr := startTestServer(t, WithOnStop(func(ss session.Sessioner) {
+		mu.Lock()
+		stopped = append(stopped, ss.SessionID())
+		mu.Unlock()
+	}))
+	c1 := dialTestClient(t, addr)
+	dialTestClient(t, addr)
+	waitFor(t, "2 sessions", func() bool { return s.SessionNum() == 2 })
+
+	var first *Session
+	for _, ss := range s.Sessions() {
+		if s.GetSession(ss.SessionID()) != ss {
+			t.Fatalf("GetSession(%s) mismatch", ss.SessionID())
+		}
+		if ss.UnderlayConn().RemoteAddr().String() == c1.pc.Conn().LocalAddr().String() {
+			first = ss
+		}
+	}
+	if first == nil {
+		t.Fatal("session of c1 not found")
+	}
+
+	//连接关闭后从表里删除, 并调用onStop
+	c1.pc.Close()
+	waitFor(t, "session removed", func() bool { return s.SessionNum() == 1 })
+	if s.GetSession(first.SessionID()) != nil {
+		t.Fatal("closed session is still registered")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(stopped) != 1 || stopped[0] != first.SessionID() {
+		t.Fatalf("onStop:%v", stopped)
+	}
+}
+
+func TestMulticast(t *testing.T) {
+	s, addr := startTestServer(t)
+	clients := []*testClient{dialTestClient(t, addr), dialTestClient(t, addr), dialTestClient(t, addr)}
+	waitFor(t, "3 sessions", func() bool { return s.SessionNum() == 3 })
+	byClient := func(c *testClient) *Session {
+		for _, ss := range s.Sessions() {
+			if ss.UnderlayConn().RemoteAddr().String() == c.pc.Conn().LocalAddr().String() {
+				return ss
+			}
+		}
+		t.Fatal("session not found")
+		return nil
+	}
+
+	//只发给clients[1]
+	target := byClient(clients[1])
+	if n := s.Multicast(func(ss *Session) bool { return ss == target }, 20, []byte("one")); n != 1 {
+		t.Fatalf("Multicast sent to %d sessions", n)
+	}
+	waitFor(t, "multicast msg", func() bool { return len(clients[1].received(20)) == 1 })
+
+	//关闭的session 跳过, 不算在返回值里
+	byClient(clients[2]).protoConn().Close()
+	if n := s.Broadcast(21, []byte("all")); n != 2 {
+		t.Fatalf("Broadcast sent to %d sessions", n)
+	}
+	for _, c := range clients[:2] {
+		waitFor(t, "broadcast msg", func() bool { return len(c.received(21)) == 1 })
+	}
+	time.Sleep(time.Millisecond * 50)
+	for i, c := range clients {
+		if got := c.received(20); i != 1 && len(got) != 0 {
+			t.Fatalf("client %d received multicast:%v", i, got)
+		}
+	}
+	if got := clients[2].received(21); len(got) != 0 {
+		t.Fatalf("closed session received broadcast:%v", got)
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/jursonmo/practise/pkg/dial"
+	"github.com/jursonmo/practise/pkg/proto"
+	"github.com/jursonmo/practise/pkg/udp"
+)
+
+//splitEndpoints 把udp:// 的endpoint 分出来
+func splitEndpoints(endpoints []string) (stream []string, udps []*url.URL, err error) {
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, nil, err
+		}
+		if strings.HasPrefix(u.Scheme, "udp") {
+			udps = append(udps, u)
+			continue
+		}
+		stream = append(stream, endpoint)
+	}
+	return
+}
+
+//udpServer 用pkg/udp 监听, 每个对端地址是一个UDPConn, 跟dial.Server 一样交给handler
+type udpServer struct {
+	sync.Mutex
+	endpoints []*url.URL
+	handler   dial.ConnHandler
+	lns       []*udp.UdpListen
+	log       proto.Logger
+}
+
+func (us *udpServer) start(ctx context.Context) error {
+	for _, endpoint := range us.endpoints {
+		ln, err := udp.NewUdpListen(ctx, endpoint.Scheme, endpoint.Host)
+		if err != nil {
+			return fmt.Errorf("listen %s err:%w", endpoint, err)
+		}
+		us.Lock()
+		us.lns = append(us.lns, ln)
+		lnID := len(us.lns) - 1
+		us.Unlock()
+		go us.accept(lnID, ln)
+	}
+	return nil
+}
+
+func (us *udpServer) accept(lnID int, ln *udp.UdpListen) {
+	us.log.Infof("udp server(%d) listen at %s", lnID, ln.Addr())
+	defer us.log.Infof("udp server(%d) %s out service", lnID, ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go us.handler(conn, lnID)
+	}
+}
+
+func (us *udpServer) stop() {
+	us.Lock()
+	defer us.Unlock()
+	for _, ln := range us.lns {
+		ln.Close()
+	}
+	us.lns = nil
+}
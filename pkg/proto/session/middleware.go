@@ -0,0 +1,205 @@
+package session
+
+import (
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jursonmo/practise/pkg/tokenbucket"
+)
+
+//Middleware 包装Router, 可以在RouterRegister.Use 全局注册, 也可以在AddRouter 时给某个msgid 注册
+type Middleware func(Router) Router
+
+//Chain 组合多个Middleware, 第一个在最外层
+func Chain(mws ...Middleware) Middleware {
+	return func(r Router) Router {
+		for i := len(mws) - 1; i >= 0; i-- {
+			r = mws[i](r)
+		}
+		return r
+	}
+}
+
+//Recover handler panic 时不会让ProtoConn.Run 退出, onPanic 为nil 时用session 的Logger 打印日志和堆栈
+func Recover(onPanic func(s Sessioner, msgid uint16, p interface{})) Middleware {
+	return func(next Router) Router {
+		return HandleFunc(func(s Sessioner, id uint16, d []byte) {
+			defer func() {
+				if p := recover(); p != nil {
+					if onPanic != nil {
+						onPanic(s, id, p)
+						return
+					}
+					s.Logger().Errorf("msgid:%d, handler panic:%v\n%s", id, p, debug.Stack())
+				}
+			}()
+			next.Handle(s, id, d)
+		})
+	}
+}
+
+//SlowLog handler 耗时超过threshold 就打印日志
+func SlowLog(threshold time.Duration) Middleware {
+	return func(next Router) Router {
+		return HandleFunc(func(s Sessioner, id uint16, d []byte) {
+			start := time.Now()
+			next.Handle(s, id, d)
+			if cost := time.Since(start); cost > threshold {
+				s.Logger().Infof("msgid:%d, len:%d, slow handler cost:%v", id, len(d), cost)
+			}
+		})
+	}
+}
+
+//RateLimitKey 决定消息用哪个bucket 限速, key 相同的消息共享一个bucket
+type RateLimitKey func(s Sessioner, msgid uint16) string
+
+//SessionMsgIdKey 每个session 的每个msgid 一个bucket, 一个client 发得太多不会影响其他client
+func SessionMsgIdKey(s Sessioner, msgid uint16) string {
+	return s.SessionID() + "/" + strconv.Itoa(int(msgid))
+}
+
+//MsgIdKey 每个msgid 一个bucket, 所有session 共享, 用来限制整个server 的处理速度
+func MsgIdKey(s Sessioner, msgid uint16) string {
+	return strconv.Itoa(int(msgid))
+}
+
+//RateLimit token bucket 限速, 每个session 的每个msgid 一个bucket, 见RateLimitBy
+func RateLimit(rate float64, burst int, onLimit func(s Sessioner, msgid uint16, d []byte)) Middleware {
+	return RateLimitBy(SessionMsgIdKey, rate, burst, onLimit)
+}
+
+//rateBucket 记录最近一次使用的时间, 空闲到token 补满的bucket 跟新建的一样, 可以删掉
+type rateBucket struct {
+	b    *tokenbucket.Bucket
+	used time.Time
+}
+
+//RateLimitBy token bucket 限速, key 返回相同的消息共享一个bucket; 超过限速的消息交给onLimit, onLimit 可以为nil.
+//bucket 在这里创建, Use 重新包装router 时不会重置; 空闲的bucket(比如session 已经断开) 会被删掉;
+//心跳等MaxPrivateId 以下的msgid 不限速, 否则限速会让连接断开
+func RateLimitBy(key RateLimitKey, rate float64, burst int, onLimit func(s Sessioner, msgid uint16, d []byte)) Middleware {
+	var mu sync.Mutex
+	var lastSweep time.Time
+	buckets := make(map[string]*rateBucket)
+	//token 补满需要的时间, rate<=0 时不会补充, 不能删
+	var idle time.Duration
+	if rate > 0 {
+		idle = time.Duration(float64(burst) / rate * float64(time.Second))
+		if idle < time.Second {
+			idle = time.Second
+		}
+	}
+	bucket := func(k string) *tokenbucket.Bucket {
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		if idle > 0 && now.Sub(lastSweep) > idle {
+			lastSweep = now
+			for k, rb := range buckets {
+				if now.Sub(rb.used) > idle {
+					delete(buckets, k)
+				}
+			}
+		}
+		rb := buckets[k]
+		if rb == nil {
+			rb = &rateBucket{b: tokenbucket.New(rate, burst)}
+			buckets[k] = rb
+		}
+		rb.used = now
+		return rb.b
+	}
+	return func(next Router) Router {
+		return HandleFunc(func(s Sessioner, id uint16, d []byte) {
+			if id < MaxPrivateId {
+				next.Handle(s, id, d)
+				return
+			}
+			if !bucket(key(s, id)).Allow() {
+				if onLimit != nil {
+					onLimit(s, id, d)
+				}
+				return
+			}
+			next.Handle(s, id, d)
+		})
+	}
+}
+
+var DefaultLatencyBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second,
+}
+
+//LatencyHistogram 按msgid 统计handler 的耗时分布
+type LatencyHistogram struct {
+	buckets []time.Duration
+	hists   sync.Map //msgid -> *histogram
+}
+
+type histogram struct {
+	counts []uint64 //len(buckets)+1, 最后一个是超过最大bucket 的
+	count  uint64
+	sum    int64
+}
+
+//HistogramSnapshot Counts[i] 是耗时<=Buckets[i] 的次数(不累加), Counts[len(Buckets)] 是超过最大bucket 的次数
+type HistogramSnapshot struct {
+	Buckets []time.Duration
+	Counts  []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+//NewLatencyHistogram buckets 为空时用DefaultLatencyBuckets
+func NewLatencyHistogram(buckets ...time.Duration) *LatencyHistogram {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	bs := append([]time.Duration(nil), buckets...)
+	sort.Slice(bs, func(i, j int) bool { return bs[i] < bs[j] })
+	return &LatencyHistogram{buckets: bs}
+}
+
+func (lh *LatencyHistogram) Middleware() Middleware {
+	return func(next Router) Router {
+		return HandleFunc(func(s Sessioner, id uint16, d []byte) {
+			start := time.Now()
+			next.Handle(s, id, d)
+			lh.Observe(id, time.Since(start))
+		})
+	}
+}
+
+func (lh *LatencyHistogram) Observe(msgid uint16, cost time.Duration) {
+	v, ok := lh.hists.Load(msgid)
+	if !ok {
+		v, _ = lh.hists.LoadOrStore(msgid, &histogram{counts: make([]uint64, len(lh.buckets)+1)})
+	}
+	h := v.(*histogram)
+	i := sort.Search(len(lh.buckets), func(i int) bool { return cost <= lh.buckets[i] })
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(cost))
+}
+
+//Snapshot 返回每个msgid 的统计
+func (lh *LatencyHistogram) Snapshot() map[uint16]HistogramSnapshot {
+	m := make(map[uint16]HistogramSnapshot)
+	lh.hists.Range(func(k, v interface{}) bool {
+		h := v.(*histogram)
+		hs := HistogramSnapshot{Buckets: lh.buckets, Counts: make([]uint64, len(h.counts)),
+			Count: atomic.LoadUint64(&h.count), Sum: time.Duration(atomic.LoadInt64(&h.sum))}
+		for i := range h.counts {
+			hs.Counts[i] = atomic.LoadUint64(&h.counts[i])
+		}
+		m[k.(uint16)] = hs
+		return true
+	})
+	return m
+}
@@ -0,0 +1,116 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	var trace []string
+	mark := func(name string) Middleware {
+		return func(next Router) Router {
+			return HandleFunc(func(s Sessioner, id uint16, d []byte) {
+				trace = append(trace, name)
+				next.Handle(s, id, d)
+			})
+		}
+	}
+	rr := NewRouterRegister()
+	rr.AddRouter(11, HandleFunc(func(Sessioner, uint16, []byte) { trace = append(trace, "h") }), mark("m1"), mark("m2"))
+	//Use 对已经注册的router 也起作用, 在per msgid middlewares 外面
+	rr.Use(mark("g"))
+	rr.GetRouter(11).Handle(&BaseSession{}, 11, nil)
+	if got := trace; len(got) != 4 || got[0] != "g" || got[1] != "m1" || got[2] != "m2" || got[3] != "h" {
+		t.Fatalf("trace:%v", got)
+	}
+}
+
+func TestRecoverAndRateLimit(t *testing.T) {
+	var recovered interface{}
+	limited := 0
+	lh := NewLatencyHistogram(time.Millisecond, time.Second)
+	rr := NewRouterRegister()
+	rr.Use(Recover(func(s Sessioner, id uint16, p interface{}) { recovered = p }), lh.Middleware())
+	rr.AddRouter(11, HandleFunc(func(Sessioner, uint16, []byte) { panic("boom") }))
+	rr.AddRouter(12, HandleFunc(func(Sessioner, uint16, []byte) {}),
+		RateLimit(1, 2, func(Sessioner, uint16, []byte) { limited++ }))
+
+	s := &BaseSession{}
+	rr.GetRouter(11).Handle(s, 11, nil)
+	if recovered != "boom" {
+		t.Fatalf("recovered:%v", recovered)
+	}
+	for i := 0; i < 5; i++ {
+		rr.GetRouter(12).Handle(s, 12, nil)
+	}
+	if limited != 3 {
+		t.Fatalf("burst 2, limited:%d", limited)
+	}
+	snap := lh.Snapshot()
+	if snap[12].Count != 5 || snap[12].Counts[0] != 5 {
+		t.Fatalf("msgid 12 histogram:%+v", snap[12])
+	}
+}
+
+func TestRateLimitKeepBucket(t *testing.T) {
+	limited := 0
+	rr := NewRouterRegister()
+	rr.Use(RateLimit(1, 2, func(Sessioner, uint16, []byte) { limited++ }))
+	rr.AddRouter(HeartBeatReqId, HandleFunc(func(Sessioner, uint16, []byte) {}))
+	rr.AddRouter(12, HandleFunc(func(Sessioner, uint16, []byte) {}))
+
+	s := &BaseSession{}
+	for i := 0; i < 3; i++ {
+		rr.GetRouter(12).Handle(s, 12, nil)
+	}
+	//Use 重新包装router, bucket 不能被重置
+	rr.Use(func(next Router) Router { return next })
+	rr.GetRouter(12).Handle(s, 12, nil)
+	if limited != 2 {
+		t.Fatalf("burst 2, limited:%d", limited)
+	}
+	//心跳不限速
+	for i := 0; i < 5; i++ {
+		rr.GetRouter(HeartBeatReqId).Handle(s, HeartBeatReqId, nil)
+	}
+	if limited != 2 {
+		t.Fatalf("heartbeat should not be limited, limited:%d", limited)
+	}
+}
+
+type idSession struct {
+	BaseSession
+	id string
+}
+
+func (s *idSession) SessionID() string {
+	return s.id
+}
+
+func TestRateLimitPerSession(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		mw     func(onLimit func(Sessioner, uint16, []byte)) Middleware
+		expect int
+	}{
+		//一个session 超过限速不影响其他session
+		{"session", func(onLimit func(Sessioner, uint16, []byte)) Middleware { return RateLimit(1, 2, onLimit) }, 1},
+		{"msgid", func(onLimit func(Sessioner, uint16, []byte)) Middleware { return RateLimitBy(MsgIdKey, 1, 2, onLimit) }, 3},
+	} {
+		limited := map[string]int{}
+		rr := NewRouterRegister()
+		rr.Use(c.mw(func(s Sessioner, _ uint16, _ []byte) { limited[s.SessionID()]++ }))
+		rr.AddRouter(12, HandleFunc(func(Sessioner, uint16, []byte) {}))
+
+		noisy, quiet := &idSession{id: "noisy"}, &idSession{id: "quiet"}
+		for i := 0; i < 3; i++ {
+			rr.GetRouter(12).Handle(noisy, 12, nil)
+		}
+		for i := 0; i < 2; i++ {
+			rr.GetRouter(12).Handle(quiet, 12, nil)
+		}
+		if limited["noisy"]+limited["quiet"] != c.expect {
+			t.Fatalf("%s: limited:%v", c.name, limited)
+		}
+	}
+}
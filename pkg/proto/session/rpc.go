@@ -0,0 +1,184 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jursonmo/practise/pkg/proto"
+)
+
+var DefaultCallTimeout = time.Second * 10
+
+var (
+	ErrNoRouter      = errors.New("peer has no router")
+	ErrSessionClosed = errors.New("session closed")
+	ErrNotCall       = errors.New("not a call request")
+	ErrReplied       = errors.New("call already replied")
+)
+
+// NoRouterError is returned by Call when the peer has no router for the msgid
+type NoRouterError struct {
+	MsgId uint16
+}
+
+func (e *NoRouterError) Error() string {
+	return fmt.Sprintf("%v for msgid:%d", ErrNoRouter, e.MsgId)
+}
+
+func (e *NoRouterError) Is(target error) bool {
+	return target == ErrNoRouter
+}
+
+type callResult struct {
+	flag byte
+	data []byte
+}
+
+// Calls 记录等待回应的请求, 每个连接(session)一个
+type Calls struct {
+	seq     uint32
+	mu      sync.Mutex
+	err     error
+	pending map[uint32]chan callResult
+}
+
+func NewCalls() *Calls {
+	return &Calls{pending: make(map[uint32]chan callResult)}
+}
+
+//send 用分配好的callid 发送请求, 等待回应直到ctx 结束, ctx 没有deadline 就用DefaultCallTimeout
+func (cs *Calls) Call(ctx context.Context, msgid uint16, send func(callid uint32) error) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCallTimeout)
+		defer cancel()
+	}
+
+	ch := make(chan callResult, 1)
+	cs.mu.Lock()
+	if cs.err != nil {
+		cs.mu.Unlock()
+		return nil, cs.err
+	}
+	callid := atomic.AddUint32(&cs.seq, 1)
+	cs.pending[callid] = ch
+	cs.mu.Unlock()
+
+	defer func() {
+		cs.mu.Lock()
+		delete(cs.pending, callid)
+		cs.mu.Unlock()
+	}()
+
+	if err := send(callid); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return nil, cs.closeErr()
+		}
+		if res.flag == proto.CallRespNoRouter {
+			return nil, &NoRouterError{MsgId: msgid}
+		}
+		return res.data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//Deliver 把回应交给等待的Call, 返回false 表示没有对应的请求(可能已经超时)
+func (cs *Calls) Deliver(flag byte, callid uint32, d []byte) bool {
+	cs.mu.Lock()
+	ch, ok := cs.pending[callid]
+	if ok {
+		delete(cs.pending, callid)
+	}
+	cs.mu.Unlock()
+	if !ok {
+		return false
+	}
+	//d 可能在pool buffer 里(proto.WithPkgRelease), 交给别的goroutine 前先复制
+	ch <- callResult{flag: flag, data: append([]byte(nil), d...)}
+	return true
+}
+
+//Close 让所有等待中的Call 返回err, 之后的Call 直接返回err
+func (cs *Calls) Close(err error) {
+	if err == nil {
+		err = ErrSessionClosed
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.err != nil {
+		return
+	}
+	cs.err = err
+	for id, ch := range cs.pending {
+		close(ch)
+		delete(cs.pending, id)
+	}
+}
+
+func (cs *Calls) closeErr() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.err
+}
+
+// Replier 处理Call 请求时router 收到的Sessioner 实现了Replier, 用Reply/ReplyTyped 回应
+type Replier interface {
+	ReplyTyped(t byte, d []byte) error
+}
+
+//Reply 回应router 正在处理的Call 请求, s 不是Call 请求时返回ErrNotCall
+func Reply(s Sessioner, d []byte) error {
+	return ReplyTyped(s, proto.RawBinary, d)
+}
+
+//ReplyTyped 回应带上payload type, 见typed.go 的ReplyMsg
+func ReplyTyped(s Sessioner, t byte, d []byte) error {
+	r, ok := s.(Replier)
+	if !ok {
+		return ErrNotCall
+	}
+	return r.ReplyTyped(t, d)
+}
+
+// callSession 包装Sessioner, 只有ReplyTyped 发送回应, WriteMsg 等还是普通的消息;
+// handler 可以把它交给别的goroutine, 在handler 返回后再回应, 只能回应一次
+type callSession struct {
+	Sessioner
+	msgid uint16
+	once  sync.Once
+	reply func(msgid uint16, flag byte, t byte, d []byte) error
+}
+
+func (s *callSession) ReplyTyped(t byte, d []byte) error {
+	err := ErrReplied
+	s.once.Do(func() {
+		err = s.reply(s.msgid, proto.CallRespOk, t, d)
+	})
+	return err
+}
+
+func (s *callSession) PayloadType() byte {
+	return PayloadType(s.Sessioner)
+}
+
+//HandleCall 处理对端的Call 请求: 没有router 回应CallRespNoRouter, 否则由handler 调用Reply 回应,
+//handler 一直不回应的话, 对端的Call 会超时.
+//注意: handler 在ProtoConn.Run 的goroutine 里执行时(没有用proto.WithDispatch), handler 里同步地Call 对端会
+//一直等到超时, 因为回应要等handler 返回后才能读到; 要在handler 里Call 就开一个goroutine 或者用WithDispatch
+func HandleCall(s Sessioner, r Router, msgid uint16, d []byte, reply func(msgid uint16, flag byte, t byte, d []byte) error) error {
+	if r == nil {
+		return reply(msgid, proto.CallRespNoRouter, proto.RawBinary, nil)
+	}
+	r.Handle(&callSession{Sessioner: s, msgid: msgid, reply: reply}, msgid, d)
+	return nil
+}
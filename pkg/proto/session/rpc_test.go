@@ -0,0 +1,114 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jursonmo/practise/pkg/proto"
+)
+
+func TestCalls(t *testing.T) {
+	cs := NewCalls()
+	ctx := context.Background()
+
+	//1. response delivered
+	resp, err := cs.Call(ctx, 11, func(callid uint32) error {
+		go cs.Deliver(proto.CallRespOk, callid, []byte("ok"))
+		return nil
+	})
+	if err != nil || string(resp) != "ok" {
+		t.Fatalf("resp:%s, err:%v", resp, err)
+	}
+
+	//2. peer has no router
+	_, err = cs.Call(ctx, 12, func(callid uint32) error {
+		go cs.Deliver(proto.CallRespNoRouter, callid, nil)
+		return nil
+	})
+	var nr *NoRouterError
+	if !errors.As(err, &nr) || nr.MsgId != 12 || !errors.Is(err, ErrNoRouter) {
+		t.Fatalf("expect NoRouterError, err:%v", err)
+	}
+
+	//3. ctx timeout, the late response is dropped
+	var lateId uint32
+	tctx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer cancel()
+	_, err = cs.Call(tctx, 13, func(callid uint32) error {
+		lateId = callid
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect DeadlineExceeded, err:%v", err)
+	}
+	if cs.Deliver(proto.CallRespOk, lateId, nil) {
+		t.Fatal("late response should be dropped")
+	}
+
+	//4. Close make pending call return
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cs.Close(nil)
+	}()
+	_, err = cs.Call(ctx, 14, func(callid uint32) error { return nil })
+	if !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("expect ErrSessionClosed, err:%v", err)
+	}
+	if _, err = cs.Call(ctx, 14, func(callid uint32) error { return nil }); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("call after Close, expect ErrSessionClosed, err:%v", err)
+	}
+}
+
+type reply struct {
+	flag byte
+	t    byte
+	d    string
+}
+
+func TestHandleCall(t *testing.T) {
+	replies := make(chan reply, 4)
+	replyFunc := func(msgid uint16, flag byte, pt byte, d []byte) error {
+		replies <- reply{flag, pt, string(d)}
+		return nil
+	}
+	s := &loopSession{rr: NewRouterRegister()}
+
+	//1. WriteMsg 是普通消息, 只有Reply 才是回应, 只能回应一次
+	var writeErr, replyErr, againErr error
+	HandleCall(s, HandleFunc(func(s Sessioner, id uint16, d []byte) {
+		writeErr = s.WriteMsg(id, d)
+		replyErr = ReplyMsg(s, "json", &typedReq{Name: "a"})
+		againErr = Reply(s, []byte("again"))
+	}), 11, []byte("req"), replyFunc)
+	if !errors.Is(writeErr, ErrNonImplement) || replyErr != nil || !errors.Is(againErr, ErrReplied) {
+		t.Fatalf("writeErr:%v, replyErr:%v, againErr:%v", writeErr, replyErr, againErr)
+	}
+	if r := <-replies; r.flag != proto.CallRespOk || r.t != proto.JSON || r.d != `{"name":"a"}` {
+		t.Fatalf("unexpect reply:%+v", r)
+	}
+
+	//2. handler 返回后在别的goroutine 回应, 不会先回应一个空的
+	var later Sessioner
+	HandleCall(s, HandleFunc(func(s Sessioner, id uint16, d []byte) { later = s }), 11, nil, replyFunc)
+	select {
+	case r := <-replies:
+		t.Fatalf("unexpect reply before Reply:%+v", r)
+	default:
+	}
+	go Reply(later, []byte("later"))
+	if r := <-replies; r.d != "later" || r.t != proto.RawBinary {
+		t.Fatalf("unexpect reply:%+v", r)
+	}
+
+	//3. no router
+	HandleCall(s, nil, 11, nil, replyFunc)
+	if r := <-replies; r.flag != proto.CallRespNoRouter {
+		t.Fatalf("expect CallRespNoRouter, got:%+v", r)
+	}
+
+	if err := Reply(s, nil); !errors.Is(err, ErrNotCall) {
+		t.Fatalf("expect ErrNotCall, err:%v", err)
+	}
+}
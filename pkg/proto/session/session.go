@@ -1,17 +1,20 @@
 package session
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"net/url"
 	"sync"
+
+	"github.com/jursonmo/practise/pkg/proto"
 )
 
 const (
 	HeartBeatReqId  = 0
 	HeartBeatRespId = 1
-	MaxPrivateId    = 10
+	MaxPrivateId    = proto.MaxPrivateMsgId
 )
 
 type Sessioner interface {
@@ -20,6 +23,14 @@ type Sessioner interface {
 	UnderlayConn() net.Conn
 	Endpoints() []*url.URL
 	WriteMsg(uint16, []byte) error
+	//WriteTypedMsg 设置payload type, 见typed.go
+	WriteTypedMsg(msgid uint16, t byte, d []byte) error
+	//Call 等对端的router 用Reply 回应, 见rpc.go; 不要在Run goroutine 里执行的handler 里同步调用
+	Call(ctx context.Context, msgid uint16, req []byte) ([]byte, error)
+	//Identity 对端通过验证后的身份, 没有验证返回nil
+	Identity() *proto.Identity
+	//Logger 带session 字段的Logger, 见proto.Logger
+	Logger() proto.Logger
 }
 
 type BaseSession struct{}
@@ -43,6 +54,18 @@ func (bs *BaseSession) Endpoints() []*url.URL {
 func (bs *BaseSession) WriteMsg(id uint16, d []byte) error {
 	return ErrNonImplement
 }
+func (bs *BaseSession) WriteTypedMsg(id uint16, t byte, d []byte) error {
+	return ErrNonImplement
+}
+func (bs *BaseSession) Call(ctx context.Context, id uint16, req []byte) ([]byte, error) {
+	return nil, ErrNonImplement
+}
+func (bs *BaseSession) Identity() *proto.Identity {
+	return nil
+}
+func (bs *BaseSession) Logger() proto.Logger {
+	return proto.NopLogger
+}
 
 type Router interface {
 	Handle(Sessioner, uint16, []byte)
@@ -56,24 +79,52 @@ func (h HandleFunc) Handle(s Sessioner, id uint16, d []byte) {
 
 type RouterRegister struct {
 	sync.RWMutex
-	routers map[uint16]Router
+	routers map[uint16]*route
+	mws     []Middleware //global middlewares, see middleware.go
+}
+
+//route 保存注册的router 和它的middlewares, wrapped 是包装好的, 注册时生成, 处理消息时不用再组合
+type route struct {
+	r       Router
+	mws     []Middleware
+	wrapped Router
 }
 
 func NewRouterRegister() *RouterRegister {
-	return &RouterRegister{routers: make(map[uint16]Router)}
+	return &RouterRegister{routers: make(map[uint16]*route)}
 }
 
-func (rr *RouterRegister) AddRouter(id uint16, r Router) error {
+//AddRouter mws 只作用于这个msgid, 在全局的middlewares 里面
+func (rr *RouterRegister) AddRouter(id uint16, r Router, mws ...Middleware) error {
 	rr.Lock()
 	defer rr.Unlock()
-	rr.routers[id] = r
+	rt := &route{r: r, mws: mws}
+	rr.wrap(rt)
+	rr.routers[id] = rt
 	return nil
 }
 
+//Use 注册全局的middlewares, 对已经注册和以后注册的router 都起作用
+func (rr *RouterRegister) Use(mws ...Middleware) {
+	rr.Lock()
+	defer rr.Unlock()
+	rr.mws = append(rr.mws, mws...)
+	for _, rt := range rr.routers {
+		rr.wrap(rt)
+	}
+}
+
+func (rr *RouterRegister) wrap(rt *route) {
+	rt.wrapped = Chain(rr.mws...)(Chain(rt.mws...)(rt.r))
+}
+
 func (rr *RouterRegister) GetRouter(id uint16) Router {
 	rr.RLock()
 	defer rr.RUnlock()
-	return rr.routers[id]
+	if rt := rr.routers[id]; rt != nil {
+		return rt.wrapped
+	}
+	return nil
 }
 
 var ErrMsgId error
@@ -0,0 +1,104 @@
+package session
+
+import (
+	"fmt"
+
+	"github.com/jursonmo/practise/pkg/encoding"
+	"github.com/jursonmo/practise/pkg/proto"
+)
+
+//RouterAdder RouterRegister, server.Server, client.Client 都实现了
+type RouterAdder interface {
+	AddRouter(id uint16, r Router, mws ...Middleware) error
+}
+
+var (
+	//DecodeErrorHandler Handle 注册的router 解码失败时调用
+	DecodeErrorHandler = func(s Sessioner, msgid uint16, err error) {
+		s.Logger().Errorf("msgid:%d, decode err:%v", msgid, err)
+	}
+	//RawCodec 对端没有设置payload type(RawBinary) 时用来解码的codec, 兼容以前直接用WriteMsg 发json 的对端
+	RawCodec = "json"
+)
+
+//Handle 注册类型化的router, payload 按消息的payload type 对应的codec 解码成*T 再交给h
+func Handle[T any](ra RouterAdder, msgid uint16, h func(s Sessioner, req *T), mws ...Middleware) error {
+	return ra.AddRouter(msgid, HandleFunc(func(s Sessioner, id uint16, d []byte) {
+		req := new(T)
+		if err := Decode(s, d, req); err != nil {
+			DecodeErrorHandler(s, id, err)
+			return
+		}
+		h(s, req)
+	}), mws...)
+}
+
+//Decode 按s 里当前消息的payload type 解码
+func Decode(s Sessioner, d []byte, v interface{}) error {
+	t := PayloadType(s)
+	name := proto.GetPayloadTypeName(t)
+	if t == proto.RawBinary {
+		if _, ok := v.(*[]byte); !ok {
+			name = RawCodec
+		}
+	}
+	codec := encoding.GetCodec(name)
+	if codec == nil {
+		return fmt.Errorf("no codec for payload type:%d", t)
+	}
+	return codec.Unmarshal(d, v)
+}
+
+//WriteMsg 用codecName 编码v, 并设置对应的payload type 发送
+func WriteMsg[T any](s Sessioner, msgid uint16, codecName string, v *T) error {
+	t, ok := proto.LookupPayloadType(codecName)
+	codec := encoding.GetCodec(codecName)
+	if !ok || codec == nil {
+		return fmt.Errorf("unknown codec:%s", codecName)
+	}
+	d, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.WriteTypedMsg(msgid, t, d)
+}
+
+//ReplyMsg 用codecName 编码v, 回应router 正在处理的Call 请求, 见Reply
+func ReplyMsg[T any](s Sessioner, codecName string, v *T) error {
+	t, ok := proto.LookupPayloadType(codecName)
+	codec := encoding.GetCodec(codecName)
+	if !ok || codec == nil {
+		return fmt.Errorf("unknown codec:%s", codecName)
+	}
+	d, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ReplyTyped(s, t, d)
+}
+
+//msgSession 把当前消息的payload type 带给router
+type msgSession struct {
+	Sessioner
+	t byte
+}
+
+func (s *msgSession) PayloadType() byte {
+	return s.t
+}
+
+//WithPayloadType session 调用router 时用, RawBinary 不需要包装
+func WithPayloadType(s Sessioner, t byte) Sessioner {
+	if t == proto.RawBinary {
+		return s
+	}
+	return &msgSession{Sessioner: s, t: t}
+}
+
+//PayloadType 返回router 收到的当前消息的payload type
+func PayloadType(s Sessioner) byte {
+	if pt, ok := s.(interface{ PayloadType() byte }); ok {
+		return pt.PayloadType()
+	}
+	return proto.RawBinary
+}
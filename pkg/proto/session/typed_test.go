@@ -0,0 +1,54 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/jursonmo/practise/pkg/proto"
+)
+
+type typedReq struct {
+	Name string `json:"name" msgpack:"name"`
+}
+
+//loopSession WriteTypedMsg 直接交给rr 里的router, 模拟对端收到
+type loopSession struct {
+	BaseSession
+	rr *RouterRegister
+}
+
+func (s *loopSession) WriteTypedMsg(msgid uint16, t byte, d []byte) error {
+	s.rr.GetRouter(msgid).Handle(WithPayloadType(s, t), msgid, d)
+	return nil
+}
+
+func TestTypedRouter(t *testing.T) {
+	rr := NewRouterRegister()
+	var got []string
+	Handle(rr, 11, func(s Sessioner, req *typedReq) {
+		got = append(got, proto.GetPayloadTypeName(PayloadType(s))+":"+req.Name)
+	})
+	var decodeErr error
+	old := DecodeErrorHandler
+	DecodeErrorHandler = func(s Sessioner, msgid uint16, err error) { decodeErr = err }
+	defer func() { DecodeErrorHandler = old }()
+
+	s := &loopSession{rr: rr}
+	for _, codec := range []string{"json", "msgpack"} {
+		if err := WriteMsg(s, 11, codec, &typedReq{Name: "a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//RawBinary 用RawCodec 解码
+	rr.GetRouter(11).Handle(s, 11, []byte(`{"name":"raw"}`))
+	if len(got) != 3 || got[0] != "json:a" || got[1] != "msgpack:a" || got[2] != "raw:raw" {
+		t.Fatalf("got:%v", got)
+	}
+
+	rr.GetRouter(11).Handle(WithPayloadType(s, proto.JSON), 11, []byte("{bad"))
+	if decodeErr == nil || len(got) != 3 {
+		t.Fatalf("decode err should go to DecodeErrorHandler, got:%v", got)
+	}
+	if err := WriteMsg(s, 11, "unknown", &typedReq{}); err == nil {
+		t.Fatal("unknown codec should fail")
+	}
+}
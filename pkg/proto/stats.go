@@ -0,0 +1,112 @@
+package proto
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//按msgid 统计的最多个数, 超过的msgid 只算在pkg type 里, 防止对端用大量msgid 占用内存
+var DefaultMaxMsgIdStats = 256
+
+type Counter struct {
+	Pkts  uint64
+	Bytes uint64
+}
+
+//Stats ProtoConn 的统计快照, In/Out 按PkgType(Msg, Ping, Pong, Auth) 下标, Bytes 是编码后的大小(压缩后)
+type Stats struct {
+	In           [MaxPkgType + 1]Counter
+	Out          [MaxPkgType + 1]Counter
+	MsgIn        map[uint16]Counter
+	MsgOut       map[uint16]Counter
+	DecodeErrors uint64 //对端的数据不符合协议或者超过限制, see limits.go
+	AuthFailures uint64
+	HeartbeatRTT time.Duration //最近一次心跳的rtt, 0 表示还没有
+}
+
+type counter struct {
+	pkts  uint64
+	bytes uint64
+}
+
+func (c *counter) add(n int) {
+	atomic.AddUint64(&c.pkts, 1)
+	atomic.AddUint64(&c.bytes, uint64(n))
+}
+
+func (c *counter) load() Counter {
+	return Counter{Pkts: atomic.LoadUint64(&c.pkts), Bytes: atomic.LoadUint64(&c.bytes)}
+}
+
+type msgCounters struct {
+	sync.Map //msgid -> *counter
+	n        int32
+}
+
+func (m *msgCounters) add(msgid uint16, n int) {
+	v, ok := m.Load(msgid)
+	if !ok {
+		if int(atomic.LoadInt32(&m.n)) >= DefaultMaxMsgIdStats {
+			return
+		}
+		var loaded bool
+		if v, loaded = m.LoadOrStore(msgid, new(counter)); !loaded {
+			atomic.AddInt32(&m.n, 1)
+		}
+	}
+	v.(*counter).add(n)
+}
+
+func (m *msgCounters) load() map[uint16]Counter {
+	res := make(map[uint16]Counter)
+	m.Range(func(k, v interface{}) bool {
+		res[k.(uint16)] = v.(*counter).load()
+		return true
+	})
+	return res
+}
+
+type connStats struct {
+	in, out       [MaxPkgType + 1]counter
+	msgIn, msgOut msgCounters
+	decodeErrors  uint64
+	authFailures  uint64
+	rtt           int64
+}
+
+func (s *connStats) count(dir *[MaxPkgType + 1]counter, msgs *msgCounters, pkg *ProtoPkg) {
+	n := pkg.Len()
+	dir[pkg.PkgType()].add(n)
+	if pkg.PkgType() == Msg {
+		if id, ok := pkg.MsgId(); ok {
+			msgs.add(id, n)
+		}
+	}
+}
+
+func (pc *ProtoConn) countIn(pkg *ProtoPkg) {
+	pc.stats.count(&pc.stats.in, &pc.stats.msgIn, pkg)
+}
+
+func (pc *ProtoConn) countOut(pkg *ProtoPkg) {
+	pc.stats.count(&pc.stats.out, &pc.stats.msgOut, pkg)
+}
+
+//SetHeartbeatRTT 心跳是在session 层实现的, 由session 设置
+func (pc *ProtoConn) SetHeartbeatRTT(rtt time.Duration) {
+	atomic.StoreInt64(&pc.stats.rtt, int64(rtt))
+}
+
+//Stats return a snapshot of the counters
+func (pc *ProtoConn) Stats() Stats {
+	s := &pc.stats
+	st := Stats{MsgIn: s.msgIn.load(), MsgOut: s.msgOut.load(),
+		DecodeErrors: atomic.LoadUint64(&s.decodeErrors), AuthFailures: atomic.LoadUint64(&s.authFailures),
+		HeartbeatRTT: time.Duration(atomic.LoadInt64(&s.rtt))}
+	for i := range s.in {
+		st.In[i] = s.in[i].load()
+		st.Out[i] = s.out[i].load()
+	}
+	return st
+}
@@ -0,0 +1,41 @@
+package proto
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	c1, c2 := net.Pipe()
+	got := make(chan struct{}, 2)
+	server := NewProtoConn(c1, true, func(*ProtoConn, []byte, byte) error { got <- struct{}{}; return nil })
+	client := NewProtoConn(c2, false, nil)
+	defer server.Close()
+	defer client.Close()
+	go server.Run(context.Background())
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.WriteWithId(7, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-got:
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	client.SetHeartbeatRTT(time.Millisecond)
+
+	out, in := client.Stats(), server.Stats()
+	if out.Out[Msg].Pkts != 2 || out.MsgOut[7].Pkts != 2 || out.HeartbeatRTT != time.Millisecond {
+		t.Fatalf("client stats:%+v", out)
+	}
+	if in.In[Msg] != out.Out[Msg] || in.MsgIn[7] != out.MsgOut[7] {
+		t.Fatalf("server in:%+v, client out:%+v", in, out)
+	}
+	if in.DecodeErrors != 0 || in.AuthFailures != 0 {
+		t.Fatalf("server stats:%+v", in)
+	}
+}
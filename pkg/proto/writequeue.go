@@ -0,0 +1,265 @@
+package proto
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	bufferpool "github.com/jursonmo/practise/pkg/bufferPool"
+)
+
+// WritePolicy decide what to do when the write queue is full
+type WritePolicy int
+
+const (
+	WriteBlock    WritePolicy = iota //等待队列有空间, 直到连接关闭
+	WriteDrop                        //丢弃, 增加drop 计数, 返回ErrWriteDropped
+	WriteFailFast                    //返回ErrQueueFull
+
+	writeDefault WritePolicy = -1 //用WithWriteQueue 指定的policy
+)
+
+var (
+	ErrQueueFull    = errors.New("write queue full")
+	ErrWriteDropped = errors.New("write queue full, dropped")
+	ErrConnClosed   = errors.New("proto conn closed")
+)
+
+var (
+	//writer goroutine 一次合并发送的最大字节数
+	DefaultMaxCoalesceSize = 64 * 1024
+	//Close 时最多等待多久把队列里的数据发送出去
+	DefaultCloseFlushTimeout = time.Second
+)
+
+type WriteQueueStats struct {
+	Depth    int
+	Cap      int
+	Dropped  uint64
+	Rejected uint64 //ErrQueueFull
+	Flushes  uint64 //writer goroutine 调用conn.Write 的次数
+}
+
+//queueItem 是队列里的一个报文, buf 不为nil 时b 在buf 里, 发送后buf 放回pool
+type queueItem struct {
+	b   []byte
+	buf bufferpool.MyBuffer
+}
+
+func (it queueItem) release() {
+	if it.buf != nil {
+		pkgBufPool.Put(it.buf)
+	}
+}
+
+type writeQueue struct {
+	ch       chan queueItem
+	policy   WritePolicy
+	done     chan struct{}
+	err      atomic.Value
+	dropped  uint64
+	rejected uint64
+	flushes  uint64
+}
+
+//WithWriteQueue 开启发送队列, 由单独的goroutine 负责写conn, 多个报文会合并成一次写,
+//policy 是队列满时默认的处理方式, 也可以用WriteWithPolicy 为每次发送指定
+func WithWriteQueue(size int, policy WritePolicy) ProtoConnOpt {
+	return func(pc *ProtoConn) {
+		if size <= 0 {
+			return
+		}
+		pc.wq = &writeQueue{ch: make(chan queueItem, size), policy: policy, done: make(chan struct{})}
+	}
+}
+
+func (q *writeQueue) loadErr() error {
+	if v := q.err.Load(); v != nil {
+		return v.(error)
+	}
+	return nil
+}
+
+func (pc *ProtoConn) startWriter() {
+	if pc.wq != nil {
+		go pc.writeLoop()
+	}
+}
+
+//write 发送已经编码好的数据, b 放进队列后不能再被修改
+func (pc *ProtoConn) write(b []byte) (int, error) {
+	if pc.wq == nil {
+		return pc.conn.Write(b)
+	}
+	return pc.enqueue(queueItem{b: b}, pc.wq.policy)
+}
+
+//writePkg 发送pkg 并Release, 编码用的buffer 来自pool;
+//放进队列时会把pkg 编码到pool buffer 里, 所以返回后调用者可以继续修改payload
+func (pc *ProtoConn) writePkg(pkg *ProtoPkg) (int, error) {
+	return pc.writePkgWithPolicy(pkg, writeDefault)
+}
+
+func (pc *ProtoConn) writePkgWithPolicy(pkg *ProtoPkg, policy WritePolicy) (int, error) {
+	defer pkg.Release()
+	if policy == writeDefault {
+		policy = WriteBlock
+		if pc.wq != nil {
+			policy = pc.wq.policy
+		}
+	}
+	pc.compress(pkg)
+	if pc.isPacketConn && pkg.Len() > pc.maxDatagramSize {
+		return 0, ErrDatagramTooBig
+	}
+	if pc.wq == nil {
+		n, err := pkg.EncodeTo(pc.conn)
+		if n > 0 {
+			pc.countOut(pkg)
+		}
+		return int(n), err
+	}
+	buf := pkgBufPool.Get(pkg.Len())
+	it := queueItem{b: pkg.AppendTo(buf.Bytes()[:0]), buf: buf}
+	n, err := pc.enqueue(it, policy)
+	if n == 0 {
+		//没有放进队列
+		it.release()
+	} else {
+		pc.countOut(pkg)
+	}
+	return n, err
+}
+
+func (pc *ProtoConn) enqueue(it queueItem, policy WritePolicy) (int, error) {
+	b := it.b
+	q := pc.wq
+	if pc.IsClosed() {
+		return 0, ErrConnClosed
+	}
+	if err := q.loadErr(); err != nil {
+		return 0, err
+	}
+	select {
+	case q.ch <- it:
+		return len(b), nil
+	default:
+	}
+
+	switch policy {
+	case WriteDrop:
+		atomic.AddUint64(&q.dropped, 1)
+		return 0, ErrWriteDropped
+	case WriteFailFast:
+		atomic.AddUint64(&q.rejected, 1)
+		return 0, ErrQueueFull
+	}
+	select {
+	case q.ch <- it:
+		return len(b), nil
+	case <-pc.closed:
+		return 0, ErrConnClosed
+	}
+}
+
+func (pc *ProtoConn) writeLoop() {
+	q := pc.wq
+	defer close(q.done)
+
+	buf := make([]byte, 0, DefaultMaxCoalesceSize)
+	flush := func(b []byte) error {
+		atomic.AddUint64(&q.flushes, 1)
+		_, err := pc.conn.Write(b)
+		return err
+	}
+	//把队列里已有的报文合并成一次写, udp 这种报文协议不能合并
+	writeBatch := func(first queueItem) error {
+		if pc.isPacketConn {
+			err := flush(first.b)
+			first.release()
+			if err != nil {
+				return err
+			}
+			for {
+				select {
+				case it := <-q.ch:
+					err := flush(it.b)
+					it.release()
+					if err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		}
+		buf = append(buf[:0], first.b...)
+		first.release()
+		for len(buf) < DefaultMaxCoalesceSize {
+			select {
+			case it := <-q.ch:
+				buf = append(buf, it.b...)
+				it.release()
+				continue
+			default:
+			}
+			break
+		}
+		return flush(buf)
+	}
+
+	for {
+		var err error
+		select {
+		case it := <-q.ch:
+			err = writeBatch(it)
+		case <-pc.closed:
+			//Close, 把剩下的发送出去
+			for {
+				select {
+				case it := <-q.ch:
+					if writeBatch(it) != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+		if err != nil {
+			q.err.Store(err)
+			go pc.Close()
+			return
+		}
+	}
+}
+
+//WriteWithPolicy 跟WriteWithId 一样, 但是指定这次发送队列满时的处理方式, 没有开启发送队列时跟WriteWithId 一样;
+//resume 模式下也带SeqOpt, 被丢弃或者ErrQueueFull 的消息没有发出去, 不会重发
+func (pc *ProtoConn) WriteWithPolicy(id uint16, d []byte, policy WritePolicy) (int, error) {
+	if !pc.authOk {
+		return 0, ErrUnauth
+	}
+	pkg, err := NewMsgIdOptPkg(d, id)
+	if err != nil {
+		return 0, err
+	}
+	if pc.resume != nil {
+		return pc.resume.write(pkg, id, d, policy)
+	}
+	return pc.writePkgWithPolicy(pkg, policy)
+}
+
+func (pc *ProtoConn) WriteQueueStats() WriteQueueStats {
+	q := pc.wq
+	if q == nil {
+		return WriteQueueStats{}
+	}
+	return WriteQueueStats{
+		Depth:    len(q.ch),
+		Cap:      cap(q.ch),
+		Dropped:  atomic.LoadUint64(&q.dropped),
+		Rejected: atomic.LoadUint64(&q.rejected),
+		Flushes:  atomic.LoadUint64(&q.flushes),
+	}
+}
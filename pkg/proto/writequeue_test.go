@@ -0,0 +1,88 @@
+package proto
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteQueue(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	got := make(chan uint16, 100)
+	server := NewProtoConn(c1, true, nil)
+	server.SetMsgHandlerv2(func(pc *ProtoConn, pkg Pkger) error {
+		id, _ := pkg.MsgId()
+		got <- id
+		return nil
+	})
+	client := NewProtoConn(c2, false, nil, WithWriteQueue(16, WriteBlock))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx)
+
+	for i := 0; i < 50; i++ {
+		if _, err := client.WriteWithId(uint16(i), []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		select {
+		case id := <-got:
+			if id != uint16(i) {
+				t.Fatalf("expect msgid:%d, got:%d", i, id)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("timeout")
+		}
+	}
+	client.Close()
+}
+
+func TestWriteQueuePolicy(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	//nobody read c1, so the writer goroutine block on the first write
+	client := NewProtoConn(c2, false, nil, WithWriteQueue(2, WriteFailFast))
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		_, err = client.WriteWithId(11, []byte("hello"))
+	}
+	if !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expect ErrQueueFull, err:%v", err)
+	}
+	if _, err = client.WriteWithPolicy(11, []byte("hello"), WriteDrop); !errors.Is(err, ErrWriteDropped) {
+		t.Fatalf("expect ErrWriteDropped, err:%v", err)
+	}
+	stats := client.WriteQueueStats()
+	if stats.Depth != 2 || stats.Cap != 2 || stats.Dropped != 1 || stats.Rejected != 1 {
+		t.Fatalf("stats:%+v", stats)
+	}
+
+	//blocked writer return when conn closed, the err may be nil if the closing writer goroutine drained the queue first
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.WriteWithPolicy(11, []byte("hello"), WriteBlock)
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+	client.Close()
+	select {
+	case err := <-done:
+		if err != nil && !errors.Is(err, ErrConnClosed) {
+			t.Fatalf("expect ErrConnClosed, err:%v", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("blocked writer not return after Close")
+	}
+	if _, err := client.WriteWithId(11, []byte("hello")); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("write after Close, expect ErrConnClosed, err:%v", err)
+	}
+}
@@ -145,7 +145,12 @@ func (ln *UdpListen) Listen() {
 				if err != nil {
 					return
 				}
-				ln.accept <- conn
+				select {
+				case ln.accept <- conn:
+				case <-ln.dead:
+					conn.Close()
+					return
+				}
 			}
 		}(l)
 	}
@@ -186,8 +191,8 @@ func (l *UdpListen) Close() error {
 	l.closed = true
 	l.Unlock()
 
+	//不关闭accept, 避免Listen goroutine 往关闭的channel 发送, Accept 会检查dead
 	close(l.dead)
-	close(l.accept)
 
 	for _, listener := range l.listeners {
 		if listener == nil {
@@ -207,7 +212,7 @@ type Listener struct {
 	clients        sync.Map
 	accept         chan *UDPConn
 	txqueue        chan MyBuffer
-	writeBatchAble bool // write batch is enable?
+	writeBatchAble int32 // write batch is enable? atomic
 	batchs         int
 	maxPacketSize  int
 	dead           chan struct{}
@@ -234,7 +239,7 @@ func WithLnMaxPacketSize(n int) ListenerOpt {
 }
 
 func NewListener(ctx context.Context, network, addr string, opts ...ListenerOpt) (*Listener, error) {
-	l := &Listener{batchs: defaultBatchs, maxPacketSize: defaultMaxPacketSize}
+	l := &Listener{batchs: defaultBatchs, maxPacketSize: defaultMaxPacketSize, dead: make(chan struct{})}
 	for _, opt := range opts {
 		opt(l)
 	}
@@ -336,7 +341,10 @@ func (l *Listener) getUDPConn(addr net.Addr) (uc *UDPConn) {
 		uc = NewUDPConn(l, l.lconn, udpaddr, WithBatchs(0), WithMaxPacketSize(l.maxPacketSize))
 		log.Printf("%v, new conn:%v", l, addr)
 		l.clients.Store(key, uc)
-		l.accept <- uc
+		select {
+		case l.accept <- uc:
+		case <-l.dead:
+		}
 	} else {
 		uc = v.(*UDPConn)
 	}
@@ -374,6 +382,7 @@ func (l *Listener) Addr() net.Addr {
 func (l *Listener) Close() error {
 	l.Lock()
 	if l.closed {
+		l.Unlock()
 		return ErrLnClosed
 	}
 	l.closed = true
@@ -382,13 +391,19 @@ func (l *Listener) Close() error {
 	log.Printf("%v closing....", l)
 	defer log.Printf("%v over", l)
 	close(l.dead)
-	close(l.accept)
+	//PutTxQueue 在锁里检查closed, 这里关闭txqueue 是安全的
 	if l.txqueue != nil {
 		close(l.txqueue)
 	}
 	return l.lconn.Close()
 }
 
+func (l *Listener) isClosed() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.closed
+}
+
 func (l *Listener) String() string {
 	return fmt.Sprintf("listener, id:%d, local:%s", l.id, l.LocalAddr().String())
 }
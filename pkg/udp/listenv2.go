@@ -24,6 +24,9 @@ func (l *Listener) readBatchLoopv2() {
 		}
 		n, err = l.pc.ReadBatch(rms, 0)
 		if err != nil {
+			if l.isClosed() {
+				return
+			}
 			l.Close()
 			panic(err)
 		}
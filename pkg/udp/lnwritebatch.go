@@ -3,6 +3,7 @@ package udp
 import (
 	"errors"
 	"log"
+	"sync/atomic"
 
 	"golang.org/x/net/ipv4"
 )
@@ -38,6 +39,12 @@ func (c *UDPConn) WriteWithBatch(data []byte) (n int, err error) {
 
 //返回的error 应该实现net.Error temporary(), 这样上层Write可以认为Eagain,再次调用Write
 func (l *Listener) PutTxQueue(b MyBuffer) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		Release(b)
+		return ErrLnClosed
+	}
 	select {
 	case l.txqueue <- b:
 	default:
@@ -48,13 +55,13 @@ func (l *Listener) PutTxQueue(b MyBuffer) error {
 }
 
 func (l *Listener) WriteBatchAble() bool {
-	return l.writeBatchAble
+	return atomic.LoadInt32(&l.writeBatchAble) == 1
 }
 
 func (l *Listener) writeBatchLoop() {
 	bw, _ := NewPCBioWriter(l.pc, l.batchs)
-	l.writeBatchAble = true
-	defer func() { l.writeBatchAble = false }()
+	atomic.StoreInt32(&l.writeBatchAble, 1)
+	defer atomic.StoreInt32(&l.writeBatchAble, 0)
 	defer log.Printf("id:%d, listener %v, writeBatchLoop quit", l.id, l.pc.LocalAddr())
 
 	bw.WriteBatchLoop(l.txqueue)
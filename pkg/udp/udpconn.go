@@ -272,7 +272,7 @@ func (c *UDPConn) Write(b []byte) (n int, err error) {
 
 	//the conn that accepted by listener
 	//由listener accept产生的UDPConn, 发送前判断是否是关闭状态. dial 产生UDPConn，如果已经关闭，底层socket 会报错返回，不需要判断
-	if c.closed {
+	if c.IsClosed() {
 		return 0, ErrConnClosed
 	}
 	if c.ln.WriteBatchAble() {